@@ -36,6 +36,7 @@ import (
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 )
 
 var (
@@ -64,14 +65,27 @@ to quickly create a Cobra application.`,
 			return err
 		}
 
-		if !util.ContainsString(sql.Drivers(), cmdConfig.Driver) {
-			return fmt.Errorf("%s is not one of the supported drivers: %s", cmdConfig.Driver, strings.Join(sql.Drivers(), ", "))
+		for _, namingContext := range append([]types.NamingContext{cmdConfig.NamingContext}, cmdConfig.NamingContexts...) {
+			if !util.ContainsString(sql.Drivers(), namingContext.Driver) {
+				return fmt.Errorf("%s is not one of the supported drivers: %s", namingContext.Driver, strings.Join(sql.Drivers(), ", "))
+			}
+		}
+
+		if err := pkg.CheckRateLimits(cmdConfig.RateLimits); err != nil {
+			return err
+		}
+
+		// the flag default of the group rdn only applies to the top level
+		for i := range cmdConfig.NamingContexts {
+			if cmdConfig.NamingContexts[i].GroupRdn == "" {
+				cmdConfig.NamingContexts[i].GroupRdn = "cn"
+			}
 		}
 
 		return nil
 	},
 	Run: func(cmd *cobra.Command, args []string) {
-		backend, err := pkg.NewBackend(cmdConfig.Driver, cmdConfig.Conn, cmdConfig.AuthQuery, cmdConfig.SearchQuery)
+		backend, err := pkg.NewBackend(cmdConfig.BackendConfig)
 		if err != nil {
 			jww.ERROR.Fatalf("Error configuring backend: %v", err)
 		}
@@ -81,13 +95,67 @@ to quickly create a Cobra application.`,
 			jww.ERROR.Fatalf("Error loading tls certificate: %v", err)
 		}
 
-		frontend := pkg.NewFrontend(cmdConfig.ServerAddress, cert, cmdConfig.BaseDn, cmdConfig.Rdn, cmdConfig.Attributes, backend)
+		options := []pkg.Option{pkg.WithBindPolicy(cmdConfig.BindPolicy)}
+		for _, option := range namingContextOptions(cmdConfig.NamingContext) {
+			options = append(options, option)
+		}
+		passwordModify := cmdConfig.UpdatePasswordQuery != ""
+		writeOperations := writesUsers(cmdConfig.NamingContext)
+		for _, namingContext := range cmdConfig.NamingContexts {
+			contextBackend, err := pkg.NewBackend(namingContext.BackendConfig)
+			if err != nil {
+				jww.ERROR.Fatalf("Error configuring backend of %s: %v", namingContext.BaseDn, err)
+			}
+
+			options = append(options, pkg.WithNamingContext(namingContext.BaseDn, namingContext.Rdn, namingContext.Attributes, contextBackend, namingContextOptions(namingContext)...))
+			passwordModify = passwordModify || namingContext.UpdatePasswordQuery != ""
+			writeOperations = writeOperations || writesUsers(namingContext)
+		}
+		if len(cmdConfig.ServiceAccounts) > 0 {
+			options = append(options, pkg.WithServiceAccounts(cmdConfig.ServiceAccounts))
+		}
+		if len(cmdConfig.AccessRules) > 0 {
+			options = append(options, pkg.WithAccessRules(cmdConfig.AccessRules))
+		}
+		if cmdConfig.LockoutFailures > 0 {
+			var store types.LockoutStore
+			if cmdConfig.LockoutQuery != "" {
+				store, err = pkg.NewLockoutStore(cmdConfig.Driver, cmdConfig.Conn, cmdConfig.LockoutPolicy)
+				if err != nil {
+					jww.ERROR.Fatalf("Error configuring lockout: %v", err)
+				}
+			}
+			options = append(options, pkg.WithLockout(cmdConfig.LockoutPolicy, store))
+		}
+		if passwordModify {
+			options = append(options, pkg.WithPasswordModify(cmdConfig.PasswordAdmins))
+		}
+		if writeOperations {
+			options = append(options, pkg.WithWriteOperations(cmdConfig.WriteAdmins))
+		}
+		if cmdConfig.SizeLimit > 0 || cmdConfig.TimeLimit > 0 {
+			options = append(options, pkg.WithSearchLimits(cmdConfig.SizeLimit, time.Duration(cmdConfig.TimeLimit)*time.Second))
+		}
+		if cmdConfig.SortLimit > 0 {
+			options = append(options, pkg.WithSortLimit(cmdConfig.SortLimit))
+		}
+		if cmdConfig.RateLimit > 0 || cmdConfig.UserRateLimit > 0 || len(cmdConfig.TrustedNetworks) > 0 {
+			options = append(options, pkg.WithRateLimits(cmdConfig.RateLimits))
+		}
+		if cmdConfig.StartTlsAddress != "" {
+			options = append(options, pkg.WithStartTls(cmdConfig.StartTlsAddress, cmdConfig.RequireTls))
+		}
+
+		frontend := pkg.NewFrontend(cmdConfig.ServerAddress, cert, cmdConfig.BaseDn, cmdConfig.Rdn, cmdConfig.Attributes, backend, options...)
+		if err := frontend.CheckSchema(); err != nil {
+			jww.ERROR.Fatalf("Error checking schema: %v", err)
+		}
 
 		frontend.Serve()
 
 		// When CTRL+C, SIGINT and SIGTERM signal occurs
 		// Then stop server gracefully
-		ch := make(chan os.Signal)
+		ch := make(chan os.Signal, 1)
 		signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
 		<-ch
 		close(ch)
@@ -96,6 +164,32 @@ to quickly create a Cobra application.`,
 	},
 }
 
+// namingContextOptions returns the options configuring the trees of the naming
+// context.
+func namingContextOptions(namingContext types.NamingContext) []pkg.TreeOption {
+	options := []pkg.TreeOption{pkg.WithObjectClasses(namingContext.ObjectClasses)}
+	if len(namingContext.DnAttributes) > 0 {
+		options = append(options, pkg.WithDnAttributes(namingContext.DnAttributes))
+	}
+	if len(namingContext.TimestampAttributes) > 0 {
+		options = append(options, pkg.WithTimestampAttributes(namingContext.TimestampAttributes))
+	}
+	if len(namingContext.ComputedAttributes) > 0 {
+		options = append(options, pkg.WithComputedAttributes(namingContext.ComputedAttributes))
+	}
+	if namingContext.GroupBaseDn != "" {
+		options = append(options, pkg.WithGroups(namingContext.GroupBaseDn, namingContext.GroupRdn, namingContext.GroupAttributes))
+		options = append(options, pkg.WithGroupObjectClasses(namingContext.GroupObjectClasses))
+	}
+
+	return options
+}
+
+// writesUsers checks if a write operation is configured for the naming context.
+func writesUsers(namingContext types.NamingContext) bool {
+	return namingContext.AddQuery != "" || len(namingContext.ModifyQueries) > 0 || namingContext.DeleteQuery != ""
+}
+
 // Execute adds all child commands to the root command sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
@@ -109,16 +203,51 @@ func init() {
 	cobra.OnInitialize(initConfig)
 
 	RootCmd.Flags().String("serverAddress", "127.0.0.1:1636", "the address to listen on")
+	RootCmd.Flags().String("startTlsAddress", "", "an additional address to listen on for plain ldap connections supporting StartTLS")
+	RootCmd.Flags().Bool("requireTls", false, "refuse binds and searches on plain connections until StartTLS succeeded")
+	RootCmd.Flags().Bool("allowAnonymousBind", true, "allow anonymous binds, i.e. with empty dn and password")
+	RootCmd.Flags().Bool("allowUnauthenticatedBind", false, "allow unauthenticated binds, i.e. with a dn and an empty password, which leave the connection anonymous")
+	RootCmd.Flags().Bool("anonymousRootDse", true, "allow anonymous connections to read the root DSE and the subschema")
+	RootCmd.Flags().Int("lockoutFailures", 0, "the number of failed binds locking a user out, 0 disables the lockout")
+	RootCmd.Flags().Int("lockoutWindow", 300, "the number of seconds the failed binds are counted for")
+	RootCmd.Flags().Int("lockoutDuration", 900, "the number of seconds a user is locked out")
+	RootCmd.Flags().Bool("lockoutPerSourceIp", false, "count the failed binds of every source address of a user separately")
+	RootCmd.Flags().String("lockoutQuery", "", "a sql query to load the lockout of a user, the named parameters ':user' and ':source' select a row of the columns failures, since and lockedUntil (unix timestamps). Keeps the lockout in the database instead of the memory")
+	RootCmd.Flags().String("lockoutFailQuery", "", "a sql query to count a failed bind of a user in a single statement, taking the named parameters ':user', ':source', ':since' and ':windowStart' and returning the columns of the lockout query. Failures since before ':windowStart' start a new window at ':since'")
+	RootCmd.Flags().String("lockoutUpdateQuery", "", "a sql query to store the lockout of a user, taking the named parameters ':user', ':source', ':failures', ':since' and ':lockedUntil'")
+	RootCmd.Flags().String("unlockQuery", "", "a sql query to remove the lockouts of a user, taking the named parameter ':user'")
+	RootCmd.Flags().Int("sizeLimit", 0, "the maximum number of entries returned by a search, 0 for unlimited")
+	RootCmd.Flags().Int("timeLimit", 0, "the maximum number of seconds a search may take, 0 for unlimited")
+	RootCmd.Flags().Int("sortLimit", 10000, "the maximum number of entries a search sorts in memory")
+	RootCmd.Flags().Float64("rateLimit", 0, "the binds and searches per second allowed to a client address, 0 for unlimited")
+	RootCmd.Flags().Int("rateBurst", 0, "the binds and searches a client address may send at once (default the rate limit)")
+	RootCmd.Flags().Float64("userRateLimit", 0, "the binds per second allowed to a user, 0 for unlimited")
+	RootCmd.Flags().Int("userRateBurst", 0, "the binds a user may send at once (default the user rate limit)")
+	RootCmd.Flags().Int("tarpitDelay", 500, "the milliseconds an operation exceeding a rate limit is delayed, doubled for every further operation")
+	RootCmd.Flags().Int("maxTarpitDelay", 10000, "the maximum milliseconds an operation is delayed, operations exceeding it are refused")
 	RootCmd.Flags().String("cert", "", "a pem encoded certificate")
 	RootCmd.Flags().String("key", "", "a pem encoded certificate key")
 
 	RootCmd.Flags().String("driver", "", fmt.Sprintf("the sql driver to use (%s)", strings.Join(sql.Drivers(), ", ")))
 	RootCmd.Flags().String("conn", "", "the connection string")
-	RootCmd.Flags().String("authQuery", "", "a sql query to retrieve the password by the username. The username is passed a the first parameter. The query must return one field, the password")
-	RootCmd.Flags().String("searchQuery", "", "a sql query to retrieve the user attributes. This string should contain one %s for the projection and one ? for the selection")
+	RootCmd.Flags().String("authQuery", "", "a sql query to retrieve the password by the username. The username is passed a the first parameter. The first field must be the password, the optional fields locked, expired, mustChange, graceLogins and expiresIn are reported by the password policy control")
+	RootCmd.Flags().String("searchQuery", "", "a sql query to retrieve the user attributes. The username is passed as the first parameter. The column names must match the attribute names, as search filters are evaluated on the query wrapped as sub query")
+	RootCmd.Flags().String("listQuery", "", "a sql query to retrieve the attributes of all users. It is used for searches not selecting a single user and has the same columns as the searchQuery")
+	RootCmd.Flags().String("updatePasswordQuery", "", "a sql query to store a new password. The password hash is passed as the first and the username as the second parameter. Enables the password modify extended operation")
+	RootCmd.Flags().StringArray("passwordAdmins", nil, "a dn allowed to change the password of every user, can be repeated")
+	RootCmd.Flags().String("addQuery", "", "a sql query to insert a user. The rdn and the attributes are passed as named parameters (e.g. ':mail'), missing attributes are NULL and the userPassword is hashed. Enables the add operation")
+	RootCmd.Flags().String("deleteQuery", "", "a sql query to delete a user. The rdn is passed as named parameter (e.g. ':cn'). Enables the delete operation")
+	RootCmd.Flags().StringArray("writeAdmins", nil, "a dn allowed to add, modify and delete users, can be repeated")
 	RootCmd.Flags().String("rdn", "", "the rdn of the user")
 	RootCmd.Flags().String("baseDn", "", "the base dn for users")
 	RootCmd.Flags().StringSlice("attributes", nil, "the attributes supported by the query provided to the backend backend (format: 'attr1,attr2,attr3,...')")
+	RootCmd.Flags().StringSlice("timestampAttributes", nil, "attributes served as GeneralizedTime, their columns hold times, text or unix timestamps (format: 'attr1,attr2,...')")
+	RootCmd.Flags().StringSlice("objectClasses", nil, "the object classes of the users, their required attributes must be served (format: 'class1,class2,...', default 'top')")
+	RootCmd.Flags().String("groupQuery", "", "a sql query to retrieve the groups. It must return a row per group and member, with the rdn value of the user in the column 'member'")
+	RootCmd.Flags().String("groupRdn", "cn", "the rdn of the groups")
+	RootCmd.Flags().String("groupBaseDn", "", "the base dn for groups, groups are only served if it is set")
+	RootCmd.Flags().StringSlice("groupAttributes", nil, "additional attributes of the groups returned by the group query (format: 'attr1,attr2,attr3,...')")
+	RootCmd.Flags().StringSlice("groupObjectClasses", nil, "the object classes of the groups (format: 'class1,class2,...', default 'top,groupOfNames' and 'posixGroup' if the groups have a gidNumber)")
 
 	RootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/minimal-ldap-proxy.yaml)")
 }
@@ -132,13 +261,48 @@ func initConfig() {
 
 	flags := []string{
 		"serverAddress",
+		"startTlsAddress",
+		"requireTls",
+		"allowAnonymousBind",
+		"allowUnauthenticatedBind",
+		"anonymousRootDse",
+		"lockoutFailures",
+		"lockoutWindow",
+		"lockoutDuration",
+		"lockoutPerSourceIp",
+		"lockoutQuery",
+		"lockoutFailQuery",
+		"lockoutUpdateQuery",
+		"unlockQuery",
+		"sizeLimit",
+		"timeLimit",
+		"sortLimit",
+		"rateLimit",
+		"rateBurst",
+		"userRateLimit",
+		"userRateBurst",
+		"tarpitDelay",
+		"maxTarpitDelay",
 		"driver",
 		"conn",
 		"authQuery",
 		"searchQuery",
+		"listQuery",
+		"updatePasswordQuery",
+		"passwordAdmins",
+		"addQuery",
+		"deleteQuery",
+		"writeAdmins",
 		"rdn",
 		"baseDn",
 		"attributes",
+		"timestampAttributes",
+		"objectClasses",
+		"groupQuery",
+		"groupRdn",
+		"groupBaseDn",
+		"groupAttributes",
+		"groupObjectClasses",
 		"cert",
 		"key",
 	}
@@ -1,24 +1,65 @@
 package pkg
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"github.com/gopenguin/minimal-ldap-proxy/pkg/password"
 	"github.com/gopenguin/minimal-ldap-proxy/types"
 	sql "github.com/jmoiron/sqlx"
 	jww "github.com/spf13/jwalterweatherman"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
-func NewBackend(driver string, connString string, authQuery string, searchQuery string) (types.Backend, error) {
-	db, err := sql.Open(driver, connString)
+func NewBackend(config types.BackendConfig) (types.Backend, error) {
+	db, err := sql.Open(config.Driver, config.Conn)
 	if err != nil {
 		return nil, err
 	}
 
+	columns := make(map[string]string)
+	for _, mapping := range config.Mapping {
+		columns[attributeKey(mapping.Attribute)] = mapping.Column
+	}
+
+	modifyQueries := make(map[string]types.ModifyQuery)
+	for _, modify := range config.ModifyQueries {
+		modifyQueries[attributeKey(modify.Attribute)] = modify
+	}
+
+	timestampFormats := make(map[string]string)
+	for _, attribute := range config.TimestampAttributes {
+		if err := checkTimestampAttribute(attribute); err != nil {
+			return nil, err
+		}
+		timestampFormats[attributeKey(attribute)] = ""
+	}
+	for _, timestamp := range config.TimestampFormats {
+		timestampFormats[attributeKey(timestamp.Attribute)] = timestamp.Format
+	}
+
 	return &sqlBackend{
-		db: db,
+		db:               db,
+		columns:          columns,
+		timestampFormats: timestampFormats,
+
+		authQuery:   config.AuthQuery,
+		searchQuery: config.SearchQuery,
+		listQuery:   config.ListQuery,
+		rdn:         config.Rdn,
+		groupQuery:  config.GroupQuery,
+		groupRdn:    config.GroupRdn,
 
-		authQuery:   authQuery,
-		searchQuery: searchQuery,
+		updatePasswordQuery: config.UpdatePasswordQuery,
+
+		addQuery:      config.AddQuery,
+		modifyQueries: modifyQueries,
+		deleteQuery:   config.DeleteQuery,
 	}, nil
 }
 
@@ -27,25 +68,451 @@ type sqlBackend struct {
 
 	authQuery   string
 	searchQuery string
+	listQuery   string
+	rdn         string
+	groupQuery  string
+	groupRdn    string
+
+	// columns maps the attributes to the columns of the queries holding them,
+	// attributes without mapping are held by the column of the same name
+	columns map[string]string
+	// timestampFormats are keyed like the columns and hold the configured
+	// timestamp attributes, columns without format hold times
+	timestampFormats map[string]string
+
+	updatePasswordQuery string
+
+	addQuery string
+	// modifyQueries are keyed like the columns
+	modifyQueries map[string]types.ModifyQuery
+	deleteQuery   string
 }
 
-func (b *sqlBackend) Authenticate(user string, pw string) bool {
-	row := b.db.QueryRow(b.authQuery, user)
+// Authenticate verifies the password returned by the first column of the auth
+// query. The optional columns locked, expired, mustChange, graceLogins and
+// expiresIn describe the state of the password.
+func (b *sqlBackend) Authenticate(user string, pw string) (bool, types.PasswordPolicy) {
+	var policy types.PasswordPolicy
+
+	rows, err := b.db.Queryx(b.authQuery, user)
+	if err != nil {
+		jww.WARN.Printf("Error fetching pw: %v", err)
+		return false, policy
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		jww.WARN.Printf("Error fetching pw: user '%s' not found", user)
+		return false, policy
+	}
 
-	var passwordHash string
-	err := row.Scan(&passwordHash)
+	columns, err := rows.Columns()
 	if err != nil {
 		jww.WARN.Printf("Error fetching pw: %v", err)
+		return false, policy
+	}
+
+	values, err := rows.SliceScan()
+	if err != nil {
+		jww.WARN.Printf("Error fetching pw: %v", err)
+		return false, policy
+	}
+
+	for i, column := range columns[1:] {
+		value := values[i+1]
+		switch strings.ToLower(column) {
+		case "locked":
+			policy.Locked = columnBool(value)
+		case "expired":
+			policy.Expired = columnBool(value)
+		case "mustchange":
+			policy.MustChange = columnBool(value)
+		case "gracelogins":
+			policy.GraceLogins = columnInt(value)
+		case "expiresin":
+			policy.ExpiresIn = columnInt(value)
+		}
+	}
+
+	return password.Verify(pw, columnString(values[0])), policy
+}
+
+func columnString(value interface{}) string {
+	if b, ok := value.([]byte); ok {
+		return string(b)
+	}
+
+	return fmt.Sprint(value)
+}
+
+// columnBool interprets the value of a column as boolean, databases without
+// boolean type return numbers or strings instead.
+func columnBool(value interface{}) bool {
+	switch value := value.(type) {
+	case nil:
 		return false
+	case bool:
+		return value
+	case int64:
+		return value != 0
 	}
 
-	return password.Verify(pw, passwordHash)
+	b, err := strconv.ParseBool(columnString(value))
+	return err == nil && b
 }
 
-func (b *sqlBackend) Search(user string, attributes []string) *types.Result {
-	attrs := make(map[string]interface{})
+// columnInt interprets the value of a column as number, NULL and other values
+// are zero.
+func columnInt(value interface{}) int {
+	if value == nil {
+		return 0
+	}
+
+	n, err := strconv.Atoi(columnString(value))
+	if err != nil {
+		return 0
+	}
+
+	return n
+}
+
+// UpdatePassword stores the password hash of the user, passing the hash as
+// first and the user as second parameter to the update password query.
+func (b *sqlBackend) UpdatePassword(user string, passwordHash string) error {
+	if b.updatePasswordQuery == "" {
+		return fmt.Errorf("no update password query configured")
+	}
+
+	res, err := b.db.Exec(b.updatePasswordQuery, passwordHash, user)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("user '%s' not found", user)
+	}
+
+	return nil
+}
+
+// Add inserts the user, the rdn value and the attributes are passed as the
+// named parameters of the add query. The values of attributes with several
+// values are inserted with their add queries afterwards.
+func (b *sqlBackend) Add(user string, attributes map[string][]string) error {
+	if b.addQuery == "" {
+		return fmt.Errorf("add query %w", types.ErrNotConfigured)
+	}
+
+	names := make([]string, 0, len(attributes))
+	for attribute := range attributes {
+		names = append(names, attribute)
+	}
+	sort.Strings(names)
+
+	values := make(map[string]*string)
+	var changes []types.Change
+	for _, attribute := range names {
+		for i := range attributes[attribute] {
+			value := &attributes[attribute][i]
+			switch {
+			case b.isMultiValued(attribute):
+				changes = append(changes, types.Change{Operation: types.ChangeAdd, Attribute: attribute, Value: value})
+			case i > 0:
+				return fmt.Errorf("attribute '%s' %w", attribute, types.ErrSingleValue)
+			default:
+				values[attributeKey(attribute)] = value
+			}
+		}
+	}
+	values[attributeKey(b.rdn)] = &user
+
+	return b.transaction(func(tx *sql.Tx) error {
+		current, err := b.currentValues(tx, user, nil)
+		if err != nil {
+			return err
+		}
+		if current != nil {
+			return fmt.Errorf("user '%s' %w", user, types.ErrExists)
+		}
+
+		if _, err := tx.NamedExec(b.addQuery, b.namedArguments(b.addQuery, values)); err != nil {
+			return err
+		}
+
+		return b.execChanges(tx, user, changes)
+	})
+}
+
+// Modify runs the modify queries of the attributes for every change in a
+// single transaction. The changes are verified against the values the search
+// query returns within the transaction, as far as it returns the attributes.
+func (b *sqlBackend) Modify(user string, changes []types.Change) error {
+	var attributes []string
+	seen := make(map[string]bool)
+	for _, change := range changes {
+		if _, err := b.changeQueries(change); err != nil {
+			return err
+		}
+		if !seen[attributeKey(change.Attribute)] {
+			seen[attributeKey(change.Attribute)] = true
+			attributes = append(attributes, change.Attribute)
+		}
+	}
+
+	return b.transaction(func(tx *sql.Tx) error {
+		current, err := b.currentValues(tx, user, attributes)
+		if err != nil {
+			return err
+		}
+		if current == nil {
+			return fmt.Errorf("user '%s' %w", user, types.ErrNotFound)
+		}
+
+		for _, change := range changes {
+			if err := applyChange(current, change, b.isMultiValued(change.Attribute)); err != nil {
+				return err
+			}
+		}
+
+		return b.execChanges(tx, user, changes)
+	})
+}
+
+// changeQuery is a statement of a change and the value passed to it.
+type changeQuery struct {
+	query string
+	value *string
+}
+
+// changeQueries returns the statements of a change. Attributes with several
+// values are replaced by deleting all values and adding the new one.
+func (b *sqlBackend) changeQueries(change types.Change) ([]changeQuery, error) {
+	modify := b.modifyQueries[attributeKey(change.Attribute)]
+
+	var queries []changeQuery
+	switch {
+	case !b.isMultiValued(change.Attribute):
+		value := change.Value
+		if change.Operation == types.ChangeDelete {
+			value = nil
+		}
+		queries = []changeQuery{{modify.Query, value}}
+	case change.Operation == types.ChangeAdd:
+		queries = []changeQuery{{modify.AddQuery, change.Value}}
+	case change.Operation == types.ChangeDelete:
+		queries = []changeQuery{{modify.DeleteQuery, change.Value}}
+	default:
+		queries = []changeQuery{{modify.DeleteQuery, nil}}
+		if change.Value != nil {
+			queries = append(queries, changeQuery{modify.AddQuery, change.Value})
+		}
+	}
+
+	for _, query := range queries {
+		if query.query == "" {
+			return nil, fmt.Errorf("modify query for '%s' %w", change.Attribute, types.ErrNotConfigured)
+		}
+	}
+
+	return queries, nil
+}
+
+// execChanges runs the statements of the changes, the value and the rdn value
+// are passed as named parameters.
+func (b *sqlBackend) execChanges(tx *sql.Tx, user string, changes []types.Change) error {
+	for _, change := range changes {
+		queries, err := b.changeQueries(change)
+		if err != nil {
+			return err
+		}
+
+		for _, query := range queries {
+			values := map[string]*string{
+				attributeKey(change.Attribute): query.value,
+				attributeKey(b.rdn):            &user,
+			}
+			if _, err := tx.NamedExec(query.query, b.namedArguments(query.query, values)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// isMultiValued tells whether the statements of the attribute store several
+// values.
+func (b *sqlBackend) isMultiValued(attribute string) bool {
+	return b.modifyQueries[attributeKey(attribute)].AddQuery != ""
+}
+
+// Delete removes the user, the rdn value is passed as named parameter of the
+// delete query.
+func (b *sqlBackend) Delete(user string) error {
+	if b.deleteQuery == "" {
+		return fmt.Errorf("delete query %w", types.ErrNotConfigured)
+	}
+
+	return b.transaction(func(tx *sql.Tx) error {
+		res, err := tx.NamedExec(b.deleteQuery, b.namedArguments(b.deleteQuery, map[string]*string{attributeKey(b.rdn): &user}))
+		if err != nil {
+			return err
+		}
+
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			return fmt.Errorf("user '%s' %w", user, types.ErrNotFound)
+		}
+
+		return nil
+	})
+}
+
+// currentValues returns the values of the attributes of the user read with the
+// search query within the transaction, keyed by the attribute keys. Attributes
+// the query doesn't return are missing, the values are nil if the user doesn't
+// exist.
+func (b *sqlBackend) currentValues(tx *sql.Tx, user string, attributes []string) (map[string][]string, error) {
+	rows, err := tx.Queryx(b.searchQuery, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var values map[string][]string
+	for rows.Next() {
+		row, err := scanRow(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		if values == nil {
+			values = make(map[string][]string)
+		}
+		for _, attribute := range attributes {
+			if _, ok := row[strings.ToLower(b.column(attribute))]; !ok {
+				continue
+			}
+
+			result := &types.Result{Attributes: make(map[string][]string)}
+			b.addValues(result, row, []string{attribute})
+			key := attributeKey(attribute)
+			values[key] = append(values[key], result.Attributes[attribute]...)
+		}
+	}
+
+	return values, rows.Err()
+}
+
+// applyChange verifies the change against the current values as RFC 4511,
+// section 4.6 requires and applies it to them. Attributes without current
+// values can't be verified until they are replaced.
+func applyChange(current map[string][]string, change types.Change, multiValued bool) error {
+	key := attributeKey(change.Attribute)
+	values, ok := current[key]
+
+	switch change.Operation {
+	case types.ChangeAdd:
+		if change.Value == nil {
+			return nil
+		}
+		if valueIndex(change.Attribute, values, *change.Value) >= 0 {
+			return fmt.Errorf("attribute '%s' %w", change.Attribute, types.ErrValueExists)
+		}
+		if len(values) > 0 && !multiValued {
+			return fmt.Errorf("attribute '%s' %w", change.Attribute, types.ErrSingleValue)
+		}
+		if ok || !multiValued {
+			current[key] = append(values, *change.Value)
+		}
+	case types.ChangeDelete:
+		if !ok {
+			return nil
+		}
+
+		i := 0
+		if change.Value != nil {
+			i = valueIndex(change.Attribute, values, *change.Value)
+		}
+		if i < 0 || len(values) == 0 {
+			return fmt.Errorf("attribute '%s' %w", change.Attribute, types.ErrNoSuchValue)
+		}
+
+		if change.Value == nil {
+			current[key] = nil
+		} else {
+			current[key] = append(values[:i:i], values[i+1:]...)
+		}
+	default:
+		current[key] = nil
+		if change.Value != nil {
+			current[key] = []string{*change.Value}
+		}
+	}
+
+	return nil
+}
+
+// valueIndex returns the index of the value equal to the given one, or -1.
+func valueIndex(attribute string, values []string, value string) int {
+	for i, v := range values {
+		if equalityMatch(attribute, v, value) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// transaction runs fn in a transaction, which is committed if fn succeeds and
+// rolled back otherwise.
+func (b *sqlBackend) transaction(fn func(tx *sql.Tx) error) error {
+	tx, err := b.db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			jww.WARN.Printf("Error rolling back: %v", rollbackErr)
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// namedParameter matches the named parameters of a query. sqlx reads '::' as
+// an escaped ':', so a cast like '::text' must be written as '::::text'.
+var namedParameter = regexp.MustCompile(`(^|[^:]):([A-Za-z_][A-Za-z0-9_]*)`)
+
+// namedArguments returns the arguments of the named parameters of the query.
+// Parameters are matched to the attributes of the values like the columns,
+// parameters without value are NULL. Values of binary attributes are passed as
+// bytes and timestamps in the format of their column.
+func (b *sqlBackend) namedArguments(query string, values map[string]*string) map[string]interface{} {
+	args := make(map[string]interface{})
+	for _, match := range namedParameter.FindAllStringSubmatch(query, -1) {
+		name := match[2]
+		switch value := values[attributeKey(name)]; {
+		case value == nil:
+			args[name] = nil
+		case isBinaryAttribute(name):
+			args[name] = []byte(*value)
+		case b.isTimestampAttribute(name):
+			args[name] = b.timestampArgument(name, *value)
+		default:
+			args[name] = *value
+		}
+	}
 
-	rows, err := b.db.Queryx(b.searchQuery, user)
+	return args
+}
+
+func (b *sqlBackend) Search(ctx context.Context, user string, filter *types.Filter, attributes []string) *types.Result {
+	rdn := b.column(b.rdn)
+	query, args := b.filterQuery(b.searchQuery, rdn, filter, user)
+
+	rows, err := b.db.QueryxContext(ctx, query, args...)
 	if err != nil {
 		jww.WARN.Printf("Error searching user: %v", err)
 		return nil
@@ -56,18 +523,22 @@ func (b *sqlBackend) Search(user string, attributes []string) *types.Result {
 		Attributes: make(map[string][]string),
 	}
 
+	found := false
 	for rows.Next() {
-		err = rows.MapScan(attrs)
+		found = true
+
+		attrs, err := scanRow(rows)
 		if err != nil {
 			jww.WARN.Printf("Error searching user: %v", err)
 			continue
 		}
 
-		mapBytesToString(attrs)
+		result.Rdn, _ = formatValue(attrs[strings.ToLower(rdn)])
+		b.addValues(result, attrs, attributes)
+	}
 
-		for _, ldapAttr := range attributes {
-			result.Attributes[ldapAttr] = append(result.Attributes[ldapAttr], fmt.Sprint(attrs[ldapAttr]))
-		}
+	if !found {
+		return nil
 	}
 
 	deduplicateAttributes(result)
@@ -75,6 +546,336 @@ func (b *sqlBackend) Search(user string, attributes []string) *types.Result {
 	return result
 }
 
+func (b *sqlBackend) List(ctx context.Context, filter *types.Filter, attributes []string, options types.ListOptions, fn func(result *types.Result)) error {
+	if b.listQuery == "" {
+		return fmt.Errorf("no list query configured")
+	}
+
+	return b.list(ctx, b.listQuery, b.rdn, filter, attributes, options, fn)
+}
+
+func (b *sqlBackend) ListGroups(ctx context.Context, filter *types.Filter, attributes []string, options types.ListOptions, fn func(result *types.Result)) error {
+	if b.groupQuery == "" {
+		return fmt.Errorf("no group query configured")
+	}
+
+	return b.list(ctx, b.groupQuery, b.groupRdn, filter, attributes, options, fn)
+}
+
+// list calls fn for every entry of the query matching the filter in the range
+// selected by the options. Entries are identified by the value of the rdn
+// column. The query is cancelled once the context is done.
+func (b *sqlBackend) list(ctx context.Context, query string, rdn string, filter *types.Filter, attributes []string, options types.ListOptions, fn func(result *types.Result)) error {
+	rdn = b.column(rdn)
+	options.Sort = b.columnSortKeys(options.Sort)
+	query, args := b.newListQuery(query, rdn, filter, options).build()
+
+	rows, err := b.db.QueryxContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("error listing entries: %v", err)
+	}
+	defer rows.Close()
+
+	// the rows are ordered by the rdn, so the rows of an entry are adjacent
+	var result *types.Result
+	for rows.Next() {
+		attrs, err := scanRow(rows)
+		if err != nil {
+			jww.WARN.Printf("Error listing entries: %v", err)
+			continue
+		}
+
+		value, _ := formatValue(attrs[strings.ToLower(rdn)])
+		if result == nil || result.Rdn != value {
+			if result != nil {
+				deduplicateAttributes(result)
+				fn(result)
+			}
+
+			result = &types.Result{
+				Rdn:        value,
+				Attributes: make(map[string][]string),
+			}
+		}
+
+		b.addValues(result, attrs, attributes)
+	}
+
+	if result != nil {
+		deduplicateAttributes(result)
+		fn(result)
+	}
+
+	return rows.Err()
+}
+
+// addValues adds the values of the attributes in the row to the entry, NULL
+// values are omitted.
+func (b *sqlBackend) addValues(result *types.Result, row map[string]interface{}, attributes []string) {
+	for _, ldapAttr := range attributes {
+		format := formatValue
+		if b.isTimestampAttribute(ldapAttr) {
+			layout := b.timestampFormats[attributeKey(ldapAttr)]
+			format = func(value interface{}) (string, bool) {
+				return formatTimestamp(value, layout)
+			}
+		}
+
+		if value, ok := format(row[strings.ToLower(b.column(ldapAttr))]); ok {
+			result.Attributes[ldapAttr] = append(result.Attributes[ldapAttr], value)
+		}
+	}
+}
+
+// generalizedTimeFormat formats times in UTC with the GeneralizedTime syntax
+// (RFC 4517, section 3.3.13).
+const generalizedTimeFormat = "20060102150405Z"
+
+// formatValue formats the value of a column according to the LDAP syntax of
+// its type, ok is false for NULL. Binary values are passed as octet strings
+// unchanged.
+func formatValue(value interface{}) (formatted string, ok bool) {
+	switch value := value.(type) {
+	case nil:
+		return "", false
+	case []byte:
+		return string(value), true
+	case string:
+		return value, true
+	case bool:
+		if value {
+			return "TRUE", true
+		}
+		return "FALSE", true
+	case int64:
+		return strconv.FormatInt(value, 10), true
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), true
+	case time.Time:
+		return value.UTC().Format(generalizedTimeFormat), true
+	default:
+		return fmt.Sprint(value), true
+	}
+}
+
+// timestampLayouts are the layouts of timestamps returned as text by the
+// databases, times without time zone are UTC.
+var timestampLayouts = []string{
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02 15:04:05Z07",
+	"2006-01-02T15:04:05Z07:00",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+}
+
+// unixTimestampFormat is the format of columns holding unix timestamps.
+const unixTimestampFormat = "unix"
+
+// formatTimestamp formats the value of a timestamp column as GeneralizedTime.
+// Besides times the column may hold text, which is parsed with the layout of
+// its format or the common layouts, or unix timestamps. Values which are no
+// timestamps are formatted like other values.
+func formatTimestamp(value interface{}, format string) (formatted string, ok bool) {
+	switch value := value.(type) {
+	case time.Time:
+		return value.UTC().Format(generalizedTimeFormat), true
+	case int64:
+		return time.Unix(value, 0).UTC().Format(generalizedTimeFormat), true
+	case []byte:
+		return formatTimestamp(string(value), format)
+	case string:
+		if format == unixTimestampFormat {
+			if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+				return formatTimestamp(seconds, format)
+			}
+		}
+
+		if t, err := parseGeneralizedTime(value); err == nil {
+			return t.UTC().Format(generalizedTimeFormat), true
+		}
+
+		layouts := timestampLayouts
+		if format != "" && format != unixTimestampFormat {
+			layouts = append([]string{format}, timestampLayouts...)
+		}
+
+		for _, layout := range layouts {
+			if t, err := time.Parse(layout, value); err == nil {
+				return t.UTC().Format(generalizedTimeFormat), true
+			}
+		}
+	}
+
+	return formatValue(value)
+}
+
+// timestampArgument converts a GeneralizedTime value passed to the database to
+// the format of the column holding the attribute, which is a time unless the
+// column holds unix timestamps or text. Values which are no timestamps are
+// passed unchanged.
+func (b *sqlBackend) timestampArgument(attribute string, value string) interface{} {
+	t, err := parseGeneralizedTime(value)
+	if err != nil {
+		return value
+	}
+
+	switch format := b.timestampFormats[attributeKey(attribute)]; format {
+	case "":
+		return t.UTC()
+	case unixTimestampFormat:
+		return t.Unix()
+	default:
+		return t.UTC().Format(format)
+	}
+}
+
+func (b *sqlBackend) isTimestampAttribute(attribute string) bool {
+	_, ok := b.timestampFormats[attributeKey(attribute)]
+	return ok || isTimestampAttribute(attribute)
+}
+
+// argument returns the parameter of an assertion value of a filter, timestamps
+// are passed in the format of their column.
+func (b *sqlBackend) argument(attribute string, value string) interface{} {
+	if b.isTimestampAttribute(attribute) {
+		return b.timestampArgument(attribute, value)
+	}
+
+	return value
+}
+
+// column returns the column holding the attribute. Attributes are matched case
+// insensitive and by their other names, as the names of an attribute type are
+// interchangeable.
+func (b *sqlBackend) column(attribute string) string {
+	if column, ok := b.columns[attributeKey(attribute)]; ok {
+		return column
+	}
+
+	return attribute
+}
+
+func (b *sqlBackend) columnSortKeys(keys []types.SortKey) []types.SortKey {
+	var result []types.SortKey
+	for _, key := range keys {
+		result = append(result, types.SortKey{Attribute: b.column(key.Attribute), Reverse: key.Reverse})
+	}
+
+	return result
+}
+
+// newQueryBuilder wraps the query, the assertions of filters are written for
+// the columns holding the attributes and the values in their format.
+func (b *sqlBackend) newQueryBuilder(query string, rdn string, args ...interface{}) *queryBuilder {
+	q := newQueryBuilder(b.db.DriverName(), query, rdn, args...)
+	q.column = b.column
+	q.argument = b.argument
+
+	return q
+}
+
+// filterQuery returns the query restricted to the rows of the entries matching
+// the filter. Without a filter the query is used unchanged.
+func (b *sqlBackend) filterQuery(query string, rdn string, filter *types.Filter, args ...interface{}) (string, []interface{}) {
+	if filter == nil {
+		return query, args
+	}
+
+	return b.newFilterQuery(query, rdn, filter, args...).build()
+}
+
+func (b *sqlBackend) newFilterQuery(query string, rdn string, filter *types.Filter, args ...interface{}) *queryBuilder {
+	q := b.newQueryBuilder(query, rdn, args...)
+	q.buf.WriteString("SELECT * FROM ")
+	q.writeQuery()
+	q.buf.WriteString(" AS entries")
+
+	if filter != nil {
+		q.buf.WriteString(" WHERE ")
+		q.writeFilter(filter)
+	}
+
+	return q
+}
+
+// newListQuery orders the rows matching the filter by the rdn. As an entry
+// spans several rows, entries are sorted and a range of them is selected by
+// joining the rows with the distinct rdn values and sort keys of the entries.
+func (b *sqlBackend) newListQuery(query string, rdn string, filter *types.Filter, options types.ListOptions) *queryBuilder {
+	if len(options.Sort) == 0 && options.Limit <= 0 && options.Offset <= 0 {
+		q := b.newFilterQuery(query, rdn, filter)
+		q.buf.WriteString(" ORDER BY " + rdn)
+
+		return q
+	}
+
+	q := b.newQueryBuilder(query, rdn)
+	q.buf.WriteString("SELECT entries.* FROM ")
+	q.writeQuery()
+	q.buf.WriteString(" AS entries JOIN (SELECT " + rdn)
+	for i, key := range options.Sort {
+		fmt.Fprintf(&q.buf, ", %s AS sortkey%d", sortKeyAggregate(key), i)
+	}
+	q.buf.WriteString(" FROM ")
+	q.writeQuery()
+	q.buf.WriteString(" AS entries")
+
+	if filter != nil {
+		q.buf.WriteString(" WHERE ")
+		q.writeFilter(filter)
+	}
+
+	q.buf.WriteString(" GROUP BY " + rdn)
+
+	if options.Limit > 0 || options.Offset > 0 {
+		q.buf.WriteString(" ORDER BY ")
+		for _, key := range options.Sort {
+			writeSortKey(&q.buf, sortKeyAggregate(key), key.Reverse)
+			q.buf.WriteString(", ")
+		}
+		q.buf.WriteString(rdn + " LIMIT ")
+
+		if options.Limit > 0 {
+			q.writeParam(options.Limit)
+		} else {
+			// some databases do not support an offset without limit
+			q.writeParam(math.MaxInt32)
+		}
+		q.buf.WriteString(" OFFSET ")
+		q.writeParam(options.Offset)
+	}
+
+	q.buf.WriteString(") AS page ON page." + rdn + " = entries." + rdn + " ORDER BY ")
+	for i, key := range options.Sort {
+		writeSortKey(&q.buf, fmt.Sprintf("page.sortkey%d", i), key.Reverse)
+		q.buf.WriteString(", ")
+	}
+	q.buf.WriteString("entries." + rdn)
+
+	return q
+}
+
+// sortKeyAggregate selects the value of an entry to sort by.
+func sortKeyAggregate(key types.SortKey) string {
+	if key.Reverse {
+		return "MAX(" + key.Attribute + ")"
+	}
+
+	return "MIN(" + key.Attribute + ")"
+}
+
+// writeSortKey orders by the expression, placing NULL values as the largest
+// value which databases do differently by default.
+func writeSortKey(buf *bytes.Buffer, expression string, reverse bool) {
+	order := ""
+	if reverse {
+		order = " DESC"
+	}
+
+	fmt.Fprintf(buf, "CASE WHEN %s IS NULL THEN 1 ELSE 0 END%s, %s%s", expression, order, expression, order)
+}
+
 func deduplicateAttributes(result *types.Result) {
 	for i := range result.Attributes {
 		result.Attributes[i] = deduplicateStringSlice(result.Attributes[i])
@@ -97,10 +898,18 @@ func deduplicateStringSlice(values []string) []string {
 	return result
 }
 
-func mapBytesToString(m map[string]interface{}) {
-	for k, v := range m {
-		if b, ok := v.([]byte); ok {
-			m[k] = string(b)
-		}
+// scanRow returns the values of a row keyed by the lower case column names, as
+// databases differ in the case of the names they return.
+func scanRow(rows *sql.Rows) (map[string]interface{}, error) {
+	attrs := make(map[string]interface{})
+	if err := rows.MapScan(attrs); err != nil {
+		return nil, err
+	}
+
+	row := make(map[string]interface{}, len(attrs))
+	for k, v := range attrs {
+		row[strings.ToLower(k)] = v
 	}
+
+	return row, nil
 }
@@ -1,7 +1,11 @@
 package pkg
 
 import (
+	"context"
+	"errors"
+	"regexp"
 	"testing"
+	"time"
 
 	"github.com/gopenguin/minimal-ldap-proxy/types"
 	sql "github.com/jmoiron/sqlx"
@@ -24,7 +28,7 @@ func TestSqlBackend_Authenticate(t *testing.T) {
 
 	mock.ExpectQuery("SELECT password FROM user WHERE name = ?").WithArgs("username").WillReturnRows(sqlmock.NewRows([]string{"password"}).AddRow("{SSHA}RrAeHR4zMHdNUfvtEibV9yTbtmMY7nF/"))
 
-	result := backend.Authenticate("username", "test123")
+	result, _ := backend.Authenticate("username", "test123")
 
 	assert.True(t, result)
 	assert.Nil(t, mock.ExpectationsWereMet())
@@ -41,20 +45,649 @@ func TestSqlBackend_Search(t *testing.T) {
 	backend := &sqlBackend{
 		db:          sql.NewDb(db, "sqlmock"),
 		searchQuery: "SELECT attr1 AS ldap1, attr3 AS ldap2 FROM user WHERE name = ?",
+		rdn:         "ldap1",
 	}
 
 	mock.ExpectQuery("SELECT attr1 AS ldap1, attr3 AS ldap2 FROM user WHERE name = ?").WithArgs("username").WillReturnRows(sqlmock.NewRows([]string{"ldap1", "ldap2"}).AddRow("a", "b"))
 
-	result := backend.Search("username", []string{"ldap1", "ldap2"})
+	result := backend.Search(context.Background(), "username", nil, []string{"ldap1", "ldap2"})
 
-	assert.EqualValues(t, []types.Result{
+	assert.EqualValues(t, &types.Result{
+		Rdn: "a",
+		Attributes: map[string][]string{
+			"ldap1": {"a"},
+			"ldap2": {"b"},
+		},
+	}, result)
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestSqlBackend_SearchTypedValues(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Unexpected error during db setup: %v", err)
+	}
+
+	defer db.Close()
+
+	backend := &sqlBackend{
+		db:          sql.NewDb(db, "sqlmock"),
+		searchQuery: "SELECT name AS cn, photo AS jpegPhoto, email AS mail, uid AS uidNumber, created AS createTimestamp, active, quota FROM user WHERE name = ?",
+		rdn:         "cn",
+	}
+
+	photo := []byte{0xff, 0xd8, 0xff, 0x00, 0xe0}
+	created := time.Date(2026, 10, 18, 14, 0, 0, 0, time.FixedZone("CEST", 2*60*60))
+	mock.ExpectQuery(regexp.QuoteMeta(backend.searchQuery)).WithArgs("username").
+		WillReturnRows(sqlmock.NewRows([]string{"cn", "jpegPhoto", "mail", "uidNumber", "createTimestamp", "active", "quota"}).
+			AddRow([]byte("username"), photo, nil, int64(1000), created, true, 1.5))
+
+	result := backend.Search(context.Background(), "username", nil, []string{"cn", "jpegPhoto", "mail", "uidNumber", "createTimestamp", "active", "quota"})
+
+	assert.EqualValues(t, &types.Result{
+		Rdn: "username",
+		Attributes: map[string][]string{
+			"cn":              {"username"},
+			"jpegPhoto":       {string(photo)},
+			"uidNumber":       {"1000"},
+			"createTimestamp": {"20261018120000Z"},
+			"active":          {"TRUE"},
+			"quota":           {"1.5"},
+		},
+	}, result)
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestSqlBackend_SearchFilter(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Unexpected error during db setup: %v", err)
+	}
+
+	defer db.Close()
+
+	backend := &sqlBackend{
+		db:          sql.NewDb(db, "sqlmock"),
+		searchQuery: "SELECT name AS cn, email AS mail FROM user WHERE name = ?",
+		rdn:         "cn",
+	}
+
+	filter := &types.Filter{
+		Type: types.FilterAnd,
+		Children: []*types.Filter{
+			{Type: types.FilterEqual, Attribute: "cn", Value: "username"},
+			{Type: types.FilterNot, Children: []*types.Filter{
+				{Type: types.FilterSubstrings, Attribute: "mail", Initial: "a_b", Final: "@example.com"},
+			}},
+		},
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM (SELECT name AS cn, email AS mail FROM user WHERE name = ?) AS entries WHERE ("+
+		"EXISTS (SELECT 1 FROM (SELECT name AS cn, email AS mail FROM user WHERE name = ?) AS candidates WHERE candidates.cn = entries.cn AND LOWER(cn) = LOWER(?)) AND "+
+		"NOT (EXISTS (SELECT 1 FROM (SELECT name AS cn, email AS mail FROM user WHERE name = ?) AS candidates WHERE candidates.cn = entries.cn AND LOWER(mail) LIKE LOWER(?) ESCAPE '!')))")).
+		WithArgs("username", "username", "username", "username", "a!_b%@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"cn", "mail"}).AddRow("username", "user@example.com"))
+
+	result := backend.Search(context.Background(), "username", filter, []string{"cn", "mail"})
+
+	assert.EqualValues(t, &types.Result{
+		Rdn: "username",
+		Attributes: map[string][]string{
+			"cn":   {"username"},
+			"mail": {"user@example.com"},
+		},
+	}, result)
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestSqlBackend_SearchMapping(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Unexpected error during db setup: %v", err)
+	}
+
+	defer db.Close()
+
+	backend := &sqlBackend{
+		db:          sql.NewDb(db, "sqlmock"),
+		searchQuery: "SELECT name, email FROM user WHERE name = ?",
+		rdn:         "uid",
+		columns: map[string]string{
+			attributeKey("uid"):           "name",
+			attributeKey("rfc822Mailbox"): "email",
+		},
+	}
+
+	filter := &types.Filter{Type: types.FilterPresent, Attribute: "mail"}
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM (SELECT name, email FROM user WHERE name = ?) AS entries WHERE "+
+		"EXISTS (SELECT 1 FROM (SELECT name, email FROM user WHERE name = ?) AS candidates WHERE candidates.name = entries.name AND email IS NOT NULL)")).
+		WithArgs("username", "username").
+		WillReturnRows(sqlmock.NewRows([]string{"NAME", "Email"}).AddRow("username", "user@example.com"))
+
+	result := backend.Search(context.Background(), "username", filter, []string{"uid", "mail"})
+
+	assert.EqualValues(t, &types.Result{
+		Rdn: "username",
+		Attributes: map[string][]string{
+			"uid":  {"username"},
+			"mail": {"user@example.com"},
+		},
+	}, result)
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestSqlBackend_SearchNotFound(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Unexpected error during db setup: %v", err)
+	}
+
+	defer db.Close()
+
+	backend := &sqlBackend{
+		db:          sql.NewDb(db, "sqlmock"),
+		searchQuery: "SELECT name AS cn FROM user WHERE name = ?",
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT name AS cn FROM user WHERE name = ?")).WithArgs("username").WillReturnRows(sqlmock.NewRows([]string{"cn"}))
+
+	assert.Nil(t, backend.Search(context.Background(), "username", nil, []string{"cn"}))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestSqlBackend_List(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Unexpected error during db setup: %v", err)
+	}
+
+	defer db.Close()
+
+	backend := &sqlBackend{
+		db:        sql.NewDb(db, "sqlmock"),
+		listQuery: "SELECT u.name AS cn, g.name AS memberOf FROM user u JOIN groups g ON (u.id = g.user_id)",
+		rdn:       "cn",
+	}
+
+	filter := &types.Filter{Type: types.FilterEqual, Attribute: "memberOf", Value: "admins"}
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM (SELECT u.name AS cn, g.name AS memberOf FROM user u JOIN groups g ON (u.id = g.user_id)) AS entries WHERE " +
+		"EXISTS (SELECT 1 FROM (SELECT u.name AS cn, g.name AS memberOf FROM user u JOIN groups g ON (u.id = g.user_id)) AS candidates WHERE candidates.cn = entries.cn AND memberOf = ?) ORDER BY cn")).
+		WithArgs("admins").
+		WillReturnRows(sqlmock.NewRows([]string{"cn", "memberOf"}).
+			AddRow("a", "admins").
+			AddRow("a", "users").
+			AddRow("b", "admins"))
+
+	var results []*types.Result
+	err = backend.List(context.Background(), filter, []string{"cn", "memberOf"}, types.ListOptions{}, func(result *types.Result) {
+		results = append(results, result)
+	})
+
+	assert.NoError(t, err)
+	assert.EqualValues(t, []*types.Result{
 		{
-			Attributes: map[string]string{
-				"ldap1": "a",
-				"ldap2": "b",
+			Rdn: "a",
+			Attributes: map[string][]string{
+				"cn":       {"a"},
+				"memberOf": {"admins", "users"},
 			},
 		},
-	}, result)
+		{
+			Rdn: "b",
+			Attributes: map[string][]string{
+				"cn":       {"b"},
+				"memberOf": {"admins"},
+			},
+		},
+	}, results)
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestSqlBackend_ListTimestamps(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Unexpected error during db setup: %v", err)
+	}
+
+	defer db.Close()
+
+	assert.NoError(t, checkTimestampAttribute("passwordExpiresAt"))
+	assert.NoError(t, checkTimestampAttribute("createTimestamp"))
+	assert.Error(t, checkTimestampAttribute("mail"))
+
+	backend := &sqlBackend{
+		db:        sql.NewDb(db, "sqlmock"),
+		listQuery: "SELECT name AS cn, created_at, changed AS pwdChangedTime, expires AS passwordExpiresAt FROM user",
+		rdn:       "cn",
+		columns:   map[string]string{attributeKey("createTimestamp"): "created_at"},
+		timestampFormats: map[string]string{
+			attributeKey("pwdChangedTime"):    "unix",
+			attributeKey("passwordExpiresAt"): "20060102150405Z",
+		},
+	}
+
+	filter := &types.Filter{
+		Type: types.FilterAnd,
+		Children: []*types.Filter{
+			{Type: types.FilterGreaterOrEqual, Attribute: "createTimestamp", Value: "20261001120000+0200"},
+			{Type: types.FilterLessOrEqual, Attribute: "passwordExpiresAt", Value: "2026110100Z"},
+			{Type: types.FilterGreaterOrEqual, Attribute: "pwdChangedTime", Value: "20261001000000Z"},
+		},
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM (SELECT name AS cn, created_at, changed AS pwdChangedTime, expires AS passwordExpiresAt FROM user) AS entries WHERE ("+
+		"EXISTS (SELECT 1 FROM (SELECT name AS cn, created_at, changed AS pwdChangedTime, expires AS passwordExpiresAt FROM user) AS candidates WHERE candidates.cn = entries.cn AND created_at >= ?) AND "+
+		"EXISTS (SELECT 1 FROM (SELECT name AS cn, created_at, changed AS pwdChangedTime, expires AS passwordExpiresAt FROM user) AS candidates WHERE candidates.cn = entries.cn AND passwordExpiresAt <= ?) AND "+
+		"EXISTS (SELECT 1 FROM (SELECT name AS cn, created_at, changed AS pwdChangedTime, expires AS passwordExpiresAt FROM user) AS candidates WHERE candidates.cn = entries.cn AND pwdChangedTime >= ?)) ORDER BY cn")).
+		WithArgs(time.Date(2026, 10, 1, 10, 0, 0, 0, time.UTC).UTC(), "20261101000000Z", time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC).Unix()).
+		WillReturnRows(sqlmock.NewRows([]string{"cn", "created_at", "pwdChangedTime", "passwordExpiresAt"}).
+			AddRow("a", []byte("2026-10-18 12:00:00"), int64(1792324800), nil).
+			AddRow("b", time.Date(2026, 10, 18, 14, 0, 0, 0, time.FixedZone("CEST", 2*60*60)), []byte("2026-10-18T12:00:00.5+02:00"), []byte("20261031235959Z")))
+
+	var results []*types.Result
+	err = backend.List(context.Background(), filter, []string{"cn", "createTimestamp", "pwdChangedTime", "passwordExpiresAt"}, types.ListOptions{}, func(result *types.Result) {
+		results = append(results, result)
+	})
+
+	assert.NoError(t, err)
+	assert.EqualValues(t, []*types.Result{
+		{
+			Rdn: "a",
+			Attributes: map[string][]string{
+				"cn":              {"a"},
+				"createTimestamp": {"20261018120000Z"},
+				"pwdChangedTime":  {"20261018120000Z"},
+			},
+		},
+		{
+			Rdn: "b",
+			Attributes: map[string][]string{
+				"cn":                {"b"},
+				"createTimestamp":   {"20261018120000Z"},
+				"pwdChangedTime":    {"20261018100000Z"},
+				"passwordExpiresAt": {"20261031235959Z"},
+			},
+		},
+	}, results)
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestSqlBackend_ListPage(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Unexpected error during db setup: %v", err)
+	}
+
+	defer db.Close()
+
+	backend := &sqlBackend{
+		db:        sql.NewDb(db, "sqlmock"),
+		listQuery: "SELECT u.name AS cn, g.name AS memberOf FROM user u JOIN groups g ON (u.id = g.user_id)",
+		rdn:       "cn",
+	}
+
+	filter := &types.Filter{Type: types.FilterEqual, Attribute: "memberOf", Value: "admins"}
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT entries.* FROM (SELECT u.name AS cn, g.name AS memberOf FROM user u JOIN groups g ON (u.id = g.user_id)) AS entries "+
+		"JOIN (SELECT cn FROM (SELECT u.name AS cn, g.name AS memberOf FROM user u JOIN groups g ON (u.id = g.user_id)) AS entries WHERE "+
+		"EXISTS (SELECT 1 FROM (SELECT u.name AS cn, g.name AS memberOf FROM user u JOIN groups g ON (u.id = g.user_id)) AS candidates WHERE candidates.cn = entries.cn AND memberOf = ?) "+
+		"GROUP BY cn ORDER BY cn LIMIT ? OFFSET ?) AS page ON page.cn = entries.cn ORDER BY entries.cn")).
+		WithArgs("admins", 2, 4).
+		WillReturnRows(sqlmock.NewRows([]string{"cn", "memberOf"}).
+			AddRow("e", "admins").
+			AddRow("e", "users").
+			AddRow("f", "admins"))
+
+	var results []string
+	err = backend.List(context.Background(), filter, []string{"cn"}, types.ListOptions{Offset: 4, Limit: 2}, func(result *types.Result) {
+		results = append(results, result.Rdn)
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"e", "f"}, results)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestSqlBackend_ListSorted(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Unexpected error during db setup: %v", err)
+	}
+
+	defer db.Close()
+
+	backend := &sqlBackend{
+		db:        sql.NewDb(db, "sqlmock"),
+		listQuery: "SELECT name AS cn, email AS mail FROM user",
+		rdn:       "cn",
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT entries.* FROM (SELECT name AS cn, email AS mail FROM user) AS entries " +
+		"JOIN (SELECT cn, MAX(mail) AS sortkey0 FROM (SELECT name AS cn, email AS mail FROM user) AS entries GROUP BY cn) AS page ON page.cn = entries.cn " +
+		"ORDER BY CASE WHEN page.sortkey0 IS NULL THEN 1 ELSE 0 END DESC, page.sortkey0 DESC, entries.cn")).
+		WillReturnRows(sqlmock.NewRows([]string{"cn", "mail"}).
+			AddRow("b", "b@example.com").
+			AddRow("a", "a@example.com"))
+
+	var results []string
+	err = backend.List(context.Background(), nil, []string{"cn"}, types.ListOptions{Sort: []types.SortKey{{Attribute: "mail", Reverse: true}}}, func(result *types.Result) {
+		results = append(results, result.Rdn)
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b", "a"}, results)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestSqlBackend_ListGroups(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Unexpected error during db setup: %v", err)
+	}
+
+	defer db.Close()
+
+	backend := &sqlBackend{
+		db:         sql.NewDb(db, "sqlmock"),
+		groupQuery: "SELECT g.name AS cn, u.name AS member FROM groups g JOIN users u ON (g.id = u.group_id)",
+		groupRdn:   "cn",
+	}
+
+	filter := &types.Filter{Type: types.FilterEqual, Attribute: "member", Value: "alice"}
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT * FROM (SELECT g.name AS cn, u.name AS member FROM groups g JOIN users u ON (g.id = u.group_id)) AS entries WHERE " +
+		"EXISTS (SELECT 1 FROM (SELECT g.name AS cn, u.name AS member FROM groups g JOIN users u ON (g.id = u.group_id)) AS candidates WHERE candidates.cn = entries.cn AND member = ?) ORDER BY cn")).
+		WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows([]string{"cn", "member"}).
+			AddRow("admins", "alice").
+			AddRow("admins", "bob"))
+
+	var results []*types.Result
+	err = backend.ListGroups(context.Background(), filter, []string{"cn", "member"}, types.ListOptions{}, func(result *types.Result) {
+		results = append(results, result)
+	})
+
+	assert.NoError(t, err)
+	assert.EqualValues(t, []*types.Result{
+		{
+			Rdn: "admins",
+			Attributes: map[string][]string{
+				"cn":     {"admins"},
+				"member": {"alice", "bob"},
+			},
+		},
+	}, results)
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestSqlBackend_UpdatePassword(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Unexpected error during db setup: %v", err)
+	}
+
+	defer db.Close()
+
+	backend := &sqlBackend{
+		db:                  sql.NewDb(db, "sqlmock"),
+		updatePasswordQuery: "UPDATE user SET password = ? WHERE name = ?",
+	}
+
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE user SET password = ? WHERE name = ?")).
+		WithArgs("hash", "username").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE user SET password = ? WHERE name = ?")).
+		WithArgs("hash", "unknown").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	assert.NoError(t, backend.UpdatePassword("username", "hash"))
+	assert.EqualError(t, backend.UpdatePassword("unknown", "hash"), "user 'unknown' not found")
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestSqlBackend_Write(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Unexpected error during db setup: %v", err)
+	}
+
+	defer db.Close()
+
+	backend := &sqlBackend{
+		db:          sql.NewDb(db, "sqlmock"),
+		searchQuery: "SELECT name AS cn, email AS mail FROM user WHERE name = ?",
+		rdn:         "cn",
+		addQuery:    "INSERT INTO user (name, email, password) VALUES (:cn, :mail, :userPassword)",
+		modifyQueries: map[string]types.ModifyQuery{
+			attributeKey("mail"): {Query: "UPDATE user SET email = :mail WHERE name = :cn"},
+		},
+		deleteQuery: "DELETE FROM user WHERE name = :cn",
+	}
+	search := regexp.QuoteMeta(backend.searchQuery)
+	columns := []string{"cn", "mail"}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(search).WithArgs("username").WillReturnRows(sqlmock.NewRows(columns))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO user (name, email, password) VALUES (?, ?, ?)")).
+		WithArgs("username", nil, "hash").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	assert.NoError(t, backend.Add("username", map[string][]string{"userPassword": {"hash"}}))
+
+	// the existence is checked within the transaction
+	mock.ExpectBegin()
+	mock.ExpectQuery(search).WithArgs("username").WillReturnRows(sqlmock.NewRows(columns).AddRow("username", nil))
+	mock.ExpectRollback()
+
+	err = backend.Add("username", map[string][]string{"userPassword": {"hash"}})
+	assert.EqualError(t, err, "user 'username' already exists")
+	assert.True(t, errors.Is(err, types.ErrExists))
+
+	// the queries are checked before the transaction begins
+	mail := "username@example.com"
+	err = backend.Modify("username", []types.Change{{Attribute: "mail", Value: &mail}, {Attribute: "sn"}})
+	assert.EqualError(t, err, "modify query for 'sn' not configured")
+	assert.True(t, errors.Is(err, types.ErrNotConfigured))
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(search).WithArgs("unknown").WillReturnRows(sqlmock.NewRows(columns))
+	mock.ExpectRollback()
+
+	err = backend.Modify("unknown", []types.Change{{Attribute: "mail", Value: &mail}})
+	assert.True(t, errors.Is(err, types.ErrNotFound))
+
+	// a value is replaced by deleting the old and adding the new one
+	old := "old@example.com"
+	mock.ExpectBegin()
+	mock.ExpectQuery(search).WithArgs("username").WillReturnRows(sqlmock.NewRows(columns).AddRow("username", old))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE user SET email = ? WHERE name = ?")).
+		WithArgs(nil, "username").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE user SET email = ? WHERE name = ?")).
+		WithArgs(mail, "username").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	assert.NoError(t, backend.Modify("username", []types.Change{
+		{Operation: types.ChangeDelete, Attribute: "mail", Value: &old},
+		{Operation: types.ChangeAdd, Attribute: "mail", Value: &mail},
+	}))
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(search).WithArgs("username").WillReturnRows(sqlmock.NewRows(columns).AddRow("username", old))
+	mock.ExpectRollback()
+
+	err = backend.Modify("username", []types.Change{{Operation: types.ChangeDelete, Attribute: "mail", Value: &mail}})
+	assert.EqualError(t, err, "attribute 'mail' has no such value")
+	assert.True(t, errors.Is(err, types.ErrNoSuchValue))
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(search).WithArgs("username").WillReturnRows(sqlmock.NewRows(columns).AddRow("username", old))
+	mock.ExpectRollback()
+
+	err = backend.Modify("username", []types.Change{{Operation: types.ChangeAdd, Attribute: "mail", Value: &mail}})
+	assert.EqualError(t, err, "attribute 'mail' takes a single value")
+	assert.True(t, errors.Is(err, types.ErrSingleValue))
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(search).WithArgs("username").WillReturnRows(sqlmock.NewRows(columns).AddRow("username", old))
+	mock.ExpectRollback()
+
+	err = backend.Modify("username", []types.Change{{Operation: types.ChangeAdd, Attribute: "mail", Value: &old}})
+	assert.EqualError(t, err, "attribute 'mail' already has a value")
+	assert.True(t, errors.Is(err, types.ErrValueExists))
+
+	err = backend.Add("username", map[string][]string{"mail": {old, mail}})
+	assert.True(t, errors.Is(err, types.ErrSingleValue))
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM user WHERE name = ?")).
+		WithArgs("unknown").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	err = backend.Delete("unknown")
+	assert.EqualError(t, err, "user 'unknown' not found")
+	assert.True(t, errors.Is(err, types.ErrNotFound))
+
+	// binary values are passed as bytes
+	certificate := "\x30\x82\x01\x0a"
+	backend.modifyQueries[attributeKey("userCertificate")] = types.ModifyQuery{Query: "UPDATE user SET certificate = :userCertificate WHERE name = :cn"}
+	mock.ExpectBegin()
+	mock.ExpectQuery(search).WithArgs("username").WillReturnRows(sqlmock.NewRows(columns).AddRow("username", old))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE user SET certificate = ? WHERE name = ?")).
+		WithArgs([]byte(certificate), "username").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	assert.NoError(t, backend.Modify("username", []types.Change{{Attribute: "userCertificate;binary", Value: &certificate}}))
+
+	// attributes with several values are changed value by value
+	backend.modifyQueries[attributeKey("mail")] = types.ModifyQuery{
+		AddQuery:    "INSERT INTO mail (user, address) VALUES (:cn, :mail)",
+		DeleteQuery: "DELETE FROM mail WHERE user = :cn AND (:mail IS NULL OR address = :mail)",
+	}
+	insertMail := regexp.QuoteMeta("INSERT INTO mail (user, address) VALUES (?, ?)")
+	deleteMail := regexp.QuoteMeta("DELETE FROM mail WHERE user = ? AND (? IS NULL OR address = ?)")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(search).WithArgs("username").WillReturnRows(sqlmock.NewRows(columns))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO user (name, email, password) VALUES (?, ?, ?)")).
+		WithArgs("username", nil, nil).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(insertMail).WithArgs("username", old).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(insertMail).WithArgs("username", mail).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	assert.NoError(t, backend.Add("username", map[string][]string{"mail": {old, mail}}))
+
+	other := "other@example.com"
+	mock.ExpectBegin()
+	mock.ExpectQuery(search).WithArgs("username").
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("username", old).AddRow("username", mail))
+	mock.ExpectExec(deleteMail).WithArgs("username", old, old).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(insertMail).WithArgs("username", other).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	assert.NoError(t, backend.Modify("username", []types.Change{
+		{Operation: types.ChangeDelete, Attribute: "mail", Value: &old},
+		{Operation: types.ChangeAdd, Attribute: "mail", Value: &other},
+	}))
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(search).WithArgs("username").WillReturnRows(sqlmock.NewRows(columns).AddRow("username", old))
+	mock.ExpectExec(deleteMail).WithArgs("username", nil, nil).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(insertMail).WithArgs("username", mail).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(insertMail).WithArgs("username", other).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	assert.NoError(t, backend.Modify("username", []types.Change{
+		{Operation: types.ChangeReplace, Attribute: "mail", Value: &mail},
+		{Operation: types.ChangeAdd, Attribute: "mail", Value: &other},
+	}))
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestSqlBackend_AuthenticatePasswordPolicy(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Unexpected error during db setup: %v", err)
+	}
+
+	defer db.Close()
+
+	backend := &sqlBackend{
+		db:        sql.NewDb(db, "sqlmock"),
+		authQuery: "SELECT password, locked, expired, must_change AS mustChange, grace AS graceLogins, expires_in AS expiresIn FROM user WHERE name = ?",
+	}
+
+	mock.ExpectQuery("SELECT password").WithArgs("username").
+		WillReturnRows(sqlmock.NewRows([]string{"password", "locked", "expired", "mustChange", "graceLogins", "expiresIn"}).
+			AddRow("{SSHA}RrAeHR4zMHdNUfvtEibV9yTbtmMY7nF/", int64(0), "true", nil, []byte("3"), int64(60)))
+
+	result, policy := backend.Authenticate("username", "test123")
+
+	assert.True(t, result)
+	assert.Equal(t, types.PasswordPolicy{Expired: true, GraceLogins: 3, ExpiresIn: 60}, policy)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestSqlLockoutStore(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Unexpected error during db setup: %v", err)
+	}
+
+	defer db.Close()
+
+	store := &sqlLockoutStore{
+		db:          sql.NewDb(db, "sqlmock"),
+		window:      time.Minute,
+		loadQuery:   "SELECT failures, since, locked_until FROM lockout WHERE name = :user AND source = :source",
+		failQuery:   "UPDATE lockout SET failures = failures + 1 WHERE name = :user AND source = :source AND since >= :windowStart RETURNING failures, since, locked_until",
+		updateQuery: "REPLACE INTO lockout (name, source, failures, since, locked_until) VALUES (:user, :source, :failures, :since, :lockedUntil)",
+		unlockQuery: "DELETE FROM lockout WHERE name = :user",
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT failures, since, locked_until FROM lockout WHERE name = ? AND source = ?")).
+		WithArgs("cn=username", "").
+		WillReturnRows(sqlmock.NewRows([]string{"failures", "since", "locked_until"}).AddRow(2, 1500000000, nil))
+
+	state, err := store.Load("cn=username", "")
+	assert.NoError(t, err)
+	assert.Equal(t, types.LockoutState{Failures: 2, Since: time.Unix(1500000000, 0)}, state)
+
+	mock.ExpectQuery(regexp.QuoteMeta("UPDATE lockout SET failures = failures + 1 WHERE name = ? AND source = ? AND since >= ? RETURNING failures, since, locked_until")).
+		WithArgs("cn=username", "", 1500000000-60).
+		WillReturnRows(sqlmock.NewRows([]string{"failures", "since", "locked_until"}).AddRow(3, 1499999990, 0))
+
+	state, err = store.Fail("cn=username", "", time.Unix(1500000000, 0))
+	assert.NoError(t, err)
+	assert.Equal(t, types.LockoutState{Failures: 3, Since: time.Unix(1499999990, 0)}, state)
+
+	mock.ExpectExec(regexp.QuoteMeta("REPLACE INTO lockout (name, source, failures, since, locked_until) VALUES (?, ?, ?, ?, ?)")).
+		WithArgs("cn=username", "192.0.2.1", 0, 0, 1500000060).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	assert.NoError(t, store.Save("cn=username", "192.0.2.1", types.LockoutState{LockedUntil: time.Unix(1500000060, 0)}))
+
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM lockout WHERE name = ?")).
+		WithArgs("cn=username").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	assert.NoError(t, store.Unlock("cn=username"))
 
 	assert.Nil(t, mock.ExpectationsWereMet())
 }
@@ -0,0 +1,125 @@
+package pkg
+
+import (
+	"fmt"
+
+	"github.com/gopenguin/minimal-ldap-proxy/types"
+)
+
+// directory is a naming context served from its own backend, i.e. the tree of
+// the users and optionally the tree of their groups.
+type directory struct {
+	attributes []string
+
+	baseDn string
+	rDn    string
+
+	groupBaseDn     string
+	groupRdn        string
+	groupAttributes []string
+
+	// objectClasses and groupObjectClasses are added to the entries
+	objectClasses      []string
+	groupObjectClasses []string
+
+	// dnTemplates turn the values of the dn attributes into dns, they are keyed
+	// by the attribute key
+	dnTemplates map[string]*dnTemplate
+	// computedAttributes are served in addition to the attributes of the
+	// backend
+	computedAttributes []*computedAttribute
+	// timestampAttributes are the attribute keys of the attributes configured
+	// as timestamps
+	timestampAttributes map[string]bool
+
+	backend types.Backend
+}
+
+func newDirectory(baseDn string, rDn string, attributes []string, backend types.Backend) *directory {
+	return &directory{
+		baseDn:     baseDn,
+		rDn:        rDn,
+		attributes: attributes,
+		backend:    backend,
+	}
+}
+
+// WithNamingContext serves an additional tree of users from its own backend.
+// The options configure the tree like the ones passed to NewFrontend for the
+// first tree.
+func WithNamingContext(baseDn string, rDn string, attributes []string, backend types.Backend, options ...TreeOption) FrontendOption {
+	return func(f *Frontend) {
+		d := newDirectory(baseDn, rDn, attributes, backend)
+		for _, option := range options {
+			option(d)
+		}
+
+		f.directories = append(f.directories, d)
+	}
+}
+
+// WithTimestampAttributes serves the attributes with the GeneralizedTime syntax
+// besides the standard timestamps like createTimestamp.
+func WithTimestampAttributes(attributes []string) TreeOption {
+	return func(d *directory) {
+		d.timestampAttributes = make(map[string]bool)
+		for _, attribute := range attributes {
+			d.timestampAttributes[attributeKey(attribute)] = true
+		}
+	}
+}
+
+func (d *directory) isTimestampAttribute(attribute string) bool {
+	return d.timestampAttributes[attributeKey(attribute)] || isTimestampAttribute(attribute)
+}
+
+// attributeTypeDefinition describes an attribute of the entries of the
+// directory.
+func (d *directory) attributeTypeDefinition(attribute string) string {
+	if d.timestampAttributes[attributeKey(attribute)] {
+		return timestampAttributeTypeDefinition(attribute)
+	}
+
+	return attributeTypeDefinition(attribute)
+}
+
+// timestampValue returns an assertion value of a configured timestamp in the
+// format of the served values, which are matched like directory strings.
+func (d *directory) timestampValue(attribute string, value string) string {
+	if !d.timestampAttributes[attributeKey(attribute)] {
+		return value
+	}
+
+	t, err := parseGeneralizedTime(value)
+	if err != nil {
+		return value
+	}
+
+	return t.UTC().Format(generalizedTimeFormat)
+}
+
+// userDirectory returns the directory of the user with the dn and the rdn
+// value of the user.
+func (f *Frontend) userDirectory(dn string) (d *directory, user string, err error) {
+	for _, d := range f.directories {
+		if user, err := d.userFromDn(dn); err == nil {
+			return d, user, nil
+		}
+	}
+
+	return nil, "", fmt.Errorf("'%s' is not the dn of a user", dn)
+}
+
+// source names a source of entries of the directory, which is continued by
+// the next page of a paged search.
+func (d *directory) source(name string) string {
+	return name + " of " + d.baseDn
+}
+
+func (d *directory) userFromDn(dn string) (user string, err error) {
+	return valueFromDn(dn, d.rDn, d.baseDn)
+}
+
+func (d *directory) userDn(user string) string {
+	return entryDn(d.rDn, user, d.baseDn)
+}
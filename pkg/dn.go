@@ -0,0 +1,284 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// distinguishedName is a parsed dn (RFC 4514), its rdns are ordered from the
+// entry up to the root.
+type distinguishedName []relativeDn
+
+// relativeDn is a set of attribute type and value pairs, usually only one.
+type relativeDn []typeAndValue
+
+type typeAndValue struct {
+	attribute string
+	value     string
+}
+
+// parseDn parses the string representation of a dn. Spaces around the
+// separators are ignored, values are unescaped.
+func parseDn(s string) (distinguishedName, error) {
+	var dn distinguishedName
+	if strings.TrimSpace(s) == "" {
+		return dn, nil
+	}
+
+	rdn := relativeDn{}
+	for i := 0; ; {
+		ava, end, err := parseTypeAndValue(s, i)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dn '%s': %v", s, err)
+		}
+		rdn = append(rdn, ava)
+
+		if end == len(s) {
+			return append(dn, rdn), nil
+		}
+
+		switch s[end] {
+		case '+':
+		case ',', ';':
+			dn = append(dn, rdn)
+			rdn = relativeDn{}
+		}
+		i = end + 1
+	}
+}
+
+// parseTypeAndValue parses the attribute type and value starting at i, end is
+// the index of the separator following it or the length of s.
+func parseTypeAndValue(s string, i int) (ava typeAndValue, end int, err error) {
+	eq := strings.IndexByte(s[i:], '=')
+	if eq < 0 {
+		return ava, 0, fmt.Errorf("missing '=' after '%s'", s[i:])
+	}
+
+	ava.attribute = strings.TrimSpace(s[i : i+eq])
+	if ava.attribute == "" || strings.ContainsAny(ava.attribute, ",+;\\\" ") {
+		return ava, 0, fmt.Errorf("invalid attribute type '%s'", ava.attribute)
+	}
+
+	i += eq + 1
+	for i < len(s) && s[i] == ' ' {
+		i++
+	}
+
+	if i < len(s) && s[i] == '#' {
+		return parseHexValue(s, i, ava)
+	}
+
+	var value []byte
+	// significant is the length of the value without unescaped trailing spaces
+	significant := 0
+	for ; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ',' || c == '+' || c == ';':
+			ava.value = string(value[:significant])
+			return ava, i, nil
+		case c == '\\':
+			if i+1 >= len(s) {
+				return ava, 0, fmt.Errorf("escape at the end of '%s'", s)
+			}
+
+			if b, err := hex.DecodeString(safeSlice(s, i+1, i+3)); err == nil {
+				value = append(value, b...)
+				i += 2
+			} else if strings.IndexByte(" \"#+,;<=>\\", s[i+1]) >= 0 {
+				value = append(value, s[i+1])
+				i++
+			} else {
+				return ava, 0, fmt.Errorf("invalid escape '\\%c'", s[i+1])
+			}
+			significant = len(value)
+		case c == '"' || c == '<' || c == '>':
+			return ava, 0, fmt.Errorf("unescaped '%c' in value", c)
+		default:
+			value = append(value, c)
+			if c != ' ' {
+				significant = len(value)
+			}
+		}
+	}
+
+	ava.value = string(value[:significant])
+	return ava, len(s), nil
+}
+
+// parseHexValue parses a value given as the hex encoding of its BER encoding,
+// only primitive values with a short length are supported.
+func parseHexValue(s string, i int, ava typeAndValue) (typeAndValue, int, error) {
+	end := i + 1
+	for end < len(s) && strings.IndexByte(",+;", s[end]) < 0 && s[end] != ' ' {
+		end++
+	}
+
+	ber, err := hex.DecodeString(s[i+1 : end])
+	if err != nil || len(ber) < 2 || ber[0]&0x20 != 0 || int(ber[1]) != len(ber)-2 {
+		return ava, 0, fmt.Errorf("unsupported value '%s'", s[i:end])
+	}
+	ava.value = string(ber[2:])
+
+	for end < len(s) && s[end] == ' ' {
+		end++
+	}
+	if end < len(s) && strings.IndexByte(",+;", s[end]) < 0 {
+		return ava, 0, fmt.Errorf("unexpected '%c' after '%s'", s[end], s[i:end])
+	}
+
+	return ava, end, nil
+}
+
+func safeSlice(s string, from int, to int) string {
+	if to > len(s) {
+		to = len(s)
+	}
+
+	return s[from:to]
+}
+
+// String returns the string representation of the rdn, escaping the values.
+func (rdn relativeDn) String() string {
+	avas := make([]string, len(rdn))
+	for i, ava := range rdn {
+		avas[i] = ava.attribute + "=" + escapeDnValue(ava.value)
+	}
+
+	return strings.Join(avas, "+")
+}
+
+// escapeDnValue escapes the characters of a value which are special in a dn
+// (RFC 4514, section 2.4).
+func escapeDnValue(value string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case strings.IndexByte("\"+,;<>\\", c) >= 0,
+			(c == '#' || c == ' ') && i == 0,
+			c == ' ' && i == len(value)-1:
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case c == 0:
+			buf.WriteString("\\00")
+		default:
+			buf.WriteByte(c)
+		}
+	}
+
+	return buf.String()
+}
+
+// normalized returns a representation of the dn which is the same for all
+// equal dns. Attribute types are replaced by their first name and values are
+// prepared according to the equality matching rule of their attribute.
+func (dn distinguishedName) normalized() string {
+	rdns := make([]string, len(dn))
+	for i, rdn := range dn {
+		avas := make([]string, len(rdn))
+		for j, ava := range rdn {
+			avas[j] = normalizedType(ava.attribute) + "=" + escapeDnValue(normalizedValue(ava.attribute, ava.value))
+		}
+
+		// the pairs of a multi valued rdn are unordered
+		sort.Strings(avas)
+		rdns[i] = strings.Join(avas, "+")
+	}
+
+	return strings.Join(rdns, ",")
+}
+
+func normalizedType(attribute string) string {
+	if names := definitionNames(attributeTypeDefinition(attribute)); len(names) > 0 {
+		return strings.ToLower(names[0])
+	}
+
+	return strings.ToLower(attribute)
+}
+
+func normalizedValue(attribute string, value string) string {
+	value = prepareValue(value)
+
+	switch equalityRule(attributeTypeDefinition(attribute)) {
+	case "caseIgnoreMatch", "caseIgnoreIA5Match", "objectIdentifierMatch":
+		return strings.ToLower(value)
+	default:
+		return value
+	}
+}
+
+// normalizedDn returns the normalized representation of the dn, invalid dns
+// are returned unchanged.
+func normalizedDn(dn string) string {
+	parsed, err := parseDn(dn)
+	if err != nil {
+		return dn
+	}
+
+	return parsed.normalized()
+}
+
+// isAncestorOf checks if the dn is above the other dn.
+func (dn distinguishedName) isAncestorOf(other distinguishedName) bool {
+	return len(dn) < len(other) && dn.normalized() == other[len(other)-len(dn):].normalized()
+}
+
+// equalDn checks if two dns are equal, invalid dns are never equal.
+func equalDn(a string, b string) bool {
+	x, errX := parseDn(a)
+	y, errY := parseDn(b)
+
+	return errX == nil && errY == nil && x.normalized() == y.normalized()
+}
+
+// isAncestor checks if the dn is above the base dn, the empty dn being the root
+// of all entries.
+func isAncestor(dn string, baseDn string) bool {
+	x, errX := parseDn(dn)
+	y, errY := parseDn(baseDn)
+
+	return errX == nil && errY == nil && x.isAncestorOf(y)
+}
+
+// isParent checks if the dn is directly above the base dn.
+func isParent(dn string, baseDn string) bool {
+	x, errX := parseDn(dn)
+	y, errY := parseDn(baseDn)
+
+	return errX == nil && errY == nil && len(x)+1 == len(y) && x.isAncestorOf(y)
+}
+
+// entryDn returns the dn of the entry named by the value of the rdn attribute
+// directly below the base dn.
+func entryDn(rdn string, value string, baseDn string) string {
+	entry := relativeDn{{attribute: rdn, value: value}}.String()
+	if baseDn == "" {
+		return entry
+	}
+
+	return entry + "," + baseDn
+}
+
+// valueFromDn extracts the rdn value of an entry directly below the base dn.
+func valueFromDn(dn string, rdn string, baseDn string) (value string, err error) {
+	entry, err := parseDn(dn)
+	if err != nil {
+		return "", err
+	}
+
+	base, err := parseDn(baseDn)
+	if err != nil {
+		return "", err
+	}
+
+	if len(entry) != len(base)+1 || !base.isAncestorOf(entry) || len(entry[0]) != 1 || attributeKey(entry[0][0].attribute) != attributeKey(rdn) {
+		return "", fmt.Errorf("dn must name an entry by '%s' directly below '%s'", rdn, baseDn)
+	}
+
+	return entry[0][0].value, nil
+}
@@ -0,0 +1,224 @@
+package pkg
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gopenguin/minimal-ldap-proxy/types"
+	"github.com/vjeantet/goldap/message"
+)
+
+// assertionConverter translates an assertion of a search filter for the
+// entries of a tree. The value is empty for presence and substring filters.
+type assertionConverter func(filterType types.FilterType, attribute string, value string) *types.Filter
+
+// convertFilter translates an ldap filter into the backend representation.
+func convertFilter(filter message.Filter, convert assertionConverter) (*types.Filter, error) {
+	switch filter := filter.(type) {
+	case message.FilterAnd:
+		return convertFilters(types.FilterAnd, filter, convert)
+	case message.FilterOr:
+		return convertFilters(types.FilterOr, filter, convert)
+	case message.FilterNot:
+		child, err := convertFilter(filter.Filter, convert)
+		if err != nil {
+			return nil, err
+		}
+
+		return &types.Filter{Type: types.FilterNot, Children: []*types.Filter{child}}, nil
+	case message.FilterEqualityMatch:
+		return convert(types.FilterEqual, string(filter.AttributeDesc()), string(filter.AssertionValue())), nil
+	case message.FilterGreaterOrEqual:
+		return convert(types.FilterGreaterOrEqual, string(filter.AttributeDesc()), string(filter.AssertionValue())), nil
+	case message.FilterLessOrEqual:
+		return convert(types.FilterLessOrEqual, string(filter.AttributeDesc()), string(filter.AssertionValue())), nil
+	case message.FilterApproxMatch:
+		return convert(types.FilterApprox, string(filter.AttributeDesc()), string(filter.AssertionValue())), nil
+	case message.FilterPresent:
+		// every entry has an objectClass, clients use it to match everything
+		if strings.EqualFold(string(filter), "objectClass") {
+			return &types.Filter{Type: types.FilterTrue}, nil
+		}
+
+		return convert(types.FilterPresent, string(filter), ""), nil
+	case message.FilterSubstrings:
+		result := convert(types.FilterSubstrings, string(filter.Type_()), "")
+		if result.Type != types.FilterSubstrings {
+			return result, nil
+		}
+
+		for _, substring := range filter.Substrings() {
+			switch substring := substring.(type) {
+			case message.SubstringInitial:
+				result.Initial = string(substring)
+			case message.SubstringAny:
+				result.Any = append(result.Any, string(substring))
+			case message.SubstringFinal:
+				result.Final = string(substring)
+			}
+		}
+
+		return result, nil
+	default:
+		return nil, fmt.Errorf("filter '%T' not supported", filter)
+	}
+}
+
+func convertFilters(filterType types.FilterType, filters []message.Filter, convert assertionConverter) (*types.Filter, error) {
+	result := &types.Filter{Type: filterType}
+
+	for _, filter := range filters {
+		child, err := convertFilter(filter, convert)
+		if err != nil {
+			return nil, err
+		}
+
+		result.Children = append(result.Children, child)
+	}
+
+	return result, nil
+}
+
+// convertUserAssertion keeps assertions on computed attributes for the
+// evaluation in memory, assertions on unknown attributes never match.
+func (d *directory) convertUserAssertion(filterType types.FilterType, attribute string, value string) *types.Filter {
+	if strings.EqualFold(attribute, "objectClass") {
+		return objectClassAssertion(d.objectClasses, filterType, value)
+	}
+	if c, ok := d.computedAttribute(attribute); ok {
+		return &types.Filter{Type: filterType, Attribute: c.name, Value: value}
+	}
+	name, ok := d.userAttribute(attribute)
+	if !ok {
+		return &types.Filter{Type: types.FilterFalse}
+	}
+	if filter, ok := d.convertDnAssertion(filterType, name, value); ok {
+		return filter
+	}
+	if d.isTimestampAttribute(name) && !validTimestampAssertion(filterType, value) {
+		return &types.Filter{Type: types.FilterFalse}
+	}
+
+	return &types.Filter{
+		Type:      filterType,
+		Attribute: name,
+		Value:     d.timestampValue(name, value),
+	}
+}
+
+// assertions with values which are no GeneralizedTime are undefined (RFC 4511,
+// section 4.5.1.7)
+func validTimestampAssertion(filterType types.FilterType, value string) bool {
+	switch filterType {
+	case types.FilterEqual, types.FilterGreaterOrEqual, types.FilterLessOrEqual:
+		_, err := parseGeneralizedTime(value)
+		return err == nil
+	default:
+		return true
+	}
+}
+
+func (d *directory) userAttribute(attribute string) (name string, ok bool) {
+	return attributeName(append([]string{d.rDn}, d.attributes...), attribute)
+}
+
+func (d *directory) isAttribute(attribute string) bool {
+	_, ok := d.userAttribute(attribute)
+	return ok
+}
+
+func (d *directory) userFromFilter(filter *types.Filter) (user string, err error) {
+	switch filter.Type {
+	case types.FilterEqual:
+		if filter.Attribute != d.rDn {
+			return "", fmt.Errorf("invalid rdn '%s', should be '%s'", filter.Attribute, d.rDn)
+		}
+
+		return filter.Value, nil
+	case types.FilterAnd:
+		for _, child := range filter.Children {
+			user, err = d.userFromFilter(child)
+			if err == nil {
+				return user, nil
+			}
+		}
+
+		return "", fmt.Errorf("no equality match on '%s' in conjunction", d.rDn)
+	default:
+		return "", fmt.Errorf("filter must select a user by '%s'", d.rDn)
+	}
+}
+
+func matchFilter(filter *types.Filter, attributes map[string][]string) bool {
+	switch filter.Type {
+	case types.FilterAnd:
+		for _, child := range filter.Children {
+			if !matchFilter(child, attributes) {
+				return false
+			}
+		}
+
+		return true
+	case types.FilterOr:
+		for _, child := range filter.Children {
+			if matchFilter(child, attributes) {
+				return true
+			}
+		}
+
+		return false
+	case types.FilterNot:
+		return !matchFilter(filter.Children[0], attributes)
+	case types.FilterTrue:
+		return true
+	case types.FilterFalse:
+		return false
+	default:
+		for _, value := range attributes[filter.Attribute] {
+			if matchValue(filter, value) {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+func matchValue(filter *types.Filter, value string) bool {
+	switch filter.Type {
+	case types.FilterEqual:
+		return equalityMatch(filter.Attribute, value, filter.Value)
+	case types.FilterApprox:
+		return strings.EqualFold(value, filter.Value)
+	case types.FilterGreaterOrEqual:
+		return orderingCompare(orderingRule(filter.Attribute), value, filter.Value) >= 0
+	case types.FilterLessOrEqual:
+		return orderingCompare(orderingRule(filter.Attribute), value, filter.Value) <= 0
+	case types.FilterPresent:
+		return true
+	case types.FilterSubstrings:
+		return matchSubstrings(filter, strings.ToLower(value))
+	default:
+		return false
+	}
+}
+
+func matchSubstrings(filter *types.Filter, value string) bool {
+	initial := strings.ToLower(filter.Initial)
+	if !strings.HasPrefix(value, initial) {
+		return false
+	}
+	value = value[len(initial):]
+
+	for _, any := range filter.Any {
+		any = strings.ToLower(any)
+
+		i := strings.Index(value, any)
+		if i < 0 {
+			return false
+		}
+		value = value[i+len(any):]
+	}
+
+	return strings.HasSuffix(value, strings.ToLower(filter.Final))
+}
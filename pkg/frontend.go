@@ -8,49 +8,143 @@ import (
 	jww "github.com/spf13/jwalterweatherman"
 	"github.com/vjeantet/goldap/message"
 	ldap "github.com/vjeantet/ldapserver"
+	"net"
 	"strings"
+	"sync"
+	"time"
 )
 
 type Frontend struct {
-	serverAddr    string
-	cert          tls.Certificate
-	attributes    []string
-	attributesMap map[string]bool
+	serverAddr string
+	cert       tls.Certificate
+
+	// directories are the served naming contexts, the first one is the tree
+	// passed to NewFrontend
+	directories []*directory
+
+	// supportedControls and supportedExtensions are announced in the root DSE
+	supportedControls   []string
+	supportedExtensions []string
+
+	// startTlsAddr is the address of the plain listener supporting StartTLS
+	startTlsAddr   string
+	startTlsServer *ldap.Server
+	// requireTls refuses binds and searches on connections without TLS
+	requireTls bool
+
+	bindPolicy      types.BindPolicy
+	serviceAccounts []types.ServiceAccount
+	accessRules     []types.AccessRule
+
+	// rateLimiter delays binds and searches exceeding the rate limits, nil if
+	// unlimited
+	rateLimiter *rateLimiter
+
+	// lockout locks users out after repeated failed binds, nil if disabled
+	lockout *lockout
+
+	// passwordModify enables the password modify extended operation,
+	// passwordAdmins may change the passwords of all users
+	passwordModify bool
+	passwordAdmins []string
+
+	// writeOperations enables adding, modifying and deleting users, which is
+	// allowed to the writeAdmins
+	writeOperations bool
+	writeAdmins     []string
+
+	// sizeLimit and timeLimit are the maximum limits of searches
+	sizeLimit int
+	timeLimit time.Duration
+	// sortLimit is the maximum number of entries sorted in memory
+	sortLimit int
+
+	sessions      map[net.Conn]*session
+	sessionsMutex sync.Mutex
+
+	router *ldap.RouteMux
+	server *ldap.Server
+}
+
+// Option configures an optional feature of the Frontend, either of the
+// Frontend itself or of the first tree.
+type Option interface {
+	apply(f *Frontend)
+}
+
+// FrontendOption configures the Frontend.
+type FrontendOption func(f *Frontend)
+
+func (o FrontendOption) apply(f *Frontend) {
+	o(f)
+}
 
-	baseDn string
-	rDn    string
+// TreeOption configures a tree of users, the first one if it is passed to
+// NewFrontend or the additional one of WithNamingContext.
+type TreeOption func(d *directory)
 
-	server  *ldap.Server
-	backend types.Backend
+func (o TreeOption) apply(f *Frontend) {
+	o(f.directories[0])
 }
 
 func init() {
 	ldap.Logger = jww.INFO
 }
 
-func NewFrontend(serverAddr string, cert tls.Certificate, baseDn string, rDn string, attributes []string, backend types.Backend) (frontend *Frontend) {
+func NewFrontend(serverAddr string, cert tls.Certificate, baseDn string, rDn string, attributes []string, backend types.Backend, options ...Option) (frontend *Frontend) {
 	frontend = &Frontend{
-		serverAddr:    serverAddr,
-		cert:          cert,
-		baseDn:        baseDn,
-		rDn:           rDn,
-		attributes:    attributes,
-		attributesMap: make(map[string]bool),
-		server:        ldap.NewServer(),
-		backend:       backend,
+		serverAddr:  serverAddr,
+		cert:        cert,
+		directories: []*directory{newDirectory(baseDn, rDn, attributes, backend)},
+		sessions:    make(map[net.Conn]*session),
+		bindPolicy: types.BindPolicy{
+			AllowAnonymousBind: true,
+			AnonymousRootDse:   true,
+		},
+		server: ldap.NewServer(),
 	}
 
-	for _, attr := range attributes {
-		frontend.attributesMap[attr] = true
+	for _, option := range options {
+		option.apply(frontend)
+	}
+
+	for _, d := range frontend.directories {
+		d.defaultObjectClasses()
 	}
 
 	router := ldap.NewRouteMux()
 	router.Bind(frontend.handleBind)
-	router.Search(frontend.handleSearchUser).
-		BaseDn(frontend.baseDn)
-	router.Search(frontend.handleSearchGeneric)
+	router.Search(frontend.handleSearch)
+	router.Compare(frontend.handleCompare)
+	frontend.supportedControls = append(frontend.supportedControls, pagedResultsControl, sortRequestControl, passwordPolicyControl)
+	router.Extended(frontend.handleWhoAmI).RequestName(ldap.NoticeOfWhoAmI).Label("WhoAmI")
+	frontend.supportedExtensions = append(frontend.supportedExtensions, string(ldap.NoticeOfWhoAmI))
+
+	frontend.router = router
+	frontend.server.Handle(frontend)
 
-	frontend.server.Handle(router)
+	if frontend.startTlsAddr != "" {
+		router.Extended(frontend.handleStartTls).RequestName(ldap.NoticeOfStartTLS).Label("StartTLS")
+		frontend.supportedExtensions = append(frontend.supportedExtensions, string(ldap.NoticeOfStartTLS))
+
+		frontend.startTlsServer = ldap.NewServer()
+		frontend.startTlsServer.Handle(frontend)
+	}
+
+	if frontend.passwordModify {
+		router.Extended(frontend.handlePasswordModify).RequestName(ldap.NoticeOfPasswordModify).Label("PasswordModify")
+		frontend.supportedExtensions = append(frontend.supportedExtensions, string(ldap.NoticeOfPasswordModify))
+	}
+
+	if frontend.writeOperations {
+		router.Add(frontend.handleAdd)
+		router.Delete(frontend.handleDelete)
+	}
+
+	// modify requests unlock accounts as well
+	if frontend.writeOperations || frontend.lockout != nil {
+		router.Modify(frontend.handleModify)
+	}
 
 	return frontend
 }
@@ -58,87 +152,114 @@ func NewFrontend(serverAddr string, cert tls.Certificate, baseDn string, rDn str
 func (f *Frontend) handleBind(w ldap.ResponseWriter, m *ldap.Message) {
 	r := m.GetBindRequest()
 	res := ldap.NewBindResponse(ldap.LDAPResultInvalidCredentials)
-	defer func() { w.Write(res) }()
+	var controls []control
+	defer func() { writeWithControls(w, res, controls...) }()
 
-	if r.AuthenticationChoice() == "simple" {
-		dn := string(r.Name())
+	if !f.tarpit(m, "bind", string(r.Name())) {
+		res.SetResultCode(ldap.LDAPResultBusy)
+		res.SetDiagnosticMessage(rateLimitExceeded)
+		return
+	}
 
-		user, err := f.userFromDn(dn)
-		if err != nil {
-			jww.WARN.Printf("Unable to get DN: %v", err)
-			return
-		}
+	if !f.isConfidential(m) {
+		res.SetResultCode(ldap.LDAPResultConfidentialityRequired)
+		res.SetDiagnosticMessage("TLS is required, use StartTLS first")
+		return
+	}
 
-		jww.INFO.Printf("Authenticating %s\n", user)
+	// a bind resets the authentication state, even if it fails
+	session := f.session(m)
+	session.bind("", authMethodAnonymous)
 
+	if r.AuthenticationChoice() == "simple" {
+		dn := string(r.Name())
 		password := string(r.AuthenticationSimple())
 
-		if f.backend.Authenticate(user, password) {
-			res.SetResultCode(ldap.LDAPResultSuccess)
+		// binds without password never authenticate, so the password must
+		// not be verified
+		if password == "" {
+			f.bindWithoutPassword(&res, dn)
+			return
 		}
-	} else {
-		jww.INFO.Printf("Unsupported authentication type %s", r.AuthenticationChoice())
-	}
-}
-
-func (f *Frontend) handleSearchUser(w ldap.ResponseWriter, m *ldap.Message) {
-	r := m.GetSearchRequest()
-
-	filteredAttributes := f.filterAttributes(r.Attributes())
 
-	jww.INFO.Printf("Searching on %s for %s with %s", r.BaseObject(), r.FilterString(), strings.Join(filteredAttributes, ", "))
+		if authenticated, ok := f.authenticateServiceAccount(m, dn, password); ok {
+			jww.INFO.Printf("Authenticating service account %s\n", dn)
 
-	user, err := f.userFromFilter(r.Filter())
-	if err != nil {
-		jww.WARN.Printf("extract user: %v", err)
-		res := ldap.NewSearchResultDoneResponse(ldap.LDAPResultNoSuchAttribute)
-		w.Write(res)
-		return
-	}
+			if authenticated {
+				res.SetResultCode(ldap.LDAPResultSuccess)
+				session.bind(dn, authMethodSimple)
+			}
+			return
+		}
 
-	result := f.backend.Search(user, filteredAttributes)
+		d, user, err := f.userDirectory(dn)
+		if err != nil {
+			jww.WARN.Printf("Unable to get DN: %v", err)
+			return
+		}
 
-	if result != nil {
-		entry := ldap.NewSearchResultEntry(fmt.Sprintf("%s=%s,%s", f.rDn, result.Attributes[f.rDn][0], string(r.BaseObject())))
+		jww.INFO.Printf("Authenticating %s\n", user)
 
-		for key, value := range result.Attributes {
-			var attributeValues []message.AttributeValue
-			for _, v := range value {
-				attributeValues = append(attributeValues, message.AttributeValue(v))
+		authenticated, policy := f.authenticate(m, d, dn, user, password)
+		result := checkPasswordPolicy(authenticated, policy)
+		if requestControl(m, passwordPolicyControl) != nil {
+			policyControl, err := result.control()
+			if err != nil {
+				res.SetResultCode(ldap.LDAPResultOperationsError)
+				res.SetDiagnosticMessage(err.Error())
+				return
 			}
+			controls = append(controls, policyControl)
+		}
 
-			entry.AddAttribute(message.AttributeDescription(key), attributeValues...)
+		if authenticated && !result.allowed {
+			jww.INFO.Printf("Password policy refuses bind of %s: %+v", user, policy)
 		}
 
-		w.Write(entry)
+		if result.allowed {
+			res.SetResultCode(ldap.LDAPResultSuccess)
+			session.bind(dn, authMethodSimple)
+			// after a reset the session may only change the password
+			session.requirePasswordChange(policy.MustChange)
+		}
+	} else {
+		jww.INFO.Printf("Unsupported authentication type %s", r.AuthenticationChoice())
+		res.SetResultCode(ldap.LDAPResultAuthMethodNotSupported)
 	}
-
-	res := ldap.NewSearchResultDoneResponse(ldap.LDAPResultSuccess)
-	w.Write(res)
-}
-
-func (f *Frontend) handleSearchGeneric(w ldap.ResponseWriter, m *ldap.Message) {
-	r := m.GetSearchRequest()
-
-	jww.INFO.Printf("Unhandled search request: %s", r.BaseObject())
-
-	res := ldap.NewSearchResultDoneResponse(ldap.LDAPResultNoSuchObject)
-	w.Write(res)
 }
 
 func (f *Frontend) Serve() {
 	go func() {
-		err := f.server.ListenAndServe(f.serverAddr, f.secureConnection)
+		err := f.server.ListenAndServe(f.serverAddr, f.trackConnections, f.secureConnection)
 		jww.ERROR.Println(err)
 	}()
+
+	if f.startTlsServer != nil {
+		go func() {
+			err := f.startTlsServer.ListenAndServe(f.startTlsAddr, f.trackConnections)
+			jww.ERROR.Println(err)
+		}()
+	}
 }
 
 func (f *Frontend) Stop() {
 	f.server.Stop()
+
+	if f.startTlsServer != nil {
+		f.startTlsServer.Stop()
+	}
 }
 
 func (f *Frontend) secureConnection(s *ldap.Server) {
-	config := &tls.Config{
+	config := f.tlsConfig()
+
+	s.Listener = tls.NewListener(s.Listener, config)
+
+	jww.INFO.Printf("Listener secured: %v", formatTlsConfig(config))
+}
+
+func (f *Frontend) tlsConfig() *tls.Config {
+	return &tls.Config{
 		Certificates:             []tls.Certificate{f.cert},
 		MinVersion:               tls.VersionTLS12,
 		CurvePreferences:         []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
@@ -152,53 +273,62 @@ func (f *Frontend) secureConnection(s *ldap.Server) {
 			tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
 		},
 	}
-
-	s.Listener = tls.NewListener(s.Listener, config)
-
-	jww.INFO.Printf("Listener secured: %v", formatTlsConfig(config))
 }
 
-func (f *Frontend) filterAttributes(attributes message.AttributeSelection) []string {
-	// if no attributes are selected, return all attributes by default
+func (d *directory) filterAttributes(attributes message.AttributeSelection) []string {
+	// if no attributes are selected, return all user attributes by default
 	if len(attributes) == 0 {
-		return f.attributes
+		return d.servedAttributes(false)
 	}
 
-	filtered := []string{f.rDn}
+	filtered := []string{d.rDn}
+	add := func(name string) {
+		if !containsString(filtered, name) {
+			filtered = append(filtered, name)
+		}
+	}
 
 	for _, attr := range attributes {
-		_, ok := f.attributesMap[string(attr)]
-		if ok {
-			filtered = append(filtered, string(attr))
+		switch string(attr) {
+		case "*":
+			for _, name := range d.servedAttributes(false) {
+				add(name)
+			}
+		case "+":
+			for _, name := range d.servedAttributes(true) {
+				add(name)
+			}
+		default:
+			if name, ok := d.userAttribute(string(attr)); ok {
+				add(name)
+			}
 		}
 	}
 
 	return filtered
 }
 
-func (f *Frontend) userFromDn(dn string) (user string, err error) {
-	prefix := f.rDn + "="
-	suffix := "," + f.baseDn
-
-	if strings.HasPrefix(dn, prefix) && strings.HasSuffix(dn, suffix) {
-		return strings.TrimSuffix(strings.TrimPrefix(dn, prefix), suffix), nil
+// servedAttributes returns either the user attributes or the operational
+// attributes of the users, which are only returned if they are selected by
+// name or with "+" (RFC 3673).
+func (d *directory) servedAttributes(operational bool) []string {
+	var attributes []string
+	for _, name := range d.attributes {
+		if isOperationalAttribute(name) == operational {
+			attributes = append(attributes, name)
+		}
 	}
 
-	return "", fmt.Errorf("dn must have a prefix of '%s' and suffix of '%s'", prefix, suffix)
+	return attributes
 }
 
-func (f *Frontend) userFromFilter(filter message.Filter) (user string, err error) {
-	switch filter.(type) {
-	case message.FilterEqualityMatch:
-		eq := filter.(message.FilterEqualityMatch)
-		if string(eq.AttributeDesc()) != f.rDn {
-			return "", fmt.Errorf("invalid rdn '%s', should be '%s'", string(eq.AttributeDesc()), f.rDn)
-		}
+// newSearchResultDone creates a search result done response including a
+// diagnostic message, which ldap.NewSearchResultDoneResponse does not support.
+func newSearchResultDone(resultCode int, diagnosticMessage string) message.SearchResultDone {
+	res := ldap.NewResponse(resultCode)
+	res.SetDiagnosticMessage(diagnosticMessage)
 
-		return string(eq.AssertionValue()), nil
-	default:
-		return "", fmt.Errorf("filter '%T' not supported", filter)
-	}
+	return message.SearchResultDone(res)
 }
 
 func formatTlsConfig(c *tls.Config) string {
@@ -0,0 +1,133 @@
+package pkg
+
+import (
+	"github.com/gopenguin/minimal-ldap-proxy/pkg/password"
+	"github.com/gopenguin/minimal-ldap-proxy/types"
+	ldap "github.com/vjeantet/ldapserver"
+)
+
+// WithServiceAccounts adds accounts which are not served by the backend, e.g.
+// for applications searching the directory. The passwords are hashed like the
+// passwords of the users.
+func WithServiceAccounts(accounts []types.ServiceAccount) FrontendOption {
+	return func(f *Frontend) {
+		f.serviceAccounts = accounts
+	}
+}
+
+// WithAccessRules restricts the trees and attributes bound accounts may search.
+// Without rules every bound account may search everything.
+func WithAccessRules(rules []types.AccessRule) FrontendOption {
+	return func(f *Frontend) {
+		f.accessRules = rules
+	}
+}
+
+// authenticateServiceAccount verifies the password if the dn is the dn of a
+// service account, ok is false otherwise. Service accounts are locked out like
+// users.
+func (f *Frontend) authenticateServiceAccount(m *ldap.Message, dn string, pw string) (authenticated bool, ok bool) {
+	account, ok := f.serviceAccount(dn)
+	if !ok {
+		return false, false
+	}
+
+	verify := func() bool { return password.Verify(pw, account.Password) }
+	if f.lockout == nil {
+		return verify(), true
+	}
+
+	authenticated, _ = f.lockout.verify(m, dn, verify, func() bool { return true })
+	return authenticated, true
+}
+
+func (f *Frontend) serviceAccount(dn string) (types.ServiceAccount, bool) {
+	for _, account := range f.serviceAccounts {
+		if equalDn(account.Dn, dn) {
+			return account, true
+		}
+	}
+
+	return types.ServiceAccount{}, false
+}
+
+// accessRights are the rights of a bound account on a tree.
+type accessRights struct {
+	// all allows to read every attribute
+	all bool
+	// attributes holds the keys of the readable attribute types
+	attributes map[string]bool
+}
+
+// accessRights collects the rights of the rules for the bind dn which cover the
+// tree below baseDn, ok is false if the tree must not be searched. The rdn of
+// the tree and the objectClass are always readable, as they are part of every
+// entry.
+func (f *Frontend) accessRights(bindDn string, baseDn string, rdn string) (rights *accessRights, ok bool) {
+	if len(f.accessRules) == 0 {
+		return &accessRights{all: true}, true
+	}
+
+	for _, rule := range f.accessRules {
+		if rule.BindDn != "*" && !equalDn(rule.BindDn, bindDn) {
+			continue
+		}
+		if !coversTree(rule.BaseDns, baseDn) {
+			continue
+		}
+
+		if rights == nil {
+			rights = &accessRights{attributes: map[string]bool{
+				attributeKey(rdn):           true,
+				attributeKey("objectClass"): true,
+			}}
+		}
+
+		rights.all = rights.all || len(rule.Attributes) == 0
+		for _, attr := range rule.Attributes {
+			rights.attributes[attributeKey(attr)] = true
+		}
+	}
+
+	return rights, rights != nil
+}
+
+// coversTree checks if one of the base dns is the base dn of the tree or above
+// it.
+func coversTree(baseDns []string, baseDn string) bool {
+	for _, dn := range baseDns {
+		if equalDn(dn, baseDn) || isAncestor(dn, baseDn) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (a *accessRights) canRead(attribute string) bool {
+	return a.all || a.attributes[attributeKey(attribute)]
+}
+
+// filter removes the attributes which must not be read.
+func (a *accessRights) filter(attributes []string) []string {
+	var filtered []string
+	for _, attr := range attributes {
+		if a.canRead(attr) {
+			filtered = append(filtered, attr)
+		}
+	}
+
+	return filtered
+}
+
+// restrict replaces assertions on attributes which must not be read by a
+// constant false filter, so their values can not be probed by searching.
+func (a *accessRights) restrict(convert assertionConverter) assertionConverter {
+	return func(filterType types.FilterType, attribute string, value string) *types.Filter {
+		if !a.canRead(attribute) {
+			return &types.Filter{Type: types.FilterFalse}
+		}
+
+		return convert(filterType, attribute, value)
+	}
+}
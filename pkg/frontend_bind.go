@@ -0,0 +1,45 @@
+package pkg
+
+import (
+	"github.com/gopenguin/minimal-ldap-proxy/types"
+	jww "github.com/spf13/jwalterweatherman"
+	"github.com/vjeantet/goldap/message"
+	ldap "github.com/vjeantet/ldapserver"
+)
+
+// WithBindPolicy replaces the default policy, which allows anonymous binds and
+// anonymous access to the root DSE but refuses unauthenticated binds.
+func WithBindPolicy(policy types.BindPolicy) FrontendOption {
+	return func(f *Frontend) {
+		f.bindPolicy = policy
+	}
+}
+
+// bindWithoutPassword answers anonymous and unauthenticated binds according to
+// the bind policy. Even if successful the connection stays anonymous.
+func (f *Frontend) bindWithoutPassword(res *message.BindResponse, dn string) {
+	if dn == "" {
+		if !f.bindPolicy.AllowAnonymousBind {
+			jww.INFO.Printf("Refusing anonymous bind")
+			res.SetResultCode(ldap.LDAPResultInappropriateAuthentication)
+			res.SetDiagnosticMessage("anonymous binds are not allowed")
+			return
+		}
+
+		jww.INFO.Printf("Anonymous bind")
+		res.SetResultCode(ldap.LDAPResultSuccess)
+		return
+	}
+
+	// RFC 4513, section 5.1.2: unauthenticated binds should be refused by
+	// default, as clients might not notice that no password was sent
+	if !f.bindPolicy.AllowUnauthenticatedBind {
+		jww.INFO.Printf("Refusing unauthenticated bind of %s", dn)
+		res.SetResultCode(ldap.LDAPResultUnwillingToPerform)
+		res.SetDiagnosticMessage("unauthenticated binds are not allowed")
+		return
+	}
+
+	jww.INFO.Printf("Unauthenticated bind of %s", dn)
+	res.SetResultCode(ldap.LDAPResultSuccess)
+}
@@ -0,0 +1,185 @@
+package pkg
+
+import (
+	"context"
+	"strings"
+
+	"github.com/gopenguin/minimal-ldap-proxy/types"
+	jww "github.com/spf13/jwalterweatherman"
+	"github.com/vjeantet/goldap/message"
+	ldap "github.com/vjeantet/ldapserver"
+)
+
+// handleCompare checks if an attribute of an entry has a value, using the
+// equality matching rule of the attribute.
+func (f *Frontend) handleCompare(w ldap.ResponseWriter, m *ldap.Message) {
+	r := m.GetCompareRequest()
+	dn := string(r.Entry())
+	attribute := string(r.Ava().AttributeDesc())
+	value := string(r.Ava().AssertionValue())
+
+	if !f.isConfidential(m) {
+		w.Write(newCompareResponse(ldap.LDAPResultConfidentialityRequired, "TLS is required, use StartTLS first"))
+		return
+	}
+
+	session := f.session(m)
+	bindDn := session.BindDn()
+	if bindDn == "" {
+		w.Write(newCompareResponse(ldap.LDAPResultInsufficientAccessRights, "authentication required, bind first"))
+		return
+	}
+	if session.MustChangePassword() {
+		w.Write(newCompareResponse(ldap.LDAPResultInsufficientAccessRights, passwordChangeRequired))
+		return
+	}
+
+	jww.INFO.Printf("Comparing %s of %s as %s", attribute, dn, bindDn)
+
+	values, resultCode := f.compareValues(bindDn, dn, attribute)
+	if resultCode != ldap.LDAPResultSuccess {
+		w.Write(newCompareResponse(resultCode, ""))
+		return
+	}
+	if d, _, err := f.userDirectory(dn); err == nil {
+		value = d.timestampValue(attribute, value)
+	}
+
+	for _, v := range values {
+		if equalityMatch(attribute, v, value) {
+			w.Write(newCompareResponse(ldap.LDAPResultCompareTrue, ""))
+			return
+		}
+	}
+
+	w.Write(newCompareResponse(ldap.LDAPResultCompareFalse, ""))
+}
+
+// compareValues loads the values of the attribute of the entry, the result
+// code tells why there are no values to compare.
+func (f *Frontend) compareValues(bindDn string, dn string, attribute string) (values []string, resultCode int) {
+	for _, d := range f.directories {
+		if equalDn(dn, d.baseDn) || (d.groupBaseDn != "" && equalDn(dn, d.groupBaseDn)) {
+			return valuesOf(baseAttributes(dn), attribute)
+		}
+	}
+
+	if d, user, err := f.userDirectory(dn); err == nil {
+		return f.compareUserValues(bindDn, d, user, attribute)
+	}
+
+	for _, d := range f.directories {
+		if d.groupBaseDn == "" {
+			continue
+		}
+
+		if group, err := valueFromDn(dn, d.groupRdn, d.groupBaseDn); err == nil {
+			return f.compareGroupValues(bindDn, d, group, attribute)
+		}
+	}
+
+	return nil, ldap.LDAPResultNoSuchObject
+}
+
+func (f *Frontend) compareUserValues(bindDn string, d *directory, user string, attribute string) (values []string, resultCode int) {
+	if c, ok := d.computedAttribute(attribute); ok {
+		return f.compareComputedValues(bindDn, d, user, c)
+	}
+
+	name, known := d.userAttribute(attribute)
+	if !known {
+		name = attribute
+	}
+
+	rights, ok := f.accessRights(bindDn, d.baseDn, d.rDn)
+	if !ok || !rights.canRead(name) {
+		return nil, ldap.LDAPResultInsufficientAccessRights
+	}
+
+	if name == d.rDn {
+		return []string{user}, ldap.LDAPResultSuccess
+	}
+	objectClass := strings.EqualFold(name, "objectClass")
+	if !objectClass && !known {
+		return nil, ldap.LDAPResultNoSuchAttribute
+	}
+
+	// the objectClass is not queried, but the entry must exist
+	columns := []string{name}
+	if objectClass {
+		columns = []string{d.rDn}
+	}
+
+	result := d.backend.Search(context.Background(), user, nil, columns)
+	if result == nil {
+		return nil, ldap.LDAPResultNoSuchObject
+	}
+	if objectClass {
+		return d.objectClasses, ldap.LDAPResultSuccess
+	}
+
+	values, resultCode = valuesOf(result.Attributes, name)
+	return d.dnValues(name, values), resultCode
+}
+
+func (f *Frontend) compareComputedValues(bindDn string, d *directory, user string, c *computedAttribute) (values []string, resultCode int) {
+	rights, ok := f.accessRights(bindDn, d.baseDn, d.rDn)
+	if !ok || !c.readable(rights) {
+		return nil, ldap.LDAPResultInsufficientAccessRights
+	}
+	if c.err != nil {
+		return nil, ldap.LDAPResultNoSuchAttribute
+	}
+
+	result := d.backend.Search(context.Background(), user, nil, append([]string{d.rDn}, c.sources()...))
+	if result == nil {
+		return nil, ldap.LDAPResultNoSuchObject
+	}
+
+	return valuesOf(d.computeAttributes(result, []*computedAttribute{c}).Attributes, c.name)
+}
+
+func (f *Frontend) compareGroupValues(bindDn string, d *directory, group string, attribute string) (values []string, resultCode int) {
+	rights, ok := f.accessRights(bindDn, d.groupBaseDn, d.groupRdn)
+	if !ok || !rights.canRead(attribute) {
+		return nil, ldap.LDAPResultInsufficientAccessRights
+	}
+
+	filter := &types.Filter{Type: types.FilterEqual, Attribute: d.groupRdn, Value: group}
+	attributes, selected := d.filterGroupAttributes(message.AttributeSelection{message.LDAPString(attribute)}, rights)
+
+	var entry map[string][]string
+	err := d.backend.ListGroups(context.Background(), filter, attributes, types.ListOptions{}, func(result *types.Result) {
+		entry = d.groupEntryAttributes(result, selected)
+	})
+	if err != nil {
+		jww.WARN.Printf("compare group: %v", err)
+		return nil, ldap.LDAPResultOperationsError
+	}
+	if entry == nil {
+		return nil, ldap.LDAPResultNoSuchObject
+	}
+
+	if name, ok := d.groupAttribute(attribute); ok {
+		attribute = name
+	}
+
+	return valuesOf(entry, attribute)
+}
+
+func valuesOf(attributes map[string][]string, attribute string) ([]string, int) {
+	values := attributes[attribute]
+	if len(values) == 0 {
+		return nil, ldap.LDAPResultNoSuchAttribute
+	}
+
+	return values, ldap.LDAPResultSuccess
+}
+
+// newCompareResponse creates a compare response including a diagnostic message.
+func newCompareResponse(resultCode int, diagnosticMessage string) message.CompareResponse {
+	res := ldap.NewResponse(resultCode)
+	res.SetDiagnosticMessage(diagnosticMessage)
+
+	return message.CompareResponse(res)
+}
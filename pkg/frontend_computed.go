@@ -0,0 +1,361 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/gopenguin/minimal-ldap-proxy/types"
+	"github.com/vjeantet/goldap/message"
+)
+
+// computedAttribute is served with its template, placeholders like '{sn}' are
+// replaced by the first value of the attribute.
+type computedAttribute struct {
+	name  string
+	parts []templatePart
+	err   error
+}
+
+type templatePart struct {
+	text      string
+	attribute string
+}
+
+// WithComputedAttributes serves attributes computed from the other attributes
+// of the users, e.g. a displayName of the given name and surname.
+func WithComputedAttributes(attributes []types.ComputedAttribute) TreeOption {
+	return func(d *directory) {
+		d.computedAttributes = nil
+		for _, attribute := range attributes {
+			c := &computedAttribute{name: attribute.Attribute}
+			c.parts, c.err = d.parseComputedTemplate(attribute.Template)
+			d.computedAttributes = append(d.computedAttributes, c)
+		}
+	}
+}
+
+func (d *directory) parseComputedTemplate(template string) (parts []templatePart, err error) {
+	rest := template
+	for rest != "" {
+		i := strings.IndexByte(rest, '{')
+		if i < 0 {
+			parts = append(parts, templatePart{text: rest})
+			break
+		}
+		if i > 0 {
+			parts = append(parts, templatePart{text: rest[:i]})
+		}
+
+		j := strings.IndexByte(rest[i:], '}')
+		if j < 0 {
+			return nil, fmt.Errorf("template '%s' has an unclosed placeholder", template)
+		}
+
+		placeholder := strings.TrimSpace(rest[i+1 : i+j])
+		name, ok := d.userAttribute(placeholder)
+		if !ok {
+			return nil, fmt.Errorf("template '%s' references '%s', which is not served", template, placeholder)
+		}
+
+		parts = append(parts, templatePart{attribute: name})
+		rest = rest[i+j+1:]
+	}
+
+	return parts, nil
+}
+
+func (d *directory) checkComputedAttributes() error {
+	for _, c := range d.computedAttributes {
+		if c.err != nil {
+			return fmt.Errorf("computed attribute '%s': %v", c.name, c.err)
+		}
+
+		if d.isAttribute(c.name) || strings.EqualFold(c.name, "objectClass") {
+			return fmt.Errorf("computed attribute '%s' is served by the backend", c.name)
+		}
+	}
+
+	return nil
+}
+
+func (d *directory) computedAttribute(attribute string) (c *computedAttribute, ok bool) {
+	for _, c := range d.computedAttributes {
+		if attributeKey(c.name) == attributeKey(attribute) {
+			return c, true
+		}
+	}
+
+	return nil, false
+}
+
+func (c *computedAttribute) sources() []string {
+	var sources []string
+	for _, part := range c.parts {
+		if part.attribute != "" && !containsString(sources, part.attribute) {
+			sources = append(sources, part.attribute)
+		}
+	}
+
+	return sources
+}
+
+// readable checks the attributes it is computed of as well, as its value
+// discloses them.
+func (c *computedAttribute) readable(rights *accessRights) bool {
+	if !rights.canRead(c.name) {
+		return false
+	}
+
+	for _, source := range c.sources() {
+		if !rights.canRead(source) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (d *directory) restrictComputed(rights *accessRights, convert assertionConverter) assertionConverter {
+	return func(filterType types.FilterType, attribute string, value string) *types.Filter {
+		if c, ok := d.computedAttribute(attribute); ok && !c.readable(rights) {
+			return &types.Filter{Type: types.FilterFalse}
+		}
+
+		return convert(filterType, attribute, value)
+	}
+}
+
+func (c *computedAttribute) value(d *directory, result *types.Result) (value string, ok bool) {
+	var buf bytes.Buffer
+	for _, part := range c.parts {
+		if part.attribute == "" {
+			buf.WriteString(part.text)
+			continue
+		}
+
+		values := result.Attributes[part.attribute]
+		if part.attribute == d.rDn {
+			values = []string{result.Rdn}
+		}
+		if len(values) == 0 {
+			return "", false
+		}
+
+		buf.WriteString(values[0])
+	}
+
+	return buf.String(), true
+}
+
+func (d *directory) computeAttributes(result *types.Result, computed []*computedAttribute) *types.Result {
+	if len(computed) == 0 {
+		return result
+	}
+
+	completed := &types.Result{Rdn: result.Rdn, Attributes: make(map[string][]string)}
+	for key, values := range result.Attributes {
+		completed.Attributes[key] = values
+	}
+
+	for _, c := range computed {
+		if value, ok := c.value(d, result); ok {
+			completed.Attributes[c.name] = []string{value}
+		}
+	}
+
+	return completed
+}
+
+type computedSearch struct {
+	directory *directory
+
+	selected []*computedAttribute
+	// filter is evaluated in memory if it asserts computed attributes
+	filter   *types.Filter
+	asserted []*computedAttribute
+	// columns are only listed to compute the attributes
+	columns []string
+}
+
+// newComputedSearch returns the filter and columns for the backend, the filter
+// matches at least the entries the full filter matches.
+func (d *directory) newComputedSearch(filter *types.Filter, selection message.AttributeSelection, rights *accessRights, columns []string) (c *computedSearch, backendFilter *types.Filter, listed []string) {
+	c = &computedSearch{directory: d}
+	for _, computed := range d.computedAttributes {
+		if computed.err == nil && computed.readable(rights) && selectsComputedAttribute(selection, computed.name) {
+			c.selected = append(c.selected, computed)
+		}
+	}
+
+	filter = d.expandComputedPresence(filter)
+	backendFilter = filter
+	if d.assertsComputedAttribute(filter) {
+		c.filter = filter
+		backendFilter = d.withoutComputedAssertions(filter)
+	}
+
+	listed = append([]string{}, columns...)
+	add := func(name string) {
+		if name != "" && !containsString(listed, name) {
+			listed = append(listed, name)
+			c.columns = append(c.columns, name)
+		}
+	}
+
+	if c.filter != nil {
+		walkAssertions(c.filter, func(assertion *types.Filter) {
+			if computed, ok := d.computedAttribute(assertion.Attribute); ok {
+				c.asserted = append(c.asserted, computed)
+			} else {
+				add(assertion.Attribute)
+			}
+		})
+	}
+	for _, computed := range append(append([]*computedAttribute{}, c.selected...), c.asserted...) {
+		for _, source := range computed.sources() {
+			add(source)
+		}
+	}
+
+	return c, backendFilter, listed
+}
+
+func (c *computedSearch) match(result *types.Result) bool {
+	return c.filter == nil || matchFilter(c.filter, c.directory.computeAttributes(result, c.asserted).Attributes)
+}
+
+func (c *computedSearch) entry(result *types.Result) *types.Result {
+	return withoutAttributes(c.directory.computeAttributes(result, c.selected), c.columns)
+}
+
+// inMemory filters a listing before the range of the options is selected, the
+// listing is cancelled once the range is complete.
+func (c *computedSearch) inMemory(ctx context.Context, list func(ctx context.Context, options types.ListOptions, fn func(result *types.Result)) error) func(options types.ListOptions, fn func(result *types.Result)) error {
+	if c.filter == nil {
+		return func(options types.ListOptions, fn func(result *types.Result)) error {
+			return list(ctx, options, fn)
+		}
+	}
+
+	return func(options types.ListOptions, fn func(result *types.Result)) error {
+		listCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		n := 0
+		complete := false
+		err := list(listCtx, types.ListOptions{Sort: options.Sort}, func(result *types.Result) {
+			if complete || !c.match(result) {
+				return
+			}
+
+			if n >= options.Offset {
+				fn(result)
+			}
+			n++
+
+			if options.Limit > 0 && n >= options.Offset+options.Limit {
+				complete = true
+				cancel()
+			}
+		})
+		if complete && ctx.Err() == nil {
+			return nil
+		}
+
+		return err
+	}
+}
+
+func (d *directory) assertsComputedAttribute(filter *types.Filter) bool {
+	asserts := false
+	walkAssertions(filter, func(assertion *types.Filter) {
+		_, ok := d.computedAttribute(assertion.Attribute)
+		asserts = asserts || ok
+	})
+
+	return asserts
+}
+
+// expandComputedPresence replaces presence assertions on computed attributes by
+// ones on the attributes they are computed of.
+func (d *directory) expandComputedPresence(filter *types.Filter) *types.Filter {
+	switch filter.Type {
+	case types.FilterAnd, types.FilterOr, types.FilterNot:
+		result := &types.Filter{Type: filter.Type}
+		for _, child := range filter.Children {
+			result.Children = append(result.Children, d.expandComputedPresence(child))
+		}
+
+		return result
+	case types.FilterPresent:
+		c, ok := d.computedAttribute(filter.Attribute)
+		if !ok || c.err != nil {
+			return filter
+		}
+
+		if len(c.sources()) == 0 {
+			return &types.Filter{Type: types.FilterTrue}
+		}
+
+		result := &types.Filter{Type: types.FilterAnd}
+		for _, source := range c.sources() {
+			result.Children = append(result.Children, &types.Filter{Type: types.FilterPresent, Attribute: source})
+		}
+
+		return result
+	default:
+		return filter
+	}
+}
+
+func (d *directory) withoutComputedAssertions(filter *types.Filter) *types.Filter {
+	switch filter.Type {
+	case types.FilterAnd, types.FilterOr:
+		result := &types.Filter{Type: filter.Type}
+		for _, child := range filter.Children {
+			result.Children = append(result.Children, d.withoutComputedAssertions(child))
+		}
+
+		return result
+	case types.FilterNot:
+		if d.assertsComputedAttribute(filter) {
+			return &types.Filter{Type: types.FilterTrue}
+		}
+
+		return filter
+	default:
+		if _, ok := d.computedAttribute(filter.Attribute); ok {
+			return &types.Filter{Type: types.FilterTrue}
+		}
+
+		return filter
+	}
+}
+
+func walkAssertions(filter *types.Filter, fn func(assertion *types.Filter)) {
+	switch filter.Type {
+	case types.FilterAnd, types.FilterOr, types.FilterNot:
+		for _, child := range filter.Children {
+			walkAssertions(child, fn)
+		}
+	case types.FilterTrue, types.FilterFalse:
+	default:
+		fn(filter)
+	}
+}
+
+func selectsComputedAttribute(selection message.AttributeSelection, attribute string) bool {
+	if len(selection) == 0 {
+		return true
+	}
+
+	for _, attr := range selection {
+		if string(attr) == "*" || attributeKey(string(attr)) == attributeKey(attribute) {
+			return true
+		}
+	}
+
+	return false
+}
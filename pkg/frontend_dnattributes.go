@@ -0,0 +1,132 @@
+package pkg
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gopenguin/minimal-ldap-proxy/types"
+)
+
+// dnPlaceholder is replaced by the value of a dn attribute in its template.
+const dnPlaceholder = "{}"
+
+// dnTemplate turns the values of an attribute into the dns of the entries named
+// by them directly below baseDn. err is set for invalid templates, which are
+// reported by CheckSchema.
+type dnTemplate struct {
+	attribute string
+	rdn       string
+	baseDn    string
+	err       error
+}
+
+// WithDnAttributes serves the values of the attributes of the users as dns,
+// e.g. the group names of memberOf as the dns of the groups. Assertions on the
+// dns are converted back to the values.
+func WithDnAttributes(attributes []types.DnAttribute) TreeOption {
+	return func(d *directory) {
+		d.dnTemplates = make(map[string]*dnTemplate)
+		for _, attribute := range attributes {
+			t := &dnTemplate{attribute: attribute.Attribute}
+			t.rdn, t.baseDn, t.err = parseDnTemplate(attribute.Template)
+			d.dnTemplates[attributeKey(attribute.Attribute)] = t
+		}
+	}
+}
+
+// parseDnTemplate splits a template into the attribute of the rdn holding the
+// value and the dn below which the named entries are.
+func parseDnTemplate(template string) (rdn string, baseDn string, err error) {
+	i := strings.Index(template, "="+dnPlaceholder)
+	if i >= 0 {
+		rdn = strings.TrimSpace(template[:i])
+	}
+	if rdn == "" || strings.ContainsAny(rdn, "=,+;\\\" ") {
+		return "", "", fmt.Errorf("template '%s' must start with an rdn valued '%s'", template, dnPlaceholder)
+	}
+
+	rest := strings.TrimSpace(template[i+len(dnPlaceholder)+1:])
+	if rest != "" {
+		if rest[0] != ',' {
+			return "", "", fmt.Errorf("template '%s' must start with an rdn valued '%s'", template, dnPlaceholder)
+		}
+		baseDn = strings.TrimSpace(rest[1:])
+	}
+
+	if dn, err := parseDn(entryDn(rdn, "value", baseDn)); err != nil || len(dn[0]) != 1 {
+		return "", "", fmt.Errorf("template '%s' is not a valid dn", template)
+	}
+
+	return rdn, baseDn, nil
+}
+
+// checkDnTemplates verifies that the templates of the dn attributes are valid
+// and that the attributes are served.
+func (d *directory) checkDnTemplates() error {
+	for _, t := range d.dnTemplates {
+		if t.err != nil {
+			return fmt.Errorf("dn attribute '%s': %v", t.attribute, t.err)
+		}
+
+		if !d.isAttribute(t.attribute) {
+			return fmt.Errorf("dn attribute '%s' is not served", t.attribute)
+		}
+	}
+
+	return nil
+}
+
+// dnValues returns the values of an attribute of a user as served, i.e. values
+// of dn attributes are turned into dns.
+func (d *directory) dnValues(attribute string, values []string) []string {
+	t, ok := d.dnTemplates[attributeKey(attribute)]
+	if !ok || t.err != nil {
+		return values
+	}
+
+	dns := make([]string, len(values))
+	for i, value := range values {
+		dns[i] = entryDn(t.rdn, value, t.baseDn)
+	}
+
+	return dns
+}
+
+// dnValue returns the value held by the backend for a value of an attribute of
+// a user, dns of dn attributes are turned back into the values.
+func (d *directory) dnValue(attribute string, value string) (string, error) {
+	t, ok := d.dnTemplates[attributeKey(attribute)]
+	if !ok {
+		return value, nil
+	}
+	if t.err != nil {
+		return "", t.err
+	}
+
+	return valueFromDn(value, t.rdn, t.baseDn)
+}
+
+// convertDnAssertion converts an assertion on a dn attribute to an assertion
+// on the value held by the backend, ok is false for other attributes. Only
+// equality and presence assertions can match, the other ones do not apply to
+// dns.
+func (d *directory) convertDnAssertion(filterType types.FilterType, attribute string, value string) (filter *types.Filter, ok bool) {
+	t, ok := d.dnTemplates[attributeKey(attribute)]
+	if !ok {
+		return nil, false
+	}
+
+	switch {
+	case filterType == types.FilterPresent:
+		return &types.Filter{Type: filterType, Attribute: attribute}, true
+	case filterType != types.FilterEqual || t.err != nil:
+		return &types.Filter{Type: types.FilterFalse}, true
+	}
+
+	value, err := valueFromDn(value, t.rdn, t.baseDn)
+	if err != nil {
+		return &types.Filter{Type: types.FilterFalse}, true
+	}
+
+	return &types.Filter{Type: filterType, Attribute: attribute, Value: value}, true
+}
@@ -0,0 +1,194 @@
+package pkg
+
+import (
+	"context"
+
+	"github.com/gopenguin/minimal-ldap-proxy/types"
+	"github.com/vjeantet/goldap/message"
+	ldap "github.com/vjeantet/ldapserver"
+)
+
+// The membership attributes of a group entry are all derived from the member
+// column of the group query, which holds the rdn value of the user.
+const (
+	memberAttribute       = "member"
+	uniqueMemberAttribute = "uniqueMember"
+	memberUidAttribute    = "memberUid"
+)
+
+// WithGroups serves the groups of the backend below their own base dn. The
+// group query returns a row for every group and member, the attributes are
+// additional columns served for the groups.
+func WithGroups(baseDn string, rdn string, attributes []string) TreeOption {
+	return func(d *directory) {
+		d.groupBaseDn = baseDn
+		d.groupRdn = rdn
+		d.groupAttributes = attributes
+	}
+}
+
+// convertGroupAssertion translates assertions on the membership attributes to
+// assertions on the member column, the dn of a member is replaced by the rdn
+// value of the user.
+func (d *directory) convertGroupAssertion(filterType types.FilterType, attribute string, value string) *types.Filter {
+	name, ok := d.groupAttribute(attribute)
+	if !ok {
+		return &types.Filter{Type: types.FilterFalse}
+	}
+
+	switch name {
+	case "objectClass":
+		return objectClassAssertion(d.groupObjectClasses, filterType, value)
+	case memberAttribute, uniqueMemberAttribute:
+		if filterType == types.FilterEqual {
+			user, err := d.userFromDn(value)
+			if err != nil {
+				return &types.Filter{Type: types.FilterFalse}
+			}
+
+			value = user
+		} else if filterType != types.FilterPresent {
+			return &types.Filter{Type: types.FilterFalse}
+		}
+
+		return &types.Filter{Type: filterType, Attribute: memberAttribute, Value: value}
+	case memberUidAttribute:
+		return &types.Filter{Type: filterType, Attribute: memberAttribute, Value: value}
+	}
+
+	return &types.Filter{Type: filterType, Attribute: name, Value: value}
+}
+
+// searchGroups writes an entry for every group below the base in scope
+// matching the filter to the page.
+func (d *directory) searchGroups(ctx context.Context, w ldap.ResponseWriter, p *page, s searchScope, filter *types.Filter, selection message.AttributeSelection, rights *accessRights) error {
+	if s.entry != "" {
+		filter = &types.Filter{
+			Type: types.FilterAnd,
+			Children: []*types.Filter{
+				{Type: types.FilterEqual, Attribute: d.groupRdn, Value: s.entry},
+				filter,
+			},
+		}
+	} else if !s.children {
+		return nil
+	}
+
+	attributes, selected := d.filterGroupAttributes(selection, rights)
+	sortAttributes := p.sorting.missingAttributes(attributes, d.groupColumn)
+
+	return p.list(listing{
+		source: d.source("groups"),
+		list: func(options types.ListOptions, fn func(result *types.Result)) error {
+			return d.backend.ListGroups(ctx, filter, append(append([]string{}, attributes...), sortAttributes...), options, fn)
+		},
+		column: d.groupColumn,
+		values: func(result *types.Result, attribute string) []string {
+			if name, ok := d.groupAttribute(attribute); ok {
+				attribute = name
+			}
+
+			return d.groupEntryAttributes(result, map[string]bool{attribute: true})[attribute]
+		},
+		write: func(result *types.Result) {
+			w.Write(d.newGroupEntry(withoutAttributes(result, sortAttributes), selected))
+		},
+	})
+}
+
+// groupColumn returns the name under which an attribute of the columns of the
+// group query is served, ok is false if it is no such attribute.
+func (d *directory) groupColumn(attribute string) (name string, ok bool) {
+	return attributeName(append([]string{d.groupRdn}, d.groupAttributes...), attribute)
+}
+
+// groupAttribute returns the name under which an attribute of the group
+// entries is served, ok is false if it is no such attribute.
+func (d *directory) groupAttribute(attribute string) (name string, ok bool) {
+	return attributeName(append([]string{"objectClass", memberAttribute, uniqueMemberAttribute, memberUidAttribute, d.groupRdn}, d.groupAttributes...), attribute)
+}
+
+func (d *directory) isGroupAttribute(attribute string) bool {
+	_, ok := d.groupAttribute(attribute)
+	return ok
+}
+
+// filterGroupAttributes returns the columns to query and the attributes to
+// return for the selected attributes of a search, which are readable with the
+// access rights.
+func (d *directory) filterGroupAttributes(selection message.AttributeSelection, rights *accessRights) ([]string, map[string]bool) {
+	selected := map[string]bool{d.groupRdn: true}
+
+	all := append([]string{"objectClass", memberAttribute, uniqueMemberAttribute, memberUidAttribute}, d.groupAttributes...)
+	if len(selection) == 0 {
+		selection = message.AttributeSelection{"*"}
+	}
+
+	for _, attr := range selection {
+		if string(attr) == "*" {
+			for _, name := range all {
+				selected[name] = true
+			}
+		} else if name, ok := d.groupAttribute(string(attr)); ok {
+			selected[name] = true
+		}
+	}
+
+	for attr := range selected {
+		if !rights.canRead(attr) {
+			delete(selected, attr)
+		}
+	}
+
+	attributes := []string{d.groupRdn, memberAttribute}
+	for _, attr := range d.groupAttributes {
+		if selected[attr] && attr != d.groupRdn {
+			attributes = append(attributes, attr)
+		}
+	}
+
+	return attributes, selected
+}
+
+func (d *directory) newGroupEntry(result *types.Result, selected map[string]bool) message.SearchResultEntry {
+	entry := ldap.NewSearchResultEntry(entryDn(d.groupRdn, result.Rdn, d.groupBaseDn))
+
+	for key, values := range d.groupEntryAttributes(result, selected) {
+		addAttribute(&entry, key, values)
+	}
+
+	return entry
+}
+
+// groupEntryAttributes derives the selected attributes of a group entry from
+// the columns of the group query.
+func (d *directory) groupEntryAttributes(result *types.Result, selected map[string]bool) map[string][]string {
+	attributes := make(map[string][]string)
+
+	if selected["objectClass"] {
+		attributes["objectClass"] = d.groupObjectClasses
+	}
+
+	var members []string
+	for _, user := range result.Attributes[memberAttribute] {
+		members = append(members, d.userDn(user))
+	}
+
+	if selected[memberAttribute] {
+		attributes[memberAttribute] = members
+	}
+	if selected[uniqueMemberAttribute] {
+		attributes[uniqueMemberAttribute] = members
+	}
+	if selected[memberUidAttribute] {
+		attributes[memberUidAttribute] = result.Attributes[memberAttribute]
+	}
+
+	for key, values := range result.Attributes {
+		if key != memberAttribute {
+			attributes[key] = values
+		}
+	}
+
+	return attributes
+}
@@ -0,0 +1,48 @@
+package pkg
+
+import (
+	"context"
+	"time"
+
+	"github.com/vjeantet/goldap/message"
+)
+
+// WithSearchLimits restricts the number of entries and the duration of every
+// search, zero means unlimited. Clients may request lower limits.
+func WithSearchLimits(sizeLimit int, timeLimit time.Duration) FrontendOption {
+	return func(f *Frontend) {
+		f.sizeLimit = sizeLimit
+		f.timeLimit = timeLimit
+	}
+}
+
+// searchLimits returns the limits of the search, the lower of the requested
+// and the configured ones.
+func (f *Frontend) searchLimits(r message.SearchRequest) (sizeLimit int, timeLimit time.Duration) {
+	sizeLimit = lowerLimit(int(r.SizeLimit()), f.sizeLimit)
+	timeLimit = time.Duration(r.TimeLimit()) * time.Second
+	if f.timeLimit > 0 && (timeLimit <= 0 || f.timeLimit < timeLimit) {
+		timeLimit = f.timeLimit
+	}
+
+	return sizeLimit, timeLimit
+}
+
+// searchContext returns the context of a search, which cancels the queries of
+// the backend once the time limit is exceeded.
+func searchContext(timeLimit time.Duration) (context.Context, context.CancelFunc) {
+	if timeLimit > 0 {
+		return context.WithTimeout(context.Background(), timeLimit)
+	}
+
+	return context.WithCancel(context.Background())
+}
+
+// lowerLimit returns the lower of two limits, zero means unlimited.
+func lowerLimit(a int, b int) int {
+	if a <= 0 || (b > 0 && b < a) {
+		return b
+	}
+
+	return a
+}
@@ -0,0 +1,150 @@
+package pkg
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gopenguin/minimal-ldap-proxy/types"
+	"github.com/vjeantet/goldap/message"
+)
+
+// WithObjectClasses sets the object classes of the user entries, which are
+// added to every entry. By default the entries are only of the class top.
+func WithObjectClasses(objectClasses []string) TreeOption {
+	return func(d *directory) {
+		d.objectClasses = objectClasses
+	}
+}
+
+// WithGroupObjectClasses sets the object classes of the group entries, which
+// are added to every entry.
+func WithGroupObjectClasses(objectClasses []string) TreeOption {
+	return func(d *directory) {
+		d.groupObjectClasses = objectClasses
+	}
+}
+
+// defaultObjectClasses sets the object classes left unconfigured and adds the
+// superclasses of the configured ones. Groups are groupOfNames, which excludes
+// the structural groupOfUniqueNames, and posixGroups only if they have a
+// gidNumber.
+func (d *directory) defaultObjectClasses() {
+	if len(d.objectClasses) == 0 {
+		d.objectClasses = []string{"top"}
+	}
+
+	if d.groupBaseDn != "" && len(d.groupObjectClasses) == 0 {
+		d.groupObjectClasses = []string{"top", "groupOfNames"}
+		if _, ok := attributeName(d.groupAttributes, "gidNumber"); ok {
+			d.groupObjectClasses = append(d.groupObjectClasses, "posixGroup")
+		}
+	}
+
+	d.objectClasses = withSuperclasses(d.objectClasses)
+	d.groupObjectClasses = withSuperclasses(d.groupObjectClasses)
+}
+
+// CheckSchema verifies that the object classes of the entries are known and
+// that the attributes they require are served, as well as the dn and computed
+// attributes and that the trees don't overlap.
+func (f *Frontend) CheckSchema() error {
+	if err := f.checkTrees(); err != nil {
+		return err
+	}
+
+	for _, d := range f.directories {
+		users := append([]string{"objectClass", d.rDn}, d.attributes...)
+		if err := checkObjectClasses(d.objectClasses, users); err != nil {
+			return fmt.Errorf("users of %s: %v", d.baseDn, err)
+		}
+		if err := d.checkDnTemplates(); err != nil {
+			return fmt.Errorf("users of %s: %v", d.baseDn, err)
+		}
+		if err := d.checkComputedAttributes(); err != nil {
+			return fmt.Errorf("users of %s: %v", d.baseDn, err)
+		}
+
+		if d.groupBaseDn != "" {
+			groups := append([]string{"objectClass", d.groupRdn, memberAttribute, uniqueMemberAttribute, memberUidAttribute}, d.groupAttributes...)
+			if err := checkObjectClasses(d.groupObjectClasses, groups); err != nil {
+				return fmt.Errorf("groups of %s: %v", d.groupBaseDn, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkTrees verifies that no base dn of the users and groups of the naming
+// contexts is the same as or below another one, as the entries of overlapping
+// trees would be returned twice and binds would be routed to the first tree.
+func (f *Frontend) checkTrees() error {
+	var baseDns []string
+	for _, d := range f.directories {
+		baseDns = append(baseDns, d.baseDn)
+		if d.groupBaseDn != "" {
+			baseDns = append(baseDns, d.groupBaseDn)
+		}
+	}
+
+	for i, a := range baseDns {
+		for _, b := range baseDns[i+1:] {
+			if equalDn(a, b) || isAncestor(a, b) || isAncestor(b, a) {
+				return fmt.Errorf("the trees of %s and %s overlap", a, b)
+			}
+		}
+	}
+
+	return nil
+}
+
+func checkObjectClasses(objectClasses []string, served []string) error {
+	for _, objectClass := range objectClasses {
+		required, err := requiredAttributes(objectClass)
+		if err != nil {
+			return err
+		}
+
+		for _, attribute := range required {
+			if _, ok := attributeName(served, attribute); !ok {
+				return fmt.Errorf("object class '%s' requires the attribute '%s'", objectClass, attribute)
+			}
+		}
+	}
+
+	return nil
+}
+
+// objectClassAssertion evaluates an assertion on the objectClass, which is the
+// same for all entries of a tree, to a constant filter. Only equality and
+// presence assertions can match.
+func objectClassAssertion(objectClasses []string, filterType types.FilterType, value string) *types.Filter {
+	switch filterType {
+	case types.FilterPresent:
+		return &types.Filter{Type: types.FilterTrue}
+	case types.FilterEqual, types.FilterApprox:
+		for _, objectClass := range objectClasses {
+			if strings.EqualFold(objectClass, value) {
+				return &types.Filter{Type: types.FilterTrue}
+			}
+		}
+	}
+
+	return &types.Filter{Type: types.FilterFalse}
+}
+
+// selectsAttribute checks if the attribute is returned for the selection of a
+// search, which selects all user attributes if it is empty or contains "*".
+func selectsAttribute(selection message.AttributeSelection, attribute string) bool {
+	if len(selection) == 0 {
+		return true
+	}
+
+	for _, attr := range selection {
+		if string(attr) == "*" || strings.EqualFold(string(attr), attribute) {
+			return true
+		}
+	}
+
+	return false
+}
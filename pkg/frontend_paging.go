@@ -0,0 +1,283 @@
+package pkg
+
+import (
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/gopenguin/minimal-ldap-proxy/types"
+	"github.com/vjeantet/goldap/message"
+	ldap "github.com/vjeantet/ldapserver"
+)
+
+// pagedResultsControl is the simple paged results control (RFC 2696).
+const pagedResultsControl = "1.2.840.113556.1.4.319"
+
+type pagedResultsValue struct {
+	Size   int
+	Cookie []byte
+}
+
+// pagedSearch is the cursor of a paged search kept by the session.
+type pagedSearch struct {
+	cookie  string
+	request string
+	// offsets of the sources of entries, -1 if exhausted
+	offsets  map[string]int
+	returned int
+	// busy is set while a page runs
+	busy bool
+}
+
+// page limits the entries written by a search from several sources.
+type page struct {
+	// size is the number of entries left, negative if unlimited
+	size    int
+	paged   bool
+	cursor  *pagedSearch
+	more    bool
+	limited bool
+
+	sorting  *sorting
+	controls []control
+}
+
+type listing struct {
+	source string
+	list   func(options types.ListOptions, fn func(result *types.Result)) error
+	column func(attribute string) (name string, ok bool)
+	values func(result *types.Result, attribute string) []string
+	write  func(result *types.Result)
+}
+
+func (f *Frontend) newPage(m *ldap.Message, r message.SearchRequest) (*page, error) {
+	p := &page{size: -1, cursor: &pagedSearch{offsets: make(map[string]int)}}
+
+	c := requestControl(m, pagedResultsControl)
+	if c == nil {
+		return p, nil
+	}
+
+	var value pagedResultsValue
+	if c.ControlValue() == nil {
+		return nil, fmt.Errorf("paged results control without value")
+	}
+	if _, err := asn1.Unmarshal([]byte(*c.ControlValue()), &value); err != nil {
+		return nil, fmt.Errorf("invalid paged results control: %v", err)
+	}
+	if value.Size < 0 {
+		return nil, fmt.Errorf("invalid page size %d", value.Size)
+	}
+
+	p.size = value.Size
+	p.paged = true
+	var sortValue []byte
+	if c := requestControl(m, sortRequestControl); c != nil && c.ControlValue() != nil {
+		sortValue = []byte(*c.ControlValue())
+	}
+
+	s := f.session(m)
+	p.cursor.request = fmt.Sprintf("%q %s %d %s %v %x", s.BindDn(), r.BaseObject(), r.Scope(), r.FilterString(), r.Attributes(), sortValue)
+
+	if len(value.Cookie) > 0 {
+		cursor, err := s.pagedSearch(string(value.Cookie), p.cursor.request)
+		if err != nil {
+			return nil, err
+		}
+
+		p.cursor = cursor
+	}
+
+	return p, nil
+}
+
+// limit applies the size limit to all pages of a paged search.
+func (p *page) limit(sizeLimit int) {
+	if sizeLimit <= 0 {
+		return
+	}
+
+	left := sizeLimit - p.cursor.returned
+	if left < 0 {
+		left = 0
+	}
+
+	if p.size < 0 || left <= p.size {
+		p.size = left
+		p.limited = true
+	}
+}
+
+func (p *page) take(source string) bool {
+	if p.cursor.offsets[source] < 0 {
+		return false
+	}
+	if p.size == 0 {
+		p.more = true
+		return false
+	}
+
+	p.cursor.offsets[source] = -1
+	return true
+}
+
+func (p *page) write(w ldap.ResponseWriter, entry message.SearchResultEntry) {
+	w.Write(entry)
+	p.written()
+}
+
+func (p *page) written() {
+	p.cursor.returned++
+
+	if p.size > 0 {
+		p.size--
+	}
+}
+
+// list continues the listing after the previous pages, one entry more than
+// fitting on the page tells if it is exhausted.
+func (p *page) list(l listing) error {
+	offset := p.cursor.offsets[l.source]
+	if offset < 0 {
+		return nil
+	}
+	if p.size == 0 {
+		p.more = true
+		return nil
+	}
+
+	options := types.ListOptions{Offset: offset}
+	if p.size > 0 {
+		options.Limit = p.size + 1
+	}
+
+	list := l.list
+	if p.sorting != nil {
+		if keys, ok := p.sorting.backendKeys(l.column); ok {
+			options.Sort = keys
+		} else {
+			list = p.sorting.inMemory(l.list, l.values)
+		}
+	}
+
+	n := 0
+	err := list(options, func(result *types.Result) {
+		if p.size != 0 {
+			l.write(result)
+			p.written()
+			n++
+		} else {
+			p.more = true
+		}
+	})
+	if errors.Is(err, errSortLimitExceeded) {
+		p.sorting.fail(ldap.LDAPResultAdminLimitExceeded, "")
+		if sortControl, controlErr := p.sorting.control(); controlErr == nil {
+			p.controls = replaceControl(p.controls, sortControl)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if p.more {
+		p.cursor.offsets[l.source] = offset + n
+	} else {
+		p.cursor.offsets[l.source] = -1
+	}
+
+	return nil
+}
+
+func (p *page) done(w ldap.ResponseWriter, s *session) {
+	if p.more && p.limited {
+		p.fail(w, s, ldap.LDAPResultSizeLimitExceeded, "size limit exceeded")
+		return
+	}
+
+	p.finish(w, s, ldap.NewSearchResultDoneResponse(ldap.LDAPResultSuccess))
+}
+
+func (p *page) fail(w ldap.ResponseWriter, s *session, resultCode int, diagnosticMessage string) {
+	p.more = false
+	p.finish(w, s, newSearchResultDone(resultCode, diagnosticMessage))
+}
+
+// finish keeps the cursor of a paged search with entries left.
+func (p *page) finish(w ldap.ResponseWriter, s *session, res message.SearchResultDone) {
+	if !p.paged {
+		writeWithControls(w, res, p.controls...)
+		return
+	}
+
+	var cookie []byte
+	if p.more {
+		s.savePagedSearch(p.cursor)
+		cookie = []byte(p.cursor.cookie)
+	} else {
+		s.releasePagedSearch(p.cursor)
+	}
+
+	value, err := asn1.Marshal(pagedResultsValue{Cookie: cookie})
+	if err != nil {
+		w.Write(newSearchResultDone(ldap.LDAPResultOperationsError, err.Error()))
+		return
+	}
+
+	writeWithControls(w, res, append(p.controls, control{ControlType: []byte(pagedResultsControl), ControlValue: value})...)
+}
+
+// pagedSearch takes the cursor until the page is finished.
+func (s *session) pagedSearch(cookie string, request string) (*pagedSearch, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	cursor := s.pagedSearches[cookie]
+	if cursor == nil || cursor.request != request {
+		return nil, fmt.Errorf("unknown cookie of paged search")
+	}
+	if cursor.busy {
+		return nil, fmt.Errorf("paged search is already in progress")
+	}
+
+	cursor.busy = true
+	return cursor, nil
+}
+
+func (s *session) savePagedSearch(cursor *pagedSearch) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if cursor.cookie == "" {
+		s.lastCookie++
+		cursor.cookie = strconv.Itoa(s.lastCookie)
+	}
+	cursor.busy = false
+
+	if s.pagedSearches == nil {
+		s.pagedSearches = make(map[string]*pagedSearch)
+	}
+	s.pagedSearches[cursor.cookie] = cursor
+}
+
+func (s *session) releasePagedSearch(cursor *pagedSearch) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.pagedSearches, cursor.cookie)
+}
+
+func requestControl(m *ldap.Message, oid string) *message.Control {
+	if m.Controls() == nil {
+		return nil
+	}
+
+	for _, c := range *m.Controls() {
+		if c.ControlType().String() == oid {
+			return &c
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,127 @@
+package pkg
+
+import (
+	"encoding/asn1"
+
+	"github.com/gopenguin/minimal-ldap-proxy/pkg/password"
+	jww "github.com/spf13/jwalterweatherman"
+	ldap "github.com/vjeantet/ldapserver"
+)
+
+// WithPasswordModify enables the password modify extended operation, which
+// requires the backend to be able to update passwords. Users may change their
+// own password by providing the old one, the admins may change the password of
+// every user without.
+func WithPasswordModify(admins []string) FrontendOption {
+	return func(f *Frontend) {
+		f.passwordModify = true
+		f.passwordAdmins = admins
+	}
+}
+
+// passwordModifyRequest is the value of the password modify extended request
+// (RFC 3062, section 2).
+type passwordModifyRequest struct {
+	UserIdentity []byte `asn1:"tag:0,optional"`
+	OldPassword  []byte `asn1:"tag:1,optional"`
+	NewPassword  []byte `asn1:"tag:2,optional"`
+}
+
+func (f *Frontend) handlePasswordModify(w ldap.ResponseWriter, m *ldap.Message) {
+	res := ldap.NewExtendedResponse(ldap.LDAPResultSuccess)
+	defer func() { w.Write(res) }()
+
+	if !f.isConfidential(m) {
+		res.SetResultCode(ldap.LDAPResultConfidentialityRequired)
+		res.SetDiagnosticMessage("TLS is required, use StartTLS first")
+		return
+	}
+
+	session := f.session(m)
+	bindDn := session.BindDn()
+	if bindDn == "" {
+		res.SetResultCode(ldap.LDAPResultInsufficientAccessRights)
+		res.SetDiagnosticMessage("authentication required, bind first")
+		return
+	}
+
+	r := m.GetExtendedRequest()
+
+	var req passwordModifyRequest
+	if value := r.RequestValue(); value != nil {
+		if _, err := asn1.Unmarshal([]byte(*value), &req); err != nil {
+			res.SetResultCode(ldap.LDAPResultProtocolError)
+			res.SetDiagnosticMessage("invalid password modify request")
+			return
+		}
+	}
+
+	dn := bindDn
+	if len(req.UserIdentity) > 0 {
+		dn = string(req.UserIdentity)
+	}
+
+	d, user, err := f.userDirectory(dn)
+	if err != nil {
+		res.SetResultCode(ldap.LDAPResultUnwillingToPerform)
+		res.SetDiagnosticMessage("only passwords of users can be changed")
+		return
+	}
+
+	// generating passwords is not supported
+	if len(req.NewPassword) == 0 {
+		res.SetResultCode(ldap.LDAPResultUnwillingToPerform)
+		res.SetDiagnosticMessage("a new password is required")
+		return
+	}
+
+	jww.INFO.Printf("Changing password of %s as %s", user, bindDn)
+
+	if !f.isPasswordAdmin(bindDn) {
+		if !equalDn(dn, bindDn) {
+			res.SetResultCode(ldap.LDAPResultInsufficientAccessRights)
+			res.SetDiagnosticMessage("insufficient access rights to change the password of other users")
+			return
+		}
+
+		authenticated := false
+		if len(req.OldPassword) > 0 {
+			authenticated, _ = f.authenticate(m, d, dn, user, string(req.OldPassword))
+		}
+
+		if !authenticated {
+			res.SetResultCode(ldap.LDAPResultInvalidCredentials)
+			res.SetDiagnosticMessage("the old password is wrong")
+			return
+		}
+	}
+
+	hash, err := password.Hash(string(req.NewPassword))
+	if err != nil {
+		jww.ERROR.Printf("hash password: %v", err)
+		res.SetResultCode(ldap.LDAPResultOther)
+		return
+	}
+
+	if err := d.backend.UpdatePassword(user, hash); err != nil {
+		jww.WARN.Printf("update password: %v", err)
+		res.SetResultCode(ldap.LDAPResultOperationsError)
+		res.SetDiagnosticMessage(err.Error())
+		return
+	}
+
+	// a reset password has been changed by its user
+	if equalDn(dn, bindDn) {
+		session.requirePasswordChange(false)
+	}
+}
+
+func (f *Frontend) isPasswordAdmin(dn string) bool {
+	for _, admin := range f.passwordAdmins {
+		if equalDn(admin, dn) {
+			return true
+		}
+	}
+
+	return false
+}
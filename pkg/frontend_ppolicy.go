@@ -0,0 +1,107 @@
+package pkg
+
+import (
+	"encoding/asn1"
+	"fmt"
+
+	"github.com/gopenguin/minimal-ldap-proxy/types"
+)
+
+// passwordPolicyControl is the oid of the password policy request and response
+// controls (draft-behera-ldap-password-policy, section 6).
+const passwordPolicyControl = "1.3.6.1.4.1.42.2.27.8.5.1"
+
+// The warnings and errors of the password policy response control.
+const (
+	ppolicyNone = -1
+
+	ppolicyTimeBeforeExpiration = 0
+	ppolicyGraceAuthNsRemaining = 1
+
+	ppolicyPasswordExpired  = 0
+	ppolicyAccountLocked    = 1
+	ppolicyChangeAfterReset = 2
+)
+
+// passwordChangeRequired is the diagnostic message of the operations refused
+// until a user changes the password after a reset.
+const passwordChangeRequired = "the password must be changed first"
+
+// passwordPolicyValue is the value of the password policy response control,
+// the warning is a choice of the time before expiration and the remaining
+// grace logins.
+type passwordPolicyValue struct {
+	Warning asn1.RawValue `asn1:"optional"`
+	Error   asn1.RawValue `asn1:"optional"`
+}
+
+// passwordPolicyResult is the outcome of a bind according to the state of the
+// password of the user.
+type passwordPolicyResult struct {
+	// allowed is set if the bind may succeed
+	allowed bool
+
+	warning      int
+	warningValue int
+	error        int
+}
+
+// checkPasswordPolicy decides if a user may bind with the state of the
+// password. The state is only reported if the password is right, so it doesn't
+// tell which accounts exist or are locked.
+func checkPasswordPolicy(authenticated bool, policy types.PasswordPolicy) passwordPolicyResult {
+	result := passwordPolicyResult{allowed: authenticated, warning: ppolicyNone, error: ppolicyNone}
+
+	switch {
+	case policy.LockedOut:
+		result.allowed = false
+		result.error = ppolicyAccountLocked
+	case !authenticated:
+	case policy.Locked:
+		result.allowed = false
+		result.error = ppolicyAccountLocked
+	case policy.Expired && policy.GraceLogins > 0:
+		result.warning = ppolicyGraceAuthNsRemaining
+		result.warningValue = policy.GraceLogins
+	case policy.Expired:
+		result.allowed = false
+		result.error = ppolicyPasswordExpired
+	case policy.ExpiresIn > 0:
+		result.warning = ppolicyTimeBeforeExpiration
+		result.warningValue = policy.ExpiresIn
+	}
+
+	if result.allowed && policy.MustChange {
+		result.error = ppolicyChangeAfterReset
+	}
+
+	return result
+}
+
+// control returns the password policy response control, which carries neither
+// warning nor error if there is nothing to report.
+func (r passwordPolicyResult) control() (control, error) {
+	var value passwordPolicyValue
+
+	if r.warning != ppolicyNone {
+		choice, err := asn1.MarshalWithParams(r.warningValue, fmt.Sprintf("tag:%d", r.warning))
+		if err != nil {
+			return control{}, err
+		}
+		value.Warning = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: choice}
+	}
+	if r.error != ppolicyNone {
+		data, err := asn1.MarshalWithParams(asn1.Enumerated(r.error), "tag:1")
+		if err != nil {
+			return control{}, err
+		}
+		value.Error.FullBytes = data
+	}
+
+	data, err := asn1.Marshal(value)
+	if err != nil {
+		return control{}, err
+	}
+
+	return control{ControlType: []byte(passwordPolicyControl), ControlValue: data}, nil
+}
@@ -0,0 +1,179 @@
+package pkg
+
+import (
+	"strings"
+
+	"github.com/gopenguin/minimal-ldap-proxy/types"
+	jww "github.com/spf13/jwalterweatherman"
+	"github.com/vjeantet/goldap/message"
+	ldap "github.com/vjeantet/ldapserver"
+)
+
+// Version is announced as vendorVersion of the root DSE, it can be set at
+// build time using -ldflags "-X github.com/gopenguin/minimal-ldap-proxy/pkg.Version=...".
+var Version = "dev"
+
+const subschemaDn = "cn=Subschema"
+
+// handleSearchRootDse answers searches for the root DSE (RFC 4512, section 5.1)
+// and the subschema subentry, which are both single entries without children.
+func (f *Frontend) handleSearchRootDse(w ldap.ResponseWriter, m *ldap.Message, attributes map[string][]string) {
+	r := m.GetSearchRequest()
+
+	jww.INFO.Printf("Searching on special entry '%s' for %s", r.BaseObject(), r.FilterString())
+
+	if !f.bindPolicy.AnonymousRootDse && f.session(m).BindDn() == "" {
+		w.Write(newSearchResultDone(ldap.LDAPResultInsufficientAccessRights, "authentication required, bind first"))
+		return
+	}
+
+	filter, err := convertFilter(r.Filter(), entryAssertion(attributes))
+	if err != nil {
+		jww.WARN.Printf("convert filter: %v", err)
+		w.Write(newSearchResultDone(ldap.LDAPResultUnwillingToPerform, err.Error()))
+		return
+	}
+
+	if int(r.Scope()) != ldap.SearchRequestSingleLevel && matchFilter(filter, attributes) {
+		entry := ldap.NewSearchResultEntry(string(r.BaseObject()))
+
+		for key, values := range selectAttributes(attributes, r.Attributes()) {
+			addAttribute(&entry, key, values)
+		}
+
+		w.Write(entry)
+	}
+
+	w.Write(ldap.NewSearchResultDoneResponse(ldap.LDAPResultSuccess))
+}
+
+// rootDseAttributes describes the server. Attributes without values, e.g.
+// supportedSASLMechanisms as long as no mechanism is supported, are omitted.
+func (f *Frontend) rootDseAttributes() map[string][]string {
+	attributes := map[string][]string{
+		"objectClass":             {"top"},
+		"namingContexts":          f.namingContexts(),
+		"supportedLDAPVersion":    {"3"},
+		"supportedControl":        f.supportedControls,
+		"supportedExtension":      f.supportedExtensions,
+		"supportedSASLMechanisms": nil,
+		"subschemaSubentry":       {subschemaDn},
+		"vendorName":              {"gopenguin"},
+		"vendorVersion":           {"minimal-ldap-proxy " + Version},
+	}
+
+	for key, values := range attributes {
+		if len(values) == 0 {
+			delete(attributes, key)
+		}
+	}
+
+	return attributes
+}
+
+func (f *Frontend) namingContexts() []string {
+	var namingContexts []string
+	for _, d := range f.directories {
+		namingContexts = append(namingContexts, d.baseDn)
+		if d.groupBaseDn != "" {
+			namingContexts = append(namingContexts, d.groupBaseDn)
+		}
+	}
+
+	return namingContexts
+}
+
+// subschemaAttributes describes the attributes and object classes of the
+// served entries.
+func (f *Frontend) subschemaAttributes() map[string][]string {
+	definitions := []string{attributeTypeDefinition("objectClass")}
+	var objectClasses []string
+
+	for _, d := range f.directories {
+		names := append([]string{d.rDn}, d.attributes...)
+		for _, c := range d.computedAttributes {
+			names = append(names, c.name)
+		}
+		objectClasses = append(objectClasses, d.objectClasses...)
+
+		if d.groupBaseDn != "" {
+			names = append(names, d.groupRdn, memberAttribute, uniqueMemberAttribute, memberUidAttribute)
+			names = append(names, d.groupAttributes...)
+			objectClasses = append(objectClasses, d.groupObjectClasses...)
+		}
+
+		for _, name := range names {
+			definitions = append(definitions, d.attributeTypeDefinition(name))
+		}
+	}
+
+	// the attributes the object classes may contain are described as well
+	for _, objectClass := range objectClasses {
+		definition := objectClassDefinitions[strings.ToLower(objectClass)]
+		for _, name := range append(definitionList(definition, "MUST"), definitionList(definition, "MAY")...) {
+			definitions = append(definitions, attributeTypeDefinition(name))
+		}
+	}
+
+	var attributeTypes []string
+	seen := make(map[string]bool)
+	for _, definition := range definitions {
+		if !seen[definition] {
+			seen[definition] = true
+			attributeTypes = append(attributeTypes, definition)
+		}
+	}
+
+	var objectClassesDefinitions []string
+	for _, objectClass := range objectClasses {
+		definition := objectClassDefinitions[strings.ToLower(objectClass)]
+		if definition != "" && !seen[definition] {
+			seen[definition] = true
+			objectClassesDefinitions = append(objectClassesDefinitions, definition)
+		}
+	}
+
+	return map[string][]string{
+		"objectClass":    {"top", "subschema"},
+		"cn":             {"Subschema"},
+		"attributeTypes": attributeTypes,
+		"objectClasses":  objectClassesDefinitions,
+	}
+}
+
+// entryAssertion passes assertions on the attributes of an entry to the in
+// memory filter evaluation.
+func entryAssertion(attributes map[string][]string) assertionConverter {
+	return func(filterType types.FilterType, attribute string, value string) *types.Filter {
+		for key := range attributes {
+			if strings.EqualFold(key, attribute) {
+				return &types.Filter{Type: filterType, Attribute: key, Value: value}
+			}
+		}
+
+		return &types.Filter{Type: types.FilterFalse}
+	}
+}
+
+// selectAttributes returns the selected attributes of an entry, all attributes
+// are returned if nothing, "*" or "+" is selected.
+func selectAttributes(attributes map[string][]string, selection message.AttributeSelection) map[string][]string {
+	if len(selection) == 0 {
+		return attributes
+	}
+
+	selected := make(map[string][]string)
+	for _, attr := range selection {
+		if attr == "*" || attr == "+" {
+			return attributes
+		}
+
+		for key, values := range attributes {
+			if strings.EqualFold(key, string(attr)) {
+				selected[key] = values
+			}
+		}
+	}
+
+	return selected
+}
@@ -0,0 +1,433 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gopenguin/minimal-ldap-proxy/types"
+	jww "github.com/spf13/jwalterweatherman"
+	"github.com/vjeantet/goldap/message"
+	ldap "github.com/vjeantet/ldapserver"
+)
+
+// searchScope describes which entries of a tree are in the scope of a search.
+type searchScope struct {
+	// base is set if the base entry of the tree is in scope
+	base bool
+	// children is set if all entries below the base entry are in scope
+	children bool
+	// entry is the rdn value of the single entry in scope
+	entry string
+}
+
+// scopeOf determines the entries of the tree below baseDn which are in the
+// scope of a search, ok is false if the search does not cover the tree.
+func scopeOf(searchBase string, scope int, baseDn string, rdn string) (s searchScope, ok bool) {
+	switch {
+	case equalDn(searchBase, baseDn):
+		s.base = scope != ldap.SearchRequestSingleLevel
+		s.children = scope != ldap.SearchRequestScopeBaseObject
+	case isAncestor(searchBase, baseDn):
+		if scope == ldap.SearchRequestScopeBaseObject {
+			return s, false
+		}
+
+		s.base = scope == ldap.SearchRequestHomeSubtree || isParent(searchBase, baseDn)
+		s.children = scope == ldap.SearchRequestHomeSubtree
+	default:
+		value, err := valueFromDn(searchBase, rdn, baseDn)
+		if err != nil {
+			return s, false
+		}
+
+		// an entry has no children, so only the entry itself can match
+		if scope != ldap.SearchRequestSingleLevel {
+			s.entry = value
+		}
+	}
+
+	return s, true
+}
+
+// handleSearch searches the users and groups trees covered by the base object
+// of the search.
+func (f *Frontend) handleSearch(w ldap.ResponseWriter, m *ldap.Message) {
+	r := m.GetSearchRequest()
+	base := string(r.BaseObject())
+	scope := int(r.Scope())
+
+	if !f.tarpit(m, "search", "") {
+		w.Write(newSearchResultDone(ldap.LDAPResultBusy, rateLimitExceeded))
+		return
+	}
+
+	switch {
+	case base == "" && scope == ldap.SearchRequestScopeBaseObject:
+		f.handleSearchRootDse(w, m, f.rootDseAttributes())
+		return
+	case equalDn(base, subschemaDn):
+		f.handleSearchRootDse(w, m, f.subschemaAttributes())
+		return
+	}
+
+	if _, err := parseDn(base); err != nil {
+		w.Write(newSearchResultDone(ldap.LDAPResultInvalidDNSyntax, err.Error()))
+		return
+	}
+
+	if !f.isConfidential(m) {
+		w.Write(newSearchResultDone(ldap.LDAPResultConfidentialityRequired, "TLS is required, use StartTLS first"))
+		return
+	}
+
+	session := f.session(m)
+	bindDn := session.BindDn()
+	if bindDn == "" {
+		w.Write(newSearchResultDone(ldap.LDAPResultInsufficientAccessRights, "authentication required, bind first"))
+		return
+	}
+	if session.MustChangePassword() {
+		w.Write(newSearchResultDone(ldap.LDAPResultInsufficientAccessRights, passwordChangeRequired))
+		return
+	}
+
+	jww.INFO.Printf("Searching on %s (scope %d) for %s as %s", base, scope, r.FilterString(), bindDn)
+
+	var trees []*searchedTree
+	covered := false
+	for _, d := range f.directories {
+		t := &searchedTree{directory: d}
+		t.userScope, t.users = scopeOf(base, scope, d.baseDn, d.rDn)
+		if d.groupBaseDn != "" {
+			t.groupScope, t.groups = scopeOf(base, scope, d.groupBaseDn, d.groupRdn)
+		}
+
+		if !t.users && !t.groups {
+			continue
+		}
+		covered = true
+
+		var userAccess, groupAccess bool
+		t.userRights, userAccess = f.accessRights(bindDn, d.baseDn, d.rDn)
+		t.groupRights, groupAccess = f.accessRights(bindDn, d.groupBaseDn, d.groupRdn)
+
+		t.users = t.users && userAccess
+		t.groups = t.groups && groupAccess
+
+		if t.users || t.groups {
+			trees = append(trees, t)
+		}
+	}
+
+	if !covered {
+		f.handleSearchGeneric(w, m)
+		return
+	}
+
+	if len(trees) == 0 {
+		jww.WARN.Printf("%s is not allowed to search %s", bindDn, base)
+		w.Write(newSearchResultDone(ldap.LDAPResultInsufficientAccessRights, fmt.Sprintf("insufficient access rights to search '%s'", base)))
+		return
+	}
+
+	sorting, err := newSorting(m)
+	if err != nil {
+		jww.WARN.Printf("sorted search: %v", err)
+		w.Write(newSearchResultDone(ldap.LDAPResultProtocolError, err.Error()))
+		return
+	}
+
+	var controls []control
+	if sorting != nil {
+		sorting.limit = f.sortLimit
+		if sorting.limit <= 0 {
+			sorting.limit = defaultSortLimit
+		}
+
+		checkSortKeys(sorting, trees)
+		sortControl, err := sorting.control()
+		if err != nil {
+			w.Write(newSearchResultDone(ldap.LDAPResultOperationsError, err.Error()))
+			return
+		}
+		controls = append(controls, sortControl)
+
+		if sorting.resultCode != ldap.LDAPResultSuccess {
+			if sorting.critical {
+				writeWithControls(w, newSearchResultDone(ldap.LDAPResultUnavailableCriticalExtension, "unable to sort the entries"), controls...)
+				return
+			}
+
+			// the entries are returned unsorted
+			sorting = nil
+		}
+	}
+
+	// the cursor of a paged search is taken until the page is finished
+	p, err := f.newPage(m, r)
+	if err != nil {
+		jww.WARN.Printf("paged search: %v", err)
+		w.Write(newSearchResultDone(ldap.LDAPResultUnwillingToPerform, err.Error()))
+		return
+	}
+	p.sorting = sorting
+	p.controls = controls
+
+	// a page size of zero abandons a paged search
+	if p.paged && p.size == 0 {
+		p.done(w, session)
+		return
+	}
+
+	sizeLimit, timeLimit := f.searchLimits(r)
+	p.limit(sizeLimit)
+
+	ctx, cancel := searchContext(timeLimit)
+	defer cancel()
+
+	for _, t := range trees {
+		d := t.directory
+
+		if t.users {
+			filter, err := convertFilter(r.Filter(), t.userRights.restrict(d.restrictComputed(t.userRights, d.convertUserAssertion)))
+			if err != nil {
+				jww.WARN.Printf("convert filter: %v", err)
+				p.fail(w, session, ldap.LDAPResultUnwillingToPerform, err.Error())
+				return
+			}
+
+			if err := searchBase(w, p, t.userScope, d.source("userBase"), d.baseDn, r); err != nil {
+				jww.WARN.Printf("convert filter: %v", err)
+				p.fail(w, session, ldap.LDAPResultUnwillingToPerform, err.Error())
+				return
+			}
+
+			computed, filter, attributes := d.newComputedSearch(filter, r.Attributes(), t.userRights, t.userRights.filter(d.filterAttributes(r.Attributes())))
+			err = d.searchUsers(ctx, w, p, t.userScope, filter, computed, attributes, selectsAttribute(r.Attributes(), "objectClass"))
+			if ctx.Err() != nil {
+				jww.WARN.Printf("search users: time limit of %v exceeded", timeLimit)
+				p.fail(w, session, ldap.LDAPResultTimeLimitExceeded, "time limit exceeded")
+				return
+			}
+			if err != nil {
+				jww.WARN.Printf("search users: %v", err)
+				p.fail(w, session, searchResultCode(err), err.Error())
+				return
+			}
+		}
+
+		if t.groups {
+			filter, err := convertFilter(r.Filter(), t.groupRights.restrict(d.convertGroupAssertion))
+			if err != nil {
+				jww.WARN.Printf("convert filter: %v", err)
+				p.fail(w, session, ldap.LDAPResultUnwillingToPerform, err.Error())
+				return
+			}
+
+			if err := searchBase(w, p, t.groupScope, d.source("groupBase"), d.groupBaseDn, r); err != nil {
+				jww.WARN.Printf("convert filter: %v", err)
+				p.fail(w, session, ldap.LDAPResultUnwillingToPerform, err.Error())
+				return
+			}
+
+			err = d.searchGroups(ctx, w, p, t.groupScope, filter, r.Attributes(), t.groupRights)
+			if ctx.Err() != nil {
+				jww.WARN.Printf("search groups: time limit of %v exceeded", timeLimit)
+				p.fail(w, session, ldap.LDAPResultTimeLimitExceeded, "time limit exceeded")
+				return
+			}
+			if err != nil {
+				jww.WARN.Printf("search groups: %v", err)
+				p.fail(w, session, searchResultCode(err), err.Error())
+				return
+			}
+		}
+	}
+
+	p.done(w, session)
+}
+
+// searchResultCode returns the result code of a search failing with the error.
+func searchResultCode(err error) int {
+	if errors.Is(err, errSortLimitExceeded) {
+		return ldap.LDAPResultUnwillingToPerform
+	}
+
+	return ldap.LDAPResultOperationsError
+}
+
+// searchedTree holds the scopes of the trees of a directory covered by a
+// search and the access rights of the bound account to them.
+type searchedTree struct {
+	directory *directory
+
+	users      bool
+	userScope  searchScope
+	userRights *accessRights
+
+	groups      bool
+	groupScope  searchScope
+	groupRights *accessRights
+}
+
+// checkSortKeys verifies that the sort keys are attributes of the searched
+// trees, which are readable with the access rights.
+func checkSortKeys(s *sorting, trees []*searchedTree) {
+	for _, key := range s.keys {
+		found := false
+		readable := true
+
+		for _, t := range trees {
+			userAttribute := t.users && t.directory.isAttribute(key.attribute)
+			groupAttribute := t.groups && t.directory.isGroupAttribute(key.attribute)
+
+			found = found || userAttribute || groupAttribute
+			if userAttribute && !t.userRights.canRead(key.attribute) || groupAttribute && !t.groupRights.canRead(key.attribute) {
+				readable = false
+			}
+		}
+
+		switch {
+		case !found:
+			s.fail(ldap.LDAPResultNoSuchAttribute, key.attribute)
+		case !readable:
+			s.fail(ldap.LDAPResultInsufficientAccessRights, key.attribute)
+		}
+	}
+}
+
+func (f *Frontend) handleSearchGeneric(w ldap.ResponseWriter, m *ldap.Message) {
+	r := m.GetSearchRequest()
+
+	jww.INFO.Printf("Unhandled search request: %s", r.BaseObject())
+
+	res := ldap.NewSearchResultDoneResponse(ldap.LDAPResultNoSuchObject)
+	w.Write(res)
+}
+
+// searchUsers writes an entry for every user below the base in scope matching
+// the filter and the assertions on computed attributes to the page. Filters
+// selecting a single user are answered by the search query, everything else
+// requires the backend to list the users. The objectClass is added to the entries if it is selected.
+func (d *directory) searchUsers(ctx context.Context, w ldap.ResponseWriter, p *page, s searchScope, filter *types.Filter, computed *computedSearch, attributes []string, objectClass bool) error {
+	user := s.entry
+	if s.children {
+		var err error
+		user, err = d.userFromFilter(filter)
+		if err != nil {
+			sortAttributes := p.sorting.missingAttributes(attributes, d.userAttribute)
+
+			return p.list(listing{
+				source: d.source("users"),
+				list: computed.inMemory(ctx, func(ctx context.Context, options types.ListOptions, fn func(result *types.Result)) error {
+					return d.backend.List(ctx, filter, append(append([]string{}, attributes...), sortAttributes...), options, fn)
+				}),
+				column: d.userAttribute,
+				values: func(result *types.Result, attribute string) []string {
+					name, _ := d.userAttribute(attribute)
+					return result.Attributes[name]
+				},
+				write: func(result *types.Result) {
+					w.Write(d.newUserEntry(computed.entry(withoutAttributes(result, sortAttributes)), objectClass))
+				},
+			})
+		}
+	}
+
+	if user != "" && p.take(d.source("user")) {
+		if result := d.backend.Search(ctx, user, filter, attributes); result != nil && computed.match(result) {
+			p.write(w, d.newUserEntry(computed.entry(result), objectClass))
+		}
+	}
+
+	return nil
+}
+
+func (d *directory) newUserEntry(result *types.Result, objectClass bool) message.SearchResultEntry {
+	entry := ldap.NewSearchResultEntry(d.userDn(result.Rdn))
+
+	if objectClass {
+		addAttribute(&entry, "objectClass", d.objectClasses)
+	}
+
+	for key, value := range result.Attributes {
+		addAttribute(&entry, key, d.dnValues(key, value))
+	}
+
+	return entry
+}
+
+// addAttribute adds the values of the attribute to the entry, under the name
+// with the ';binary' option if the syntax of the attribute requires it.
+func addAttribute(entry *message.SearchResultEntry, name string, values []string) {
+	name = binaryTransferName(name)
+
+	var attributeValues []message.AttributeValue
+	for _, v := range values {
+		attributeValues = append(attributeValues, message.AttributeValue(v))
+	}
+
+	entry.AddAttribute(message.AttributeDescription(name), attributeValues...)
+}
+
+// searchBase writes the base entry of a tree in scope to the page if it matches
+// the filter, which is evaluated on the attributes of the base entry.
+func searchBase(w ldap.ResponseWriter, p *page, s searchScope, source string, baseDn string, r message.SearchRequest) error {
+	if !s.base || !p.take(source) {
+		return nil
+	}
+
+	attributes := baseAttributes(baseDn)
+	filter, err := convertFilter(r.Filter(), entryAssertion(attributes))
+	if err != nil {
+		return err
+	}
+
+	if matchFilter(filter, attributes) {
+		p.write(w, newBaseEntry(baseDn, selectAttributes(attributes, r.Attributes())))
+	}
+
+	return nil
+}
+
+func newBaseEntry(baseDn string, attributes map[string][]string) message.SearchResultEntry {
+	entry := ldap.NewSearchResultEntry(baseDn)
+
+	for key, value := range attributes {
+		addAttribute(&entry, key, value)
+	}
+
+	return entry
+}
+
+// baseObjectClasses are the structural object classes of base entries by the
+// attribute of their rdn.
+var baseObjectClasses = map[string]string{
+	"ou": "organizationalUnit",
+	"o":  "organization",
+	"dc": "domain",
+	"c":  "country",
+	"l":  "locality",
+}
+
+// baseAttributes returns the attributes of a base dn entry, which are derived
+// from its rdn.
+func baseAttributes(baseDn string) map[string][]string {
+	dn, err := parseDn(baseDn)
+	if err != nil || len(dn) == 0 {
+		return nil
+	}
+
+	attributes := map[string][]string{"objectClass": {"top"}}
+	for _, ava := range dn[0] {
+		attributes[ava.attribute] = append(attributes[ava.attribute], ava.value)
+
+		if objectClass, ok := baseObjectClasses[strings.ToLower(ava.attribute)]; ok {
+			attributes["objectClass"] = append(attributes["objectClass"], objectClass)
+		}
+	}
+
+	return attributes
+}
@@ -0,0 +1,267 @@
+package pkg
+
+import (
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gopenguin/minimal-ldap-proxy/types"
+	ldap "github.com/vjeantet/ldapserver"
+)
+
+// The server side sort controls (RFC 2891).
+const (
+	sortRequestControl  = "1.2.840.113556.1.4.473"
+	sortResponseControl = "1.2.840.113556.1.4.474"
+)
+
+// defaultSortLimit is the maximum number of entries sorted in memory if none
+// is configured.
+const defaultSortLimit = 10000
+
+// errSortLimitExceeded is returned by listings too large to sort in memory.
+var errSortLimitExceeded = errors.New("too many entries to sort")
+
+// WithSortLimit restricts the number of entries sorted in memory, searches
+// with more entries are refused.
+func WithSortLimit(limit int) FrontendOption {
+	return func(f *Frontend) {
+		f.sortLimit = limit
+	}
+}
+
+// sortKeyValue is a key of the sort request control value, which is a
+// sequence of them.
+type sortKeyValue struct {
+	AttributeType []byte
+	OrderingRule  []byte `asn1:"optional,tag:0"`
+	ReverseOrder  bool   `asn1:"optional,tag:1"`
+}
+
+// sortResultValue is the value of the sort response control.
+type sortResultValue struct {
+	SortResult    asn1.Enumerated
+	AttributeType []byte `asn1:"optional,tag:0"`
+}
+
+// sorting is the server side sort requested by a search. Listings are sorted
+// by the backend if it can sort by all keys, otherwise they are sorted in
+// memory.
+type sorting struct {
+	keys     []sortKey
+	critical bool
+	// limit is the maximum number of entries sorted in memory
+	limit int
+
+	// resultCode and attribute tell why the entries can not be sorted
+	resultCode int
+	attribute  string
+}
+
+type sortKey struct {
+	attribute string
+	// rule is the requested ordering rule, empty for the one of the attribute
+	rule    string
+	reverse bool
+}
+
+// newSorting returns the sorting requested by the sort request control of the
+// search, nil if it has none.
+func newSorting(m *ldap.Message) (*sorting, error) {
+	c := requestControl(m, sortRequestControl)
+	if c == nil {
+		return nil, nil
+	}
+
+	if c.ControlValue() == nil {
+		return nil, fmt.Errorf("sort request control without value")
+	}
+
+	var values []sortKeyValue
+	if _, err := asn1.Unmarshal([]byte(*c.ControlValue()), &values); err != nil {
+		return nil, fmt.Errorf("invalid sort request control: %v", err)
+	}
+	if len(values) == 0 {
+		return nil, fmt.Errorf("sort request control without keys")
+	}
+
+	s := &sorting{critical: bool(c.Criticality()), resultCode: ldap.LDAPResultSuccess}
+	for _, value := range values {
+		key := sortKey{attribute: string(value.AttributeType), reverse: value.ReverseOrder}
+
+		if len(value.OrderingRule) > 0 {
+			rule, ok := orderingRules[strings.ToLower(string(value.OrderingRule))]
+			if !ok {
+				s.fail(ldap.LDAPResultInappropriateMatching, key.attribute)
+			}
+
+			key.rule = rule
+		}
+
+		s.keys = append(s.keys, key)
+	}
+
+	return s, nil
+}
+
+// fail records why the entries can not be sorted, only the first reason is
+// reported.
+func (s *sorting) fail(resultCode int, attribute string) {
+	if s.resultCode == ldap.LDAPResultSuccess {
+		s.resultCode = resultCode
+		s.attribute = attribute
+	}
+}
+
+// control returns the sort response control.
+func (s *sorting) control() (control, error) {
+	value := sortResultValue{SortResult: asn1.Enumerated(s.resultCode)}
+	if s.attribute != "" {
+		value.AttributeType = []byte(s.attribute)
+	}
+
+	data, err := asn1.Marshal(value)
+	if err != nil {
+		return control{}, err
+	}
+
+	return control{ControlType: []byte(sortResponseControl), ControlValue: data}, nil
+}
+
+// backendKeys returns the keys for the backend, ok is false if one of them
+// is no column or has an ordering rule the backend does not know about.
+func (s *sorting) backendKeys(column func(attribute string) (string, bool)) (keys []types.SortKey, ok bool) {
+	for _, key := range s.keys {
+		name, isColumn := column(key.attribute)
+		if key.rule != "" || !isColumn {
+			return nil, false
+		}
+
+		keys = append(keys, types.SortKey{Attribute: name, Reverse: key.reverse})
+	}
+
+	return keys, true
+}
+
+// inMemory wraps a listing to sort all of its entries in memory before the
+// range of the options is selected. Listings with more entries than the limit
+// fail with errSortLimitExceeded.
+func (s *sorting) inMemory(list func(options types.ListOptions, fn func(result *types.Result)) error, values func(result *types.Result, attribute string) []string) func(options types.ListOptions, fn func(result *types.Result)) error {
+	return func(options types.ListOptions, fn func(result *types.Result)) error {
+		var results []*types.Result
+		err := list(types.ListOptions{Limit: s.limit + 1}, func(result *types.Result) {
+			results = append(results, result)
+		})
+		if err != nil {
+			return err
+		}
+		if len(results) > s.limit {
+			return errSortLimitExceeded
+		}
+
+		sort.SliceStable(results, func(i, j int) bool {
+			return s.less(results[i], results[j], values)
+		})
+
+		for i := options.Offset; i < len(results) && (options.Limit <= 0 || i < options.Offset+options.Limit); i++ {
+			fn(results[i])
+		}
+
+		return nil
+	}
+}
+
+func (s *sorting) less(a *types.Result, b *types.Result, values func(result *types.Result, attribute string) []string) bool {
+	for _, key := range s.keys {
+		rule := key.rule
+		if rule == "" {
+			rule = orderingRule(key.attribute)
+		}
+
+		x, okX := key.value(rule, values(a, key.attribute))
+		y, okY := key.value(rule, values(b, key.attribute))
+
+		// entries without value are ordered as if they had the largest value
+		var c int
+		switch {
+		case !okX && !okY:
+			continue
+		case !okX:
+			c = 1
+		case !okY:
+			c = -1
+		default:
+			c = orderingCompare(rule, x, y)
+		}
+
+		if key.reverse {
+			c = -c
+		}
+		if c != 0 {
+			return c < 0
+		}
+	}
+
+	return false
+}
+
+// value returns the value an entry is sorted by, the smallest one or the
+// largest if the order is reversed.
+func (k sortKey) value(rule string, values []string) (value string, ok bool) {
+	for _, v := range values {
+		c := orderingCompare(rule, v, value)
+		if !ok || (c < 0 && !k.reverse) || (c > 0 && k.reverse) {
+			value = v
+			ok = true
+		}
+	}
+
+	return value, ok
+}
+
+// missingAttributes returns the columns of the sort keys which are not
+// selected, but must be listed to sort the entries.
+func (s *sorting) missingAttributes(selected []string, column func(attribute string) (string, bool)) []string {
+	if s == nil {
+		return nil
+	}
+
+	var missing []string
+	for _, key := range s.keys {
+		name, ok := column(key.attribute)
+		if ok && !containsString(selected, name) && !containsString(missing, name) {
+			missing = append(missing, name)
+		}
+	}
+
+	return missing
+}
+
+// withoutAttributes returns the entry without the attributes, which were only
+// listed to sort the entries.
+func withoutAttributes(result *types.Result, attributes []string) *types.Result {
+	if len(attributes) == 0 {
+		return result
+	}
+
+	stripped := &types.Result{Rdn: result.Rdn, Attributes: make(map[string][]string)}
+	for key, values := range result.Attributes {
+		if !containsString(attributes, key) {
+			stripped.Attributes[key] = values
+		}
+	}
+
+	return stripped
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
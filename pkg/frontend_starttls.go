@@ -0,0 +1,62 @@
+package pkg
+
+import (
+	"crypto/tls"
+
+	jww "github.com/spf13/jwalterweatherman"
+	ldap "github.com/vjeantet/ldapserver"
+)
+
+// WithStartTls serves plain ldap on an additional address, where clients can
+// upgrade their connection using the StartTLS extended operation (RFC 4511,
+// section 4.14). If requireTls is set, binds and searches other than for the
+// root DSE are refused until TLS is established.
+func WithStartTls(serverAddr string, requireTls bool) FrontendOption {
+	return func(f *Frontend) {
+		f.startTlsAddr = serverAddr
+		f.requireTls = requireTls
+	}
+}
+
+func (f *Frontend) handleStartTls(w ldap.ResponseWriter, m *ldap.Message) {
+	res := ldap.NewExtendedResponse(ldap.LDAPResultSuccess)
+	res.SetResponseName(ldap.NoticeOfStartTLS)
+
+	if f.session(m).Tls() {
+		res.SetResultCode(ldap.LDAPResultOperationsError)
+		res.SetDiagnosticMessage("TLS is already established")
+		w.Write(res)
+		return
+	}
+
+	conn := m.Client.GetConn()
+	tlsConn := tls.Server(conn, f.tlsConfig())
+
+	// the client starts the handshake once it received the response, the
+	// server handles StartTLS synchronously so no other message is read
+	w.Write(res)
+
+	if err := tlsConn.Handshake(); err != nil {
+		jww.WARN.Printf("StartTLS handshake with %s failed: %v", conn.RemoteAddr(), err)
+
+		// the state of the connection is unknown, closing it ends the session
+		conn.Close()
+		return
+	}
+
+	m.Client.SetConn(tlsConn)
+	f.session(m).setTls()
+
+	jww.INFO.Printf("StartTLS established with %s", conn.RemoteAddr())
+}
+
+// isConfidential checks if an operation is allowed on the connection of the
+// message with respect to the TLS requirement.
+func (f *Frontend) isConfidential(m *ldap.Message) bool {
+	return !f.requireTls || f.session(m).Tls()
+}
+
+func isTls(m *ldap.Message) bool {
+	_, ok := m.Client.GetConn().(*tls.Conn)
+	return ok
+}
@@ -1,93 +1,1912 @@
 package pkg
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
 	"github.com/go-ldap/ldap"
+	"github.com/gopenguin/minimal-ldap-proxy/pkg/password"
 	"github.com/gopenguin/minimal-ldap-proxy/types"
 	"github.com/stretchr/testify/assert"
 	"github.com/vjeantet/ldapserver"
-	"testing"
-	"time"
+	"gopkg.in/asn1-ber.v1"
 )
 
-var _ types.Backend = (*testBackend)(nil)
+var _ types.Backend = (*testBackend)(nil)
+
+const testReaderDn = "cn=reader,ou=Services,dc=example,dc=com"
+
+type testBackend struct {
+	username   string
+	password   string
+	bindResult bool
+	// passwordPolicy is returned by Authenticate
+	passwordPolicy types.PasswordPolicy
+
+	passwordHash string
+
+	added    map[string][]string
+	changes  []types.Change
+	deleted  bool
+	writeErr error
+
+	filter       *types.Filter
+	attributes   []string
+	options      []types.ListOptions
+	searchResult *types.Result
+	listResult   []*types.Result
+	groupResult  []*types.Result
+	// listDelay delays listings, unless the context is done before
+	listDelay time.Duration
+}
+
+func (t *testBackend) Authenticate(username string, password string) (bool, types.PasswordPolicy) {
+	t.username = username
+	t.password = password
+
+	return t.bindResult, t.passwordPolicy
+}
+
+func (t *testBackend) UpdatePassword(username string, passwordHash string) error {
+	t.username = username
+	t.passwordHash = passwordHash
+
+	return nil
+}
+
+func (t *testBackend) Add(username string, attributes map[string][]string) error {
+	t.username = username
+	t.added = attributes
+
+	return t.writeErr
+}
+
+func (t *testBackend) Modify(username string, changes []types.Change) error {
+	t.username = username
+	t.changes = changes
+
+	return t.writeErr
+}
+
+func (t *testBackend) Delete(username string) error {
+	t.username = username
+	t.deleted = true
+
+	return t.writeErr
+}
+
+func (t *testBackend) Search(ctx context.Context, user string, filter *types.Filter, attributes []string) *types.Result {
+	t.username = user
+	t.filter = filter
+	t.attributes = attributes
+
+	return t.searchResult
+}
+
+func (t *testBackend) List(ctx context.Context, filter *types.Filter, attributes []string, options types.ListOptions, fn func(result *types.Result)) error {
+	t.filter = filter
+	t.attributes = attributes
+
+	return t.list(ctx, t.listResult, options, fn)
+}
+
+func (t *testBackend) ListGroups(ctx context.Context, filter *types.Filter, attributes []string, options types.ListOptions, fn func(result *types.Result)) error {
+	t.filter = filter
+	t.attributes = attributes
+
+	var results []*types.Result
+	for _, result := range t.groupResult {
+		if filter == nil || matchFilter(filter, result.Attributes) {
+			results = append(results, result)
+		}
+	}
+
+	return t.list(ctx, results, options, fn)
+}
+
+func (t *testBackend) list(ctx context.Context, results []*types.Result, options types.ListOptions, fn func(result *types.Result)) error {
+	t.options = append(t.options, options)
+
+	select {
+	case <-time.After(t.listDelay):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	for i, result := range results {
+		if i >= options.Offset && (options.Limit <= 0 || i < options.Offset+options.Limit) {
+			fn(result)
+		}
+	}
+
+	return nil
+}
+
+func TestFrontend_handleBind(t *testing.T) {
+	withLdapServerAndClient(t, nil, func(t *testing.T, backend *testBackend, client *ldap.Conn) {
+		backend.bindResult = true
+		err := client.Bind("cn=username,ou=People,dc=example,dc=com", "password")
+		assert.NoError(t, err)
+		assert.Equal(t, "username", backend.username)
+		assert.Equal(t, "password", backend.password)
+
+		err = client.Bind(`CN=Doe\, John, OU=people,DC=Example,DC=com`, "password")
+		assert.NoError(t, err)
+		assert.Equal(t, "Doe, John", backend.username)
+
+		backend.bindResult = false
+		err = client.Bind("cn=username,ou=People,dc=example,dc=com", "password")
+		assert.EqualError(t, err, "LDAP Result Code 49 \"Invalid Credentials\": ")
+	})
+}
+
+func TestFrontend_handleBindPasswordPolicy(t *testing.T) {
+	withLdapServerAndClient(t, nil, func(t *testing.T, backend *testBackend, client *ldap.Conn) {
+		backend.bindResult = true
+
+		backend.passwordPolicy = types.PasswordPolicy{Expired: true, GraceLogins: 1}
+		assert.NoError(t, client.Bind("cn=username,ou=People,dc=example,dc=com", "password"))
+
+		backend.passwordPolicy = types.PasswordPolicy{Expired: true}
+		err := client.Bind("cn=username,ou=People,dc=example,dc=com", "password")
+		assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials))
+
+		backend.passwordPolicy = types.PasswordPolicy{Locked: true}
+		err = client.Bind("cn=username,ou=People,dc=example,dc=com", "password")
+		assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials))
+	})
+
+	backend := &testBackend{bindResult: true, passwordPolicy: types.PasswordPolicy{ExpiresIn: 60}}
+	frontend := NewFrontend("127.0.0.1:0", newTestCertificate(t), "ou=People,dc=example,dc=com", "cn", nil, backend)
+	frontend.Serve()
+	defer frontend.Stop()
+
+	if !waitListenerReady(frontend.server, 2*time.Second) {
+		t.Errorf("server not ready after 2 seconds")
+		return
+	}
+
+	// the bind request is sent raw, the client encodes the controls as part of
+	// the bind request
+	conn, err := tls.Dial("tcp", frontend.server.Listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	bind := asn1.RawValue{Class: asn1.ClassApplication, Tag: 0, IsCompound: true, Bytes: append(append(
+		mustMarshal(t, 3),
+		mustMarshal(t, []byte("cn=username,ou=People,dc=example,dc=com"))...),
+		mustMarshal(t, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, Bytes: []byte("password")})...)}
+	controls := asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: mustMarshal(t, struct {
+		ControlType []byte
+	}{[]byte(passwordPolicyControl)})}
+
+	_, err = conn.Write(mustMarshal(t, asn1.RawValue{Tag: asn1.TagSequence, IsCompound: true, Bytes: append(append(mustMarshal(t, 1), mustMarshal(t, bind)...), mustMarshal(t, controls)...)}))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var msg, id, res, responseControls asn1.RawValue
+	var responseControl control
+	if _, err := asn1.Unmarshal(readRawMessage(t, conn), &msg); !assert.NoError(t, err) {
+		return
+	}
+	rest, _ := asn1.Unmarshal(msg.Bytes, &id)
+	rest, _ = asn1.Unmarshal(rest, &res)
+	asn1.Unmarshal(rest, &responseControls)
+	asn1.Unmarshal(responseControls.Bytes, &responseControl)
+
+	assert.Equal(t, passwordPolicyControl, string(responseControl.ControlType))
+	assert.Equal(t, []byte{0x30, 0x05, 0xa0, 0x03, 0x80, 0x01, 0x3c}, responseControl.ControlValue)
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	tests := []struct {
+		name          string
+		authenticated bool
+		policy        types.PasswordPolicy
+		allowed       bool
+		value         []byte
+	}{
+		{name: "Nothing to report", authenticated: true, allowed: true, value: []byte{0x30, 0x00}},
+		{name: "Wrong password", policy: types.PasswordPolicy{Expired: true}, value: []byte{0x30, 0x00}},
+		{name: "Locked", authenticated: true, policy: types.PasswordPolicy{Locked: true}, value: []byte{0x30, 0x03, 0x81, 0x01, 0x01}},
+		{name: "Locked with wrong password", policy: types.PasswordPolicy{Locked: true}, value: []byte{0x30, 0x00}},
+		{name: "Locked out", policy: types.PasswordPolicy{Locked: true, LockedOut: true}, value: []byte{0x30, 0x03, 0x81, 0x01, 0x01}},
+		{name: "Expired", authenticated: true, policy: types.PasswordPolicy{Expired: true}, value: []byte{0x30, 0x03, 0x81, 0x01, 0x00}},
+		{
+			name:          "Grace login",
+			authenticated: true,
+			policy:        types.PasswordPolicy{Expired: true, GraceLogins: 2},
+			allowed:       true,
+			value:         []byte{0x30, 0x05, 0xa0, 0x03, 0x81, 0x01, 0x02},
+		},
+		{
+			name:          "Expiring",
+			authenticated: true,
+			policy:        types.PasswordPolicy{ExpiresIn: 3600, MustChange: true},
+			allowed:       true,
+			value:         []byte{0x30, 0x09, 0xa0, 0x04, 0x80, 0x02, 0x0e, 0x10, 0x81, 0x01, 0x02},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := checkPasswordPolicy(test.authenticated, test.policy)
+
+			assert.Equal(t, test.allowed, result.allowed)
+			if policyControl, err := result.control(); assert.NoError(t, err) {
+				assert.Equal(t, test.value, policyControl.ControlValue)
+			}
+		})
+	}
+}
+
+func TestFrontend_handleBindLockout(t *testing.T) {
+	withLdapServerAndClient(t, nil, func(t *testing.T, backend *testBackend, client *ldap.Conn) {
+		backend.searchResult = &types.Result{Rdn: "username"}
+		for i := 0; i < 2; i++ {
+			err := client.Bind("cn=username,ou=People,dc=example,dc=com", "wrong")
+			assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials))
+		}
+
+		// the password of a locked user is not verified, whatever the spelling
+		// of the dn
+		backend.bindResult = true
+		backend.password = ""
+		err := client.Bind("CN=Username,OU=People,DC=example,DC=com", "password")
+		assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials))
+		assert.Equal(t, "", backend.password)
+
+		assert.NoError(t, client.Bind(testReaderDn, "secret"))
+
+		modify := ldap.NewModifyRequest("cn=username,ou=People,dc=example,dc=com")
+		modify.Replace("mail", []string{"username@example.com"})
+		assert.True(t, ldap.IsErrorWithCode(client.Modify(modify), ldap.LDAPResultUnwillingToPerform))
+
+		modify = ldap.NewModifyRequest("cn=username,ou=People,dc=example,dc=com")
+		modify.Delete("pwdAccountLockedTime", nil)
+		assert.NoError(t, client.Modify(modify))
+
+		assert.NoError(t, client.Bind("cn=username,ou=People,dc=example,dc=com", "password"))
+		assert.Equal(t, "password", backend.password)
+
+		// unknown users are never locked out
+		backend.bindResult = false
+		backend.searchResult = nil
+		for i := 0; i < 2; i++ {
+			err := client.Bind("cn=unknown,ou=People,dc=example,dc=com", "wrong")
+			assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials))
+		}
+		backend.bindResult = true
+		assert.NoError(t, client.Bind("cn=unknown,ou=People,dc=example,dc=com", "password"))
+
+		// service accounts are locked out like users
+		for i := 0; i < 2; i++ {
+			err := client.Bind(testReaderDn, "wrong")
+			assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials))
+		}
+		err = client.Bind(testReaderDn, "secret")
+		assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials))
+	}, WithLockout(types.LockoutPolicy{LockoutFailures: 2, LockoutWindow: 60, LockoutDuration: 60}, nil), WithPasswordModify([]string{testReaderDn}))
+}
+
+func TestLockout(t *testing.T) {
+	store := newMemoryLockoutStore(time.Minute)
+	l := newLockout(types.LockoutPolicy{LockoutFailures: 2, LockoutWindow: 60, LockoutDuration: 60}, store)
+	exists := func() bool { return true }
+
+	l.failed("cn=username", "", types.LockoutState{}, exists)
+	_, locked := l.locked("cn=username", "")
+	assert.False(t, locked)
+
+	// failures before the window are forgotten
+	store.Save("cn=username", "", types.LockoutState{Failures: 1, Since: time.Now().Add(-2 * time.Minute)})
+	state, _ := l.locked("cn=username", "")
+	l.failed("cn=username", "", state, exists)
+	state, locked = l.locked("cn=username", "")
+	assert.False(t, locked)
+	assert.Equal(t, 1, state.Failures)
+
+	// failures counted since the state was loaded, e.g. by other proxies
+	// sharing the store, count as well
+	l.failed("cn=username", "", types.LockoutState{}, exists)
+	state, locked = l.locked("cn=username", "")
+	assert.True(t, locked)
+	_, locked = l.locked("cn=username", "192.0.2.1")
+	assert.False(t, locked)
+
+	l.succeeded("cn=username", "", state)
+	_, locked = l.locked("cn=username", "")
+	assert.False(t, locked)
+
+	// failures of unknown accounts are not counted
+	l.failed("cn=unknown", "", types.LockoutState{}, func() bool { return false })
+	assert.NotContains(t, store.states, "cn=unknown")
+
+	// the lockout ends after its duration
+	store.Save("cn=username", "", types.LockoutState{LockedUntil: time.Now().Add(-time.Second)})
+	_, locked = l.locked("cn=username", "")
+	assert.False(t, locked)
+
+	// expired states are removed once per window
+	store.pruned = time.Now().Add(-2 * time.Minute)
+	store.Save("cn=other", "", types.LockoutState{Failures: 1, Since: time.Now()})
+	assert.NotContains(t, store.states, "cn=username")
+	assert.Contains(t, store.states, "cn=other")
+}
+
+func TestLockout_verifyConcurrently(t *testing.T) {
+	l := newLockout(types.LockoutPolicy{LockoutFailures: 2, LockoutWindow: 60, LockoutDuration: 60}, newMemoryLockoutStore(time.Minute))
+
+	// concurrent binds of a user can't verify more passwords than the
+	// lockout allows
+	var mutex sync.Mutex
+	verified := 0
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.verify(nil, "cn=username", func() bool {
+				mutex.Lock()
+				defer mutex.Unlock()
+
+				verified++
+				return false
+			}, func() bool { return true })
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 2, verified)
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(types.RateLimits{
+		RateLimit:       1,
+		RateBurst:       2,
+		UserRateLimit:   0.5,
+		TarpitDelay:     100,
+		MaxTarpitDelay:  400,
+		TrustedNetworks: []types.TrustedNetwork{{Cidr: "192.0.2.0/24", RateLimit: 10}},
+	})
+	now := time.Now()
+
+	// assertDelay expects the operation to be delayed and waits for it
+	assertDelay := func(expected time.Duration, address string, user string) {
+		t.Helper()
+
+		delay, ok := l.delay(address, user, now)
+		assert.True(t, ok)
+		assert.Equal(t, expected, delay)
+		now = now.Add(delay)
+	}
+
+	assertDelay(0, "198.51.100.1", "")
+	assertDelay(0, "198.51.100.1", "")
+
+	// the delay doubles as long as the limit is exceeded, longer delays than
+	// the maximum are refused
+	assertDelay(100*time.Millisecond, "198.51.100.1", "")
+	assertDelay(200*time.Millisecond, "198.51.100.1", "")
+	assertDelay(400*time.Millisecond, "198.51.100.1", "")
+	_, ok := l.delay("198.51.100.1", "", now)
+	assert.False(t, ok)
+
+	now = now.Add(time.Second)
+	assertDelay(0, "198.51.100.1", "")
+
+	// operations sent while another one is delayed are refused
+	delay, ok := l.delay("198.51.100.1", "", now)
+	assert.True(t, ok)
+	assert.Equal(t, 100*time.Millisecond, delay)
+	_, ok = l.delay("198.51.100.1", "", now)
+	assert.False(t, ok)
+
+	// clients of the trusted network have their own limit
+	for i := 0; i < 10; i++ {
+		assertDelay(0, "192.0.2.1", "")
+	}
+	assertDelay(100*time.Millisecond, "192.0.2.1", "")
+
+	// the limit of the user applies to every client address and spelling
+	assertDelay(0, "192.0.2.2", "cn=username,ou=People,dc=example,dc=com")
+	assertDelay(100*time.Millisecond, "192.0.2.3", "CN=Username,ou=people,dc=example,dc=com")
+
+	assert.Error(t, CheckRateLimits(types.RateLimits{TrustedNetworks: []types.TrustedNetwork{{Cidr: "192.0.2.0"}}}))
+	assert.NoError(t, CheckRateLimits(types.RateLimits{TrustedNetworks: []types.TrustedNetwork{{Cidr: "2001:db8::/32"}}}))
+
+	// delays end once the operation is abandoned
+	abandoned := make(chan bool, 1)
+	abandoned <- true
+	start := time.Now()
+	assert.False(t, waitDelay(time.Minute, abandoned))
+	assert.True(t, time.Since(start) < time.Second)
+	assert.True(t, waitDelay(time.Millisecond, nil))
+}
+
+func TestFrontend_handleBindWithoutPassword(t *testing.T) {
+	withLdapServerAndClient(t, nil, func(t *testing.T, backend *testBackend, client *ldap.Conn) {
+		backend.bindResult = true
+
+		assert.NoError(t, client.Bind("", ""))
+
+		err := client.Bind("cn=username,ou=People,dc=example,dc=com", "")
+		assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultUnwillingToPerform))
+		assert.Equal(t, "", backend.username)
+
+		_, err = client.Search(&ldap.SearchRequest{BaseDN: "ou=People,dc=example,dc=com", Filter: "(objectClass=*)"})
+		assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultInsufficientAccessRights))
+	})
+
+	withLdapServerAndClient(t, nil, func(t *testing.T, backend *testBackend, client *ldap.Conn) {
+		backend.bindResult = true
+
+		err := client.Bind("", "")
+		assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultInappropriateAuthentication))
+
+		_, err = client.Search(&ldap.SearchRequest{Scope: ldap.ScopeBaseObject, Filter: "(objectClass=*)"})
+		assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultInsufficientAccessRights))
+
+		assert.NoError(t, client.Bind("cn=username,ou=People,dc=example,dc=com", ""))
+		assert.Equal(t, "", backend.username)
+
+		_, err = client.Search(&ldap.SearchRequest{Scope: ldap.ScopeBaseObject, Filter: "(objectClass=*)"})
+		assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultInsufficientAccessRights))
+	}, WithBindPolicy(types.BindPolicy{AllowUnauthenticatedBind: true}))
+}
+
+func TestFrontend_handlePasswordModify(t *testing.T) {
+	withLdapServerAndClient(t, nil, func(t *testing.T, backend *testBackend, client *ldap.Conn) {
+		_, err := client.PasswordModify(ldap.NewPasswordModifyRequest("", "secret", "new"))
+		assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultUnwillingToPerform))
+
+		_, err = client.PasswordModify(ldap.NewPasswordModifyRequest("cn=abc,ou=People,dc=example,dc=com", "", "new"))
+		assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultInsufficientAccessRights))
+
+		backend.bindResult = true
+		assert.NoError(t, client.Bind("cn=abc,ou=People,dc=example,dc=com", "old"))
+
+		_, err = client.PasswordModify(ldap.NewPasswordModifyRequest("cn=def,ou=People,dc=example,dc=com", "old", "new"))
+		assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultInsufficientAccessRights))
+
+		backend.bindResult = false
+		_, err = client.PasswordModify(ldap.NewPasswordModifyRequest("", "wrong", "new"))
+		assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials))
+		assert.Equal(t, "", backend.passwordHash)
+
+		backend.bindResult = true
+		_, err = client.PasswordModify(ldap.NewPasswordModifyRequest("", "old", "new"))
+		assert.NoError(t, err)
+		assert.Equal(t, "abc", backend.username)
+		assert.True(t, password.Verify("new", backend.passwordHash))
+	}, WithPasswordModify(nil))
+
+	withLdapServerAndClient(t, nil, func(t *testing.T, backend *testBackend, client *ldap.Conn) {
+		_, err := client.PasswordModify(ldap.NewPasswordModifyRequest("cn=abc,ou=People,dc=example,dc=com", "", "new"))
+		assert.NoError(t, err)
+		assert.Equal(t, "abc", backend.username)
+		assert.True(t, password.Verify("new", backend.passwordHash))
+	}, WithPasswordModify([]string{testReaderDn}))
+
+	withLdapServerAndClient(t, nil, func(t *testing.T, backend *testBackend, client *ldap.Conn) {
+		backend.bindResult = true
+		backend.passwordPolicy = types.PasswordPolicy{MustChange: true}
+		assert.NoError(t, client.Bind("cn=abc,ou=People,dc=example,dc=com", "old"))
+
+		// after a reset the password must be changed before searching
+		search := ldap.NewSearchRequest("ou=People,dc=example,dc=com", ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, "(cn=abc)", nil, nil)
+		_, err := client.Search(search)
+		assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultInsufficientAccessRights))
+
+		_, err = client.PasswordModify(ldap.NewPasswordModifyRequest("", "old", "new"))
+		assert.NoError(t, err)
+
+		_, err = client.Search(search)
+		assert.NoError(t, err)
+	}, WithPasswordModify(nil))
+}
+
+func TestFrontend_handleWrite(t *testing.T) {
+	withLdapServerAndClient(t, []string{"mail", "sn"}, func(t *testing.T, backend *testBackend, client *ldap.Conn) {
+		add := ldap.NewAddRequest("cn=new,ou=People,dc=example,dc=com")
+		add.Attribute("objectClass", []string{"person"})
+		add.Attribute("cn", []string{"new"})
+		add.Attribute("SN", []string{"Doe"})
+		add.Attribute("mail", []string{"a@example.com", "b@example.com"})
+		add.Attribute("userPassword", []string{"secret"})
+		assert.NoError(t, client.Add(add))
+		assert.Equal(t, "new", backend.username)
+		if assert.Len(t, backend.added, 3) {
+			assert.Equal(t, []string{"Doe"}, backend.added["sn"])
+			assert.Equal(t, []string{"a@example.com", "b@example.com"}, backend.added["mail"])
+			assert.True(t, password.Verify("secret", backend.added["userPassword"][0]))
+		}
+
+		// the rdn value must match the dn
+		backend.added = nil
+		add = ldap.NewAddRequest("cn=new,ou=People,dc=example,dc=com")
+		add.Attribute("CN", []string{"other"})
+		assert.True(t, ldap.IsErrorWithCode(client.Add(add), ldap.LDAPResultNamingViolation))
+		assert.Nil(t, backend.added)
+
+		add = ldap.NewAddRequest("cn=new,ou=People,dc=example,dc=com")
+		add.Attribute("title", []string{"unknown"})
+		assert.True(t, ldap.IsErrorWithCode(client.Add(add), ldap.LDAPResultUndefinedAttributeType))
+
+		add = ldap.NewAddRequest("cn=new,ou=Groups,dc=example,dc=com")
+		assert.True(t, ldap.IsErrorWithCode(client.Add(add), ldap.LDAPResultUnwillingToPerform))
+
+		backend.writeErr = fmt.Errorf("user 'new' %w", types.ErrExists)
+		add = ldap.NewAddRequest("cn=new,ou=People,dc=example,dc=com")
+		assert.True(t, ldap.IsErrorWithCode(client.Add(add), ldap.LDAPResultEntryAlreadyExists))
+		backend.writeErr = nil
+
+		modify := ldap.NewModifyRequest("cn=new,ou=People,dc=example,dc=com")
+		modify.Replace("rfc822Mailbox", []string{"new@example.com"})
+		modify.Delete("sn", nil)
+		assert.NoError(t, client.Modify(modify))
+		// the client sends the deletions before the replacements
+		if assert.Len(t, backend.changes, 2) {
+			assert.Equal(t, types.Change{Operation: types.ChangeDelete, Attribute: "sn"}, backend.changes[0])
+			assert.Equal(t, "mail", backend.changes[1].Attribute)
+			assert.Equal(t, "new@example.com", *backend.changes[1].Value)
+		}
+
+		// deleted passwords are verified like binds and remove the hash
+		backend.bindResult = true
+		modify = ldap.NewModifyRequest("cn=new,ou=People,dc=example,dc=com")
+		modify.Delete("userPassword", []string{"secret"})
+		modify.Add("userPassword", []string{"other"})
+		assert.NoError(t, client.Modify(modify))
+		assert.Equal(t, "secret", backend.password)
+		// the client sends the additions first
+		if assert.Len(t, backend.changes, 2) {
+			assert.Equal(t, types.ChangeAdd, backend.changes[0].Operation)
+			assert.True(t, password.Verify("other", *backend.changes[0].Value))
+			assert.Equal(t, types.Change{Operation: types.ChangeDelete, Attribute: "userPassword"}, backend.changes[1])
+		}
+
+		backend.bindResult = false
+		modify = ldap.NewModifyRequest("cn=new,ou=People,dc=example,dc=com")
+		modify.Delete("userPassword", []string{"wrong"})
+		assert.True(t, ldap.IsErrorWithCode(client.Modify(modify), ldap.LDAPResultNoSuchAttribute))
+
+		for err, code := range map[error]uint8{
+			fmt.Errorf("modify query for 'mail' %w", types.ErrNotConfigured): ldap.LDAPResultUnwillingToPerform,
+			fmt.Errorf("user 'new' %w", types.ErrNotFound):                   ldap.LDAPResultNoSuchObject,
+			fmt.Errorf("attribute 'mail' %w", types.ErrNoSuchValue):          ldap.LDAPResultNoSuchAttribute,
+			fmt.Errorf("attribute 'mail' %w", types.ErrValueExists):          ldap.LDAPResultAttributeOrValueExists,
+			fmt.Errorf("attribute 'mail' %w", types.ErrSingleValue):          ldap.LDAPResultUnwillingToPerform,
+		} {
+			backend.writeErr = err
+			modify = ldap.NewModifyRequest("cn=new,ou=People,dc=example,dc=com")
+			modify.Add("mail", []string{"new@example.com"})
+			assert.True(t, ldap.IsErrorWithCode(client.Modify(modify), code), err.Error())
+		}
+		backend.writeErr = nil
+
+		// the values after the first one of a replacement are added
+		modify = ldap.NewModifyRequest("cn=new,ou=People,dc=example,dc=com")
+		modify.Replace("mail", []string{"a@example.com", "b@example.com"})
+		assert.NoError(t, client.Modify(modify))
+		if assert.Len(t, backend.changes, 2) {
+			assert.Equal(t, types.ChangeReplace, backend.changes[0].Operation)
+			assert.Equal(t, "a@example.com", *backend.changes[0].Value)
+			assert.Equal(t, types.ChangeAdd, backend.changes[1].Operation)
+			assert.Equal(t, "b@example.com", *backend.changes[1].Value)
+		}
+
+		modify = ldap.NewModifyRequest("cn=new,ou=People,dc=example,dc=com")
+		modify.Replace("cn", []string{"other"})
+		assert.True(t, ldap.IsErrorWithCode(client.Modify(modify), ldap.LDAPResultNotAllowedOnRDN))
+
+		assert.NoError(t, client.Del(ldap.NewDelRequest("cn=new,ou=People,dc=example,dc=com", nil)))
+		assert.True(t, backend.deleted)
+
+		backend.writeErr = fmt.Errorf("user 'unknown' %w", types.ErrNotFound)
+		err := client.Del(ldap.NewDelRequest("cn=unknown,ou=People,dc=example,dc=com", nil))
+		assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject))
+	}, WithWriteOperations([]string{testReaderDn}))
+
+	withLdapServerAndClient(t, nil, func(t *testing.T, backend *testBackend, client *ldap.Conn) {
+		err := client.Del(ldap.NewDelRequest("cn=new,ou=People,dc=example,dc=com", nil))
+		assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultInsufficientAccessRights))
+		assert.False(t, backend.deleted)
+	}, WithWriteOperations(nil))
+}
+
+func TestFrontend_handleWhoAmI(t *testing.T) {
+	hash, err := password.Hash("secret")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	frontend := NewFrontend("127.0.0.1:0", newTestCertificate(t), "ou=People,dc=example,dc=com", "cn", nil, &testBackend{}, WithServiceAccounts([]types.ServiceAccount{{Dn: testReaderDn, Password: hash}}))
+	frontend.Serve()
+	defer frontend.Stop()
+
+	if !waitListenerReady(frontend.server, 2*time.Second) {
+		t.Errorf("server not ready after 2 seconds")
+		return
+	}
+
+	conn, err := tls.Dial("tcp", frontend.server.Listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	whoAmI := asn1.RawValue{Class: asn1.ClassApplication, Tag: 23, IsCompound: true, Bytes: mustMarshal(t,
+		asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, Bytes: []byte("1.3.6.1.4.1.4203.1.11.3")})}
+
+	resultCode, value := rawRequest(t, conn, 1, whoAmI)
+	assert.Equal(t, ldap.LDAPResultSuccess, resultCode)
+	assert.Equal(t, "", value)
+
+	bind := asn1.RawValue{Class: asn1.ClassApplication, Tag: 0, IsCompound: true, Bytes: append(append(
+		mustMarshal(t, 3),
+		mustMarshal(t, []byte(testReaderDn))...),
+		mustMarshal(t, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, Bytes: []byte("secret")})...)}
+
+	resultCode, _ = rawRequest(t, conn, 2, bind)
+	assert.Equal(t, ldap.LDAPResultSuccess, resultCode)
+
+	resultCode, value = rawRequest(t, conn, 3, whoAmI)
+	assert.Equal(t, ldap.LDAPResultSuccess, resultCode)
+	assert.Equal(t, "dn:"+testReaderDn, value)
+}
+
+func mustMarshal(t *testing.T, value interface{}) []byte {
+	data, err := asn1.Marshal(value)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+
+	return data
+}
+
+// rawRequest sends a request and returns the result code and the response
+// value of the response.
+func rawRequest(t *testing.T, conn net.Conn, messageID int, op asn1.RawValue) (resultCode int, value string) {
+	_, err := conn.Write(mustMarshal(t, asn1.RawValue{Tag: asn1.TagSequence, IsCompound: true, Bytes: append(mustMarshal(t, messageID), mustMarshal(t, op)...)}))
+	if err != nil {
+		t.Fatalf("write request: %v", err)
+	}
+
+	var msg, id, res, code asn1.RawValue
+	if _, err := asn1.Unmarshal(readRawMessage(t, conn), &msg); err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+
+	rest, _ := asn1.Unmarshal(msg.Bytes, &id)
+	asn1.Unmarshal(rest, &res)
+
+	// resultCode, matchedDN, diagnosticMessage and the optional parts
+	rest, _ = asn1.Unmarshal(res.Bytes, &code)
+	resultCode = int(code.Bytes[0])
+	for len(rest) > 0 {
+		var part asn1.RawValue
+		rest, _ = asn1.Unmarshal(rest, &part)
+
+		if part.Class == asn1.ClassContextSpecific && part.Tag == 11 {
+			value = string(part.Bytes)
+		}
+	}
+
+	return resultCode, value
+}
+
+func readRawMessage(t *testing.T, conn net.Conn) []byte {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+
+	length := int(header[1])
+	if length&0x80 != 0 {
+		lengthBytes := make([]byte, length&0x7f)
+		if _, err := io.ReadFull(conn, lengthBytes); err != nil {
+			t.Fatalf("read response: %v", err)
+		}
+
+		header = append(header, lengthBytes...)
+		length = 0
+		for _, b := range lengthBytes {
+			length = length<<8 | int(b)
+		}
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+
+	return append(header, body...)
+}
+
+func TestFrontend_handleCompare(t *testing.T) {
+	hash, err := password.Hash("secret")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	backend := &testBackend{
+		searchResult: &types.Result{Rdn: "abc", Attributes: map[string][]string{"mail": {"Abc@Example.com"}, "custom": {"Value"}}},
+		groupResult: []*types.Result{
+			{Rdn: "admins", Attributes: map[string][]string{"cn": {"admins"}, "member": {"abc"}}},
+		},
+	}
+
+	frontend := NewFrontend("127.0.0.1:0", newTestCertificate(t), "ou=People,dc=example,dc=com", "cn", []string{"mail", "custom"}, backend,
+		WithServiceAccounts([]types.ServiceAccount{{Dn: testReaderDn, Password: hash}}),
+		WithGroups("ou=Groups,dc=example,dc=com", "cn", nil))
+	frontend.Serve()
+	defer frontend.Stop()
+
+	if !waitListenerReady(frontend.server, 2*time.Second) {
+		t.Errorf("server not ready after 2 seconds")
+		return
+	}
+
+	// the compare request is sent raw, the client encodes the assertion value
+	// as constructed octet string
+	conn, err := tls.Dial("tcp", frontend.server.Listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	compare := func(messageID int, dn string, attribute string, value string) int {
+		ava := asn1.RawValue{Tag: asn1.TagSequence, IsCompound: true, Bytes: append(mustMarshal(t, []byte(attribute)), mustMarshal(t, []byte(value))...)}
+		op := asn1.RawValue{Class: asn1.ClassApplication, Tag: 14, IsCompound: true, Bytes: append(mustMarshal(t, []byte(dn)), mustMarshal(t, ava)...)}
+
+		resultCode, _ := rawRequest(t, conn, messageID, op)
+		return resultCode
+	}
+
+	assert.Equal(t, ldap.LDAPResultInsufficientAccessRights, compare(1, "cn=abc,ou=People,dc=example,dc=com", "mail", "abc@example.com"))
+
+	bind := asn1.RawValue{Class: asn1.ClassApplication, Tag: 0, IsCompound: true, Bytes: append(append(
+		mustMarshal(t, 3),
+		mustMarshal(t, []byte(testReaderDn))...),
+		mustMarshal(t, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, Bytes: []byte("secret")})...)}
+
+	resultCode, _ := rawRequest(t, conn, 2, bind)
+	if !assert.Equal(t, ldap.LDAPResultSuccess, resultCode) {
+		return
+	}
+
+	assert.Equal(t, ldap.LDAPResultCompareTrue, compare(3, "cn=abc,ou=People,dc=example,dc=com", "mail", "abc@example.com"))
+	assert.Equal(t, "abc", backend.username)
+	assert.Equal(t, []string{"mail"}, backend.attributes)
+
+	assert.Equal(t, ldap.LDAPResultCompareFalse, compare(4, "cn=abc,ou=People,dc=example,dc=com", "custom", "value"))
+	assert.Equal(t, ldap.LDAPResultNoSuchAttribute, compare(5, "cn=abc,ou=People,dc=example,dc=com", "unknown", "value"))
+	assert.Equal(t, ldap.LDAPResultCompareTrue, compare(6, "ou=People,dc=example,dc=com", "ou", "people"))
+
+	assert.Equal(t, ldap.LDAPResultCompareTrue, compare(7, "cn=admins,ou=Groups,dc=example,dc=com", "member", "CN=abc, ou=People, dc=example, dc=com"))
+	assert.Equal(t, &types.Filter{Type: types.FilterEqual, Attribute: "cn", Value: "admins"}, backend.filter)
+
+	backend.searchResult = nil
+	assert.Equal(t, ldap.LDAPResultNoSuchObject, compare(8, "cn=def,ou=People,dc=example,dc=com", "mail", "def@example.com"))
+}
+
+func TestFrontend_handleUserSearch(t *testing.T) {
+	withLdapServerAndClient(t, []string{"attr1", "attr2", "attr3"}, func(t *testing.T, backend *testBackend, client *ldap.Conn) {
+		result, err := client.Search(&ldap.SearchRequest{
+			BaseDN: "ou=People,dc=example,dc=com",
+			Filter: "(objectClass=*)",
+		})
+
+		assert.NoError(t, err)
+		assert.Len(t, result.Entries, 1)
+		assert.Equal(t, "ou=People,dc=example,dc=com", result.Entries[0].DN)
+		assert.Equal(t, []string{"People"}, result.Entries[0].GetAttributeValues("ou"))
+
+		backend.searchResult = &types.Result{
+			Rdn: "abc",
+			Attributes: map[string][]string{
+				"cn":    {"abc"},
+				"attr2": {"def"},
+				"attr3": {"ghi"},
+			},
+		}
+
+		result, err = client.Search(&ldap.SearchRequest{
+			BaseDN:     "ou=People,dc=example,dc=com",
+			Scope:      ldap.ScopeSingleLevel,
+			Attributes: []string{"attr2", "attr3"},
+			Filter:     "(cn=abc)",
+		})
+
+		assert.NoError(t, err)
+		assert.Equal(t, "abc", backend.username)
+		assert.Equal(t, []string{"cn", "attr2", "attr3"}, backend.attributes)
+		assert.Len(t, result.Entries, 1)
+		assert.Equal(t, "cn=abc,ou=People,dc=example,dc=com", result.Entries[0].DN)
+		assert.Len(t, result.Entries[0].Attributes, 3)
+	})
+}
+
+func TestFrontend_handleSearchScopes(t *testing.T) {
+	withLdapServerAndClient(t, []string{"attr1"}, func(t *testing.T, backend *testBackend, client *ldap.Conn) {
+		backend.listResult = []*types.Result{
+			{Rdn: "abc", Attributes: map[string][]string{"cn": {"abc"}}},
+			{Rdn: "def", Attributes: map[string][]string{"cn": {"def"}}},
+		}
+		backend.searchResult = backend.listResult[0]
+
+		tests := []struct {
+			name   string
+			base   string
+			scope  int
+			filter string
+			dns    []string
+		}{
+			{
+				name:  "Base dn subtree",
+				base:  "ou=People,dc=example,dc=com",
+				scope: ldap.ScopeWholeSubtree,
+				dns:   []string{"ou=People,dc=example,dc=com", "cn=abc,ou=People,dc=example,dc=com", "cn=def,ou=People,dc=example,dc=com"},
+			},
+			{
+				name:   "Base dn by rdn",
+				base:   "ou=People,dc=example,dc=com",
+				scope:  ldap.ScopeBaseObject,
+				filter: "(OU=people)",
+				dns:    []string{"ou=People,dc=example,dc=com"},
+			},
+			{
+				name:   "Base dn by object class",
+				base:   "ou=People,dc=example,dc=com",
+				scope:  ldap.ScopeBaseObject,
+				filter: "(&(objectClass=organizationalUnit)(!(cn=*)))",
+				dns:    []string{"ou=People,dc=example,dc=com"},
+			},
+			{
+				name:   "Base dn by other rdn",
+				base:   "ou=People,dc=example,dc=com",
+				scope:  ldap.ScopeBaseObject,
+				filter: "(ou=Groups)",
+			},
+			{
+				name:  "Base dn one level",
+				base:  "ou=People,dc=example,dc=com",
+				scope: ldap.ScopeSingleLevel,
+				dns:   []string{"cn=abc,ou=People,dc=example,dc=com", "cn=def,ou=People,dc=example,dc=com"},
+			},
+			{
+				name:   "Ancestor subtree",
+				base:   "dc=example,dc=com",
+				scope:  ldap.ScopeWholeSubtree,
+				filter: "(attr1=*)",
+				dns:    []string{"cn=abc,ou=People,dc=example,dc=com", "cn=def,ou=People,dc=example,dc=com"},
+			},
+			{
+				name:  "Parent one level",
+				base:  "dc=example,dc=com",
+				scope: ldap.ScopeSingleLevel,
+				dns:   []string{"ou=People,dc=example,dc=com"},
+			},
+			{
+				name:  "User base",
+				base:  "cn=abc,ou=People,dc=example,dc=com",
+				scope: ldap.ScopeBaseObject,
+				dns:   []string{"cn=abc,ou=People,dc=example,dc=com"},
+			},
+			{
+				name:  "User one level",
+				base:  "cn=abc,ou=People,dc=example,dc=com",
+				scope: ldap.ScopeSingleLevel,
+			},
+		}
+
+		for _, test := range tests {
+			filter := test.filter
+			if filter == "" {
+				filter = "(objectClass=*)"
+			}
+
+			result, err := client.Search(&ldap.SearchRequest{
+				BaseDN: test.base,
+				Scope:  test.scope,
+				Filter: filter,
+			})
+
+			if assert.NoError(t, err, test.name) {
+				var dns []string
+				for _, entry := range result.Entries {
+					dns = append(dns, entry.DN)
+				}
+
+				assert.Equal(t, test.dns, dns, test.name)
+			}
+		}
+
+		result, err := client.Search(&ldap.SearchRequest{
+			BaseDN: "ou=People,dc=example,dc=com",
+			Scope:  ldap.ScopeBaseObject,
+			Filter: "(objectClass=*)",
+		})
+		if assert.NoError(t, err) && assert.Len(t, result.Entries, 1) {
+			assert.Equal(t, []string{"top", "organizationalUnit"}, result.Entries[0].GetAttributeValues("objectClass"))
+			assert.Equal(t, []string{"People"}, result.Entries[0].GetAttributeValues("ou"))
+		}
+
+		result, err = client.Search(&ldap.SearchRequest{
+			BaseDN:     "ou=People,dc=example,dc=com",
+			Scope:      ldap.ScopeBaseObject,
+			Filter:     "(objectClass=*)",
+			Attributes: []string{"ou"},
+		})
+		if assert.NoError(t, err) && assert.Len(t, result.Entries, 1) {
+			assert.Empty(t, result.Entries[0].GetAttributeValues("objectClass"))
+		}
+
+		_, err = client.Search(&ldap.SearchRequest{
+			BaseDN: "dc=example,dc=com",
+			Filter: "(objectClass=*)",
+		})
+		assert.EqualError(t, err, "LDAP Result Code 32 \"No Such Object\": ")
+	})
+}
+
+func TestFrontend_handlePagedSearch(t *testing.T) {
+	withLdapServerAndClient(t, []string{"cn"}, func(t *testing.T, backend *testBackend, client *ldap.Conn) {
+		for _, user := range []string{"a", "b", "c", "d", "e"} {
+			backend.listResult = append(backend.listResult, &types.Result{Rdn: user, Attributes: map[string][]string{"cn": {user}}})
+		}
+
+		paging := ldap.NewControlPaging(2)
+		request := &ldap.SearchRequest{
+			BaseDN:   "ou=People,dc=example,dc=com",
+			Scope:    ldap.ScopeWholeSubtree,
+			Filter:   "(objectClass=*)",
+			Controls: []ldap.Control{paging},
+		}
+
+		var pages [][]string
+		for {
+			result, err := client.Search(request)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			var dns []string
+			for _, entry := range result.Entries {
+				dns = append(dns, entry.DN)
+			}
+			pages = append(pages, dns)
+
+			response, ok := ldap.FindControl(result.Controls, ldap.ControlTypePaging).(*ldap.ControlPaging)
+			if !assert.True(t, ok) || len(response.Cookie) == 0 {
+				break
+			}
+			paging.SetCookie(response.Cookie)
+		}
+
+		assert.Equal(t, [][]string{
+			{"ou=People,dc=example,dc=com", "cn=a,ou=People,dc=example,dc=com"},
+			{"cn=b,ou=People,dc=example,dc=com", "cn=c,ou=People,dc=example,dc=com"},
+			{"cn=d,ou=People,dc=example,dc=com", "cn=e,ou=People,dc=example,dc=com"},
+		}, pages)
+		assert.Equal(t, []types.ListOptions{{Offset: 0, Limit: 2}, {Offset: 1, Limit: 3}, {Offset: 3, Limit: 3}}, backend.options)
+
+		paging.SetCookie([]byte("unknown"))
+		_, err := client.Search(request)
+		assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultUnwillingToPerform))
+
+		result, err := client.SearchWithPaging(&ldap.SearchRequest{
+			BaseDN: "ou=People,dc=example,dc=com",
+			Scope:  ldap.ScopeSingleLevel,
+			Filter: "(objectClass=*)",
+		}, 3)
+		assert.NoError(t, err)
+		assert.Len(t, result.Entries, 5)
+	})
+}
+
+func TestSession_pagedSearch(t *testing.T) {
+	s := &session{}
+	s.savePagedSearch(&pagedSearch{request: "search", offsets: map[string]int{}})
+
+	_, err := s.pagedSearch("1", "other search")
+	assert.Error(t, err)
+
+	cursor, err := s.pagedSearch("1", "search")
+	assert.NoError(t, err)
+
+	// a running page keeps the cookie from other pages
+	_, err = s.pagedSearch("1", "search")
+	assert.Error(t, err)
+
+	s.savePagedSearch(cursor)
+	_, err = s.pagedSearch("1", "search")
+	assert.NoError(t, err)
+
+	s.releasePagedSearch(cursor)
+	_, err = s.pagedSearch("1", "search")
+	assert.Error(t, err)
+}
+
+func TestFrontend_handleSearchLimits(t *testing.T) {
+	withLdapServerAndClient(t, []string{"cn"}, func(t *testing.T, backend *testBackend, client *ldap.Conn) {
+		for _, user := range []string{"a", "b", "c", "d", "e"} {
+			backend.listResult = append(backend.listResult, &types.Result{Rdn: user, Attributes: map[string][]string{"cn": {user}}})
+		}
+
+		request := &ldap.SearchRequest{
+			BaseDN: "ou=People,dc=example,dc=com",
+			Scope:  ldap.ScopeSingleLevel,
+			Filter: "(objectClass=*)",
+		}
+
+		// the configured limit is lower
+		result, err := client.Search(request)
+		assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded))
+		assert.Len(t, result.Entries, 3)
+		assert.Equal(t, 4, backend.options[len(backend.options)-1].Limit)
+
+		// the requested limit is lower
+		request.SizeLimit = 2
+		result, err = client.Search(request)
+		assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded))
+		assert.Len(t, result.Entries, 2)
+
+		// the limit applies to all pages of a paged search
+		paging := ldap.NewControlPaging(2)
+		request.SizeLimit = 0
+		request.Controls = []ldap.Control{paging}
+
+		result, err = client.Search(request)
+		assert.NoError(t, err)
+		assert.Len(t, result.Entries, 2)
+
+		paging.SetCookie(ldap.FindControl(result.Controls, ldap.ControlTypePaging).(*ldap.ControlPaging).Cookie)
+		result, err = client.Search(request)
+		assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded))
+		assert.Len(t, result.Entries, 1)
+
+		request.Controls = nil
+		backend.listDelay = time.Second
+		_, err = client.Search(request)
+		assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultTimeLimitExceeded))
+	}, WithSearchLimits(3, 100*time.Millisecond))
+}
+
+func TestFrontend_handleSortedSearch(t *testing.T) {
+	withLdapServerAndClient(t, []string{"cn", "sn"}, func(t *testing.T, backend *testBackend, client *ldap.Conn) {
+		for _, user := range [][]string{{"a", "beta"}, {"b", "Alpha"}, {"c"}, {"d", "gamma"}} {
+			attributes := map[string][]string{"cn": {user[0]}}
+			if len(user) > 1 {
+				attributes["sn"] = user[1:]
+			}
+
+			backend.listResult = append(backend.listResult, &types.Result{Rdn: user[0], Attributes: attributes})
+		}
+
+		search := func(critical bool, keys ...sortKeyValue) ([]string, sortResultValue, error) {
+			result, err := client.Search(&ldap.SearchRequest{
+				BaseDN:     "ou=People,dc=example,dc=com",
+				Scope:      ldap.ScopeSingleLevel,
+				Filter:     "(objectClass=*)",
+				Attributes: []string{"cn"},
+				Controls:   []ldap.Control{newRawControl(t, sortRequestControl, critical, mustMarshal(t, keys))},
+			})
+			if err != nil {
+				return nil, sortResultValue{}, err
+			}
+
+			var users []string
+			for _, entry := range result.Entries {
+				users = append(users, entry.GetAttributeValue("cn"))
+			}
+
+			var value sortResultValue
+			if c, ok := ldap.FindControl(result.Controls, sortResponseControl).(*ldap.ControlString); assert.True(t, ok) {
+				_, err = asn1.Unmarshal([]byte(c.ControlValue), &value)
+				assert.NoError(t, err)
+			}
+
+			return users, value, nil
+		}
+
+		// the backend sorts by columns
+		_, value, err := search(true, sortKeyValue{AttributeType: []byte("sn"), ReverseOrder: true})
+		assert.NoError(t, err)
+		assert.Equal(t, asn1.Enumerated(ldap.LDAPResultSuccess), value.SortResult)
+		assert.Equal(t, []types.SortKey{{Attribute: "sn", Reverse: true}}, backend.options[len(backend.options)-1].Sort)
+
+		// explicit ordering rules are applied in memory, entries without value
+		// are sorted last
+		users, value, err := search(true, sortKeyValue{AttributeType: []byte("sn"), OrderingRule: []byte("caseIgnoreOrderingMatch")})
+		assert.NoError(t, err)
+		assert.Equal(t, asn1.Enumerated(ldap.LDAPResultSuccess), value.SortResult)
+		assert.Equal(t, []string{"b", "a", "d", "c"}, users)
+		assert.Empty(t, backend.options[len(backend.options)-1].Sort)
+		assert.Contains(t, backend.attributes, "sn")
+
+		users, value, err = search(false, sortKeyValue{AttributeType: []byte("unknown")})
+		assert.NoError(t, err)
+		assert.Equal(t, asn1.Enumerated(ldap.LDAPResultNoSuchAttribute), value.SortResult)
+		assert.Equal(t, []byte("unknown"), value.AttributeType)
+		assert.Equal(t, []string{"a", "b", "c", "d"}, users)
+
+		_, _, err = search(true, sortKeyValue{AttributeType: []byte("sn"), OrderingRule: []byte("unknownMatch")})
+		assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultUnavailableCriticalExtension))
+	})
+
+	// listings sorted in memory are limited
+	withLdapServerAndClient(t, []string{"cn", "sn"}, func(t *testing.T, backend *testBackend, client *ldap.Conn) {
+		for _, user := range []string{"a", "b", "c", "d"} {
+			backend.listResult = append(backend.listResult, &types.Result{Rdn: user, Attributes: map[string][]string{"cn": {user}}})
+		}
+
+		_, err := client.Search(&ldap.SearchRequest{
+			BaseDN:   "ou=People,dc=example,dc=com",
+			Scope:    ldap.ScopeSingleLevel,
+			Filter:   "(objectClass=*)",
+			Controls: []ldap.Control{newRawControl(t, sortRequestControl, false, mustMarshal(t, []sortKeyValue{{AttributeType: []byte("sn"), OrderingRule: []byte("caseIgnoreOrderingMatch")}}))},
+		})
+		assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultUnwillingToPerform))
+		assert.Equal(t, 4, backend.options[len(backend.options)-1].Limit)
+	}, WithSortLimit(3))
+}
+
+// rawControl is a request control encoded by encoding/asn1, as the client
+// encodes a critical control in a way the server rejects (TRUE must be 0xff).
+type rawControl struct {
+	controlType string
+	data        []byte
+}
+
+func newRawControl(t *testing.T, controlType string, criticality bool, value []byte) *rawControl {
+	data := mustMarshal(t, struct {
+		ControlType  []byte
+		Criticality  bool `asn1:"optional"`
+		ControlValue []byte
+	}{[]byte(controlType), criticality, value})
+
+	return &rawControl{controlType: controlType, data: data}
+}
+
+func (c *rawControl) GetControlType() string {
+	return c.controlType
+}
+
+func (c *rawControl) Encode() *ber.Packet {
+	return ber.DecodePacket(c.data)
+}
+
+func (c *rawControl) String() string {
+	return c.controlType
+}
+
+func TestFrontend_handleUserSearchFilter(t *testing.T) {
+	withLdapServerAndClient(t, []string{"mail", "attr2"}, func(t *testing.T, backend *testBackend, client *ldap.Conn) {
+		_, err := client.Search(&ldap.SearchRequest{
+			BaseDN: "cn=abc,ou=People,dc=example,dc=com",
+			Filter: "(&(objectClass=*)(cn=abc)(|(mail~=x)(attr2=d*e*f))(!(attr2>=z))(unknown=1))",
+		})
+
+		assert.NoError(t, err)
+		assert.Equal(t, "abc", backend.username)
+		assert.Equal(t, &types.Filter{
+			Type: types.FilterAnd,
+			Children: []*types.Filter{
+				{Type: types.FilterTrue},
+				{Type: types.FilterEqual, Attribute: "cn", Value: "abc"},
+				{Type: types.FilterOr, Children: []*types.Filter{
+					{Type: types.FilterApprox, Attribute: "mail", Value: "x"},
+					{Type: types.FilterSubstrings, Attribute: "attr2", Initial: "d", Any: []string{"e"}, Final: "f"},
+				}},
+				{Type: types.FilterNot, Children: []*types.Filter{
+					{Type: types.FilterGreaterOrEqual, Attribute: "attr2", Value: "z"},
+				}},
+				{Type: types.FilterFalse},
+			},
+		}, backend.filter)
+	})
+}
+
+func TestFrontend_handleSearchAttributeNames(t *testing.T) {
+	withLdapServerAndClient(t, []string{"mail", "attr2"}, func(t *testing.T, backend *testBackend, client *ldap.Conn) {
+		_, err := client.Search(&ldap.SearchRequest{
+			BaseDN:     "cn=abc,ou=People,dc=example,dc=com",
+			Filter:     "(&(commonName=abc)(|(MAIL=x)(rfc822Mailbox=y))(ATTR2=z))",
+			Attributes: []string{"Mail", "rfc822Mailbox", "attr2", "mail;lang-de"},
+		})
+
+		// attributes with options other than ';binary' are subtypes, which are
+		// not served
+		assert.NoError(t, err)
+		assert.Equal(t, "abc", backend.username)
+		assert.Equal(t, []string{"cn", "mail", "attr2"}, backend.attributes)
+		assert.Equal(t, &types.Filter{
+			Type: types.FilterAnd,
+			Children: []*types.Filter{
+				{Type: types.FilterEqual, Attribute: "cn", Value: "abc"},
+				{Type: types.FilterOr, Children: []*types.Filter{
+					{Type: types.FilterEqual, Attribute: "mail", Value: "x"},
+					{Type: types.FilterEqual, Attribute: "mail", Value: "y"},
+				}},
+				{Type: types.FilterEqual, Attribute: "attr2", Value: "z"},
+			},
+		}, backend.filter)
+	})
+}
+
+func TestFrontend_handleSearchDnAttributes(t *testing.T) {
+	withLdapServerAndClient(t, []string{"memberOf"}, func(t *testing.T, backend *testBackend, client *ldap.Conn) {
+		backend.listResult = []*types.Result{
+			{Rdn: "alice", Attributes: map[string][]string{"memberOf": {"admins", "Doe, John"}}},
+		}
+
+		res, err := client.Search(&ldap.SearchRequest{
+			BaseDN: "ou=People,dc=example,dc=com",
+			Scope:  ldap.ScopeSingleLevel,
+			Filter: "(|(memberOf=CN=admins, OU=Groups,DC=example,DC=com)(memberOf=cn=admins,ou=Other,dc=example,dc=com)(memberOf=*))",
+		})
+
+		if !assert.NoError(t, err) || !assert.Len(t, res.Entries, 1) {
+			return
+		}
+
+		assert.Equal(t, []string{`cn=admins,ou=Groups,dc=example,dc=com`, `cn=Doe\, John,ou=Groups,dc=example,dc=com`}, res.Entries[0].GetAttributeValues("memberOf"))
+		assert.Equal(t, &types.Filter{
+			Type: types.FilterOr,
+			Children: []*types.Filter{
+				{Type: types.FilterEqual, Attribute: "memberOf", Value: "admins"},
+				{Type: types.FilterFalse},
+				{Type: types.FilterPresent, Attribute: "memberOf"},
+			},
+		}, backend.filter)
+	}, WithDnAttributes([]types.DnAttribute{{Attribute: "memberof", Template: "cn={},ou=Groups,dc=example,dc=com"}}))
+}
+
+func TestFrontend_handleSearchComputedAttributes(t *testing.T) {
+	withLdapServerAndClient(t, []string{"givenName", "sn"}, func(t *testing.T, backend *testBackend, client *ldap.Conn) {
+		backend.listResult = []*types.Result{
+			{Rdn: "jdoe", Attributes: map[string][]string{"cn": {"jdoe"}, "givenName": {"John"}, "sn": {"Doe"}}},
+			{Rdn: "asmith", Attributes: map[string][]string{"cn": {"asmith"}, "givenName": {"Alice"}, "sn": {"Smith"}}},
+			{Rdn: "nobody", Attributes: map[string][]string{"cn": {"nobody"}}},
+		}
+
+		res, err := client.Search(&ldap.SearchRequest{
+			BaseDN:     "ou=People,dc=example,dc=com",
+			Scope:      ldap.ScopeSingleLevel,
+			Filter:     "(&(displayName=John Doe)(sn=*))",
+			Attributes: []string{"displayName", "homeDirectory"},
+		})
+		if assert.NoError(t, err) && assert.Len(t, res.Entries, 1) {
+			assert.Equal(t, "cn=jdoe,ou=People,dc=example,dc=com", res.Entries[0].DN)
+			assert.Equal(t, []string{"John Doe"}, res.Entries[0].GetAttributeValues("displayName"))
+			assert.Equal(t, []string{"/home/jdoe"}, res.Entries[0].GetAttributeValues("homeDirectory"))
+			assert.Empty(t, res.Entries[0].GetAttributeValues("sn"))
+		}
+
+		// the backend lists the attributes needed to compute the values and to
+		// evaluate the filter in memory
+		assert.Equal(t, &types.Filter{
+			Type: types.FilterAnd,
+			Children: []*types.Filter{
+				{Type: types.FilterTrue},
+				{Type: types.FilterPresent, Attribute: "sn"},
+			},
+		}, backend.filter)
+		assert.ElementsMatch(t, []string{"cn", "givenName", "sn"}, backend.attributes)
+
+		res, err = client.Search(&ldap.SearchRequest{
+			BaseDN:     "ou=People,dc=example,dc=com",
+			Scope:      ldap.ScopeSingleLevel,
+			Filter:     "(!(displayName=John*))",
+			Attributes: []string{"displayName"},
+		})
+		if assert.NoError(t, err) && assert.Len(t, res.Entries, 2) {
+			assert.Equal(t, []string{"Alice Smith"}, res.Entries[0].GetAttributeValues("displayName"))
+			assert.Empty(t, res.Entries[1].GetAttributeValues("displayName"))
+		}
+
+		// presence assertions are passed to the backend
+		_, err = client.Search(&ldap.SearchRequest{
+			BaseDN: "ou=People,dc=example,dc=com",
+			Scope:  ldap.ScopeSingleLevel,
+			Filter: "(displayName=*)",
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, &types.Filter{
+			Type: types.FilterAnd,
+			Children: []*types.Filter{
+				{Type: types.FilterPresent, Attribute: "givenName"},
+				{Type: types.FilterPresent, Attribute: "sn"},
+			},
+		}, backend.filter)
+	}, WithComputedAttributes([]types.ComputedAttribute{
+		{Attribute: "displayName", Template: "{givenName} {surname}"},
+		{Attribute: "homeDirectory", Template: "/home/{cn}"},
+	}))
+
+	// computed attributes are only readable with the attributes they are
+	// computed of
+	withLdapServerAndClient(t, []string{"givenName", "sn"}, func(t *testing.T, backend *testBackend, client *ldap.Conn) {
+		backend.listResult = []*types.Result{
+			{Rdn: "jdoe", Attributes: map[string][]string{"cn": {"jdoe"}, "givenName": {"John"}, "sn": {"Doe"}}},
+		}
+
+		res, err := client.Search(&ldap.SearchRequest{
+			BaseDN:     "ou=People,dc=example,dc=com",
+			Scope:      ldap.ScopeSingleLevel,
+			Filter:     "(|(displayName=John Doe)(homeDirectory=/home/jdoe))",
+			Attributes: []string{"displayName", "homeDirectory"},
+		})
+		if assert.NoError(t, err) && assert.Len(t, res.Entries, 1) {
+			assert.Empty(t, res.Entries[0].GetAttributeValues("displayName"))
+			assert.Equal(t, []string{"/home/jdoe"}, res.Entries[0].GetAttributeValues("homeDirectory"))
+		}
+	}, WithComputedAttributes([]types.ComputedAttribute{
+		{Attribute: "displayName", Template: "{givenName} {sn}"},
+		{Attribute: "homeDirectory", Template: "/home/{cn}"},
+	}), WithAccessRules([]types.AccessRule{
+		{BindDn: testReaderDn, BaseDns: []string{"ou=People,dc=example,dc=com"}, Attributes: []string{"givenName", "displayName", "homeDirectory"}},
+	}))
+}
+
+func TestComputedSearch(t *testing.T) {
+	d := newDirectory("ou=People,dc=example,dc=com", "cn", []string{"sn"}, nil)
+	WithComputedAttributes([]types.ComputedAttribute{{Attribute: "displayName", Template: "{sn}"}})(d)
+
+	// the value discloses the attributes it is computed of, e.g. to compare
+	displayName, _ := d.computedAttribute("displayName")
+	assert.False(t, displayName.readable(&accessRights{attributes: map[string]bool{attributeKey("displayName"): true}}))
+	assert.True(t, displayName.readable(&accessRights{attributes: map[string]bool{attributeKey("displayName"): true, attributeKey("sn"): true}}))
+	c, _, _ := d.newComputedSearch(&types.Filter{Type: types.FilterSubstrings, Attribute: "displayName", Any: []string{"o"}}, nil, &accessRights{all: true}, nil)
+
+	// the listing is cancelled once the range is complete
+	var listed []string
+	list := c.inMemory(context.Background(), func(ctx context.Context, options types.ListOptions, fn func(result *types.Result)) error {
+		for _, sn := range []string{"Doe", "Smith", "Roe", "Moe"} {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			fn(&types.Result{Rdn: sn, Attributes: map[string][]string{"sn": {sn}}})
+		}
+
+		return nil
+	})
+	err := list(types.ListOptions{Offset: 1, Limit: 1}, func(result *types.Result) {
+		listed = append(listed, result.Rdn)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Roe"}, listed)
+
+	// filters are evaluated with the matching rules of the attributes
+	d = newDirectory("ou=People,dc=example,dc=com", "cn", []string{"givenName", "sn"}, nil)
+	WithComputedAttributes([]types.ComputedAttribute{{Attribute: "displayName", Template: "{givenName} {sn}"}})(d)
+	alice := &types.Result{Rdn: "alice", Attributes: map[string][]string{"givenName": {"Alice"}, "sn": {"Smith"}}}
+
+	for _, filter := range []*types.Filter{
+		{Type: types.FilterEqual, Attribute: "displayName", Value: "alice smith"},
+		{Type: types.FilterAnd, Children: []*types.Filter{
+			{Type: types.FilterSubstrings, Attribute: "displayName", Initial: "Alice"},
+			{Type: types.FilterEqual, Attribute: "givenName", Value: "ALICE"},
+		}},
+		{Type: types.FilterGreaterOrEqual, Attribute: "displayName", Value: "alice"},
+	} {
+		c, _, _ = d.newComputedSearch(filter, nil, &accessRights{all: true}, nil)
+		assert.True(t, c.match(alice), "%v", filter)
+	}
+}
+
+func TestFrontend_handleSearchBinaryAttributes(t *testing.T) {
+	withLdapServerAndClient(t, []string{"jpegPhoto", "userCertificate"}, func(t *testing.T, backend *testBackend, client *ldap.Conn) {
+		photo := "\xff\xd8\xff\x00\xe0"
+		certificate := "\x30\x82\x01\x0a\x00"
+		backend.listResult = []*types.Result{
+			{Rdn: "jdoe", Attributes: map[string][]string{"cn": {"jdoe"}, "jpegPhoto": {photo}, "userCertificate": {certificate}}},
+		}
 
-type testBackend struct {
-	username   string
-	password   string
-	bindResult bool
+		res, err := client.Search(&ldap.SearchRequest{
+			BaseDN:     "ou=People,dc=example,dc=com",
+			Scope:      ldap.ScopeSingleLevel,
+			Filter:     "(userCertificate;binary=*)",
+			Attributes: []string{"jpegPhoto", "userCertificate;binary"},
+		})
+		if assert.NoError(t, err) && assert.Len(t, res.Entries, 1) {
+			assert.Equal(t, [][]byte{[]byte(photo)}, res.Entries[0].GetRawAttributeValues("jpegPhoto"))
+			// certificates are transferred with the binary option
+			assert.Equal(t, [][]byte{[]byte(certificate)}, res.Entries[0].GetRawAttributeValues("userCertificate;binary"))
+			assert.Empty(t, res.Entries[0].GetRawAttributeValues("userCertificate"))
+		}
 
-	attributes   []string
-	searchResult []types.Result
+		assert.Equal(t, &types.Filter{Type: types.FilterPresent, Attribute: "userCertificate"}, backend.filter)
+		assert.Equal(t, []string{"cn", "jpegPhoto", "userCertificate"}, backend.attributes)
+	})
+
+	// the columns of groups are transferred like the ones of users
+	withLdapServerAndClient(t, nil, func(t *testing.T, backend *testBackend, client *ldap.Conn) {
+		certificate := "\x30\x82\x01\x0a\x00"
+		backend.groupResult = []*types.Result{
+			{Rdn: "admins", Attributes: map[string][]string{"cn": {"admins"}, "userCertificate": {certificate}}},
+		}
+
+		res, err := client.Search(&ldap.SearchRequest{
+			BaseDN:     "ou=Groups,dc=example,dc=com",
+			Scope:      ldap.ScopeSingleLevel,
+			Filter:     "(cn=admins)",
+			Attributes: []string{"userCertificate;binary"},
+		})
+		if assert.NoError(t, err) && assert.Len(t, res.Entries, 1) {
+			assert.Equal(t, [][]byte{[]byte(certificate)}, res.Entries[0].GetRawAttributeValues("userCertificate;binary"))
+			assert.Empty(t, res.Entries[0].GetRawAttributeValues("userCertificate"))
+		}
+	}, WithGroups("ou=Groups,dc=example,dc=com", "cn", []string{"userCertificate"}))
 }
 
-func (t *testBackend) Authenticate(username string, password string) bool {
-	t.username = username
-	t.password = password
+func TestFrontend_handleSearchOperationalAttributes(t *testing.T) {
+	withLdapServerAndClient(t, []string{"mail", "createTimestamp", "modifyTimestamp"}, func(t *testing.T, backend *testBackend, client *ldap.Conn) {
+		backend.listResult = []*types.Result{
+			{Rdn: "jdoe", Attributes: map[string][]string{"cn": {"jdoe"}}},
+		}
+
+		search := func(filter string, attributes ...string) {
+			_, err := client.Search(&ldap.SearchRequest{
+				BaseDN:     "ou=People,dc=example,dc=com",
+				Scope:      ldap.ScopeSingleLevel,
+				Filter:     filter,
+				Attributes: attributes,
+			})
+			assert.NoError(t, err)
+		}
+
+		// operational attributes are only listed if they are selected
+		search("(cn=*)")
+		assert.Equal(t, []string{"mail"}, backend.attributes)
+
+		search("(cn=*)", "*", "createTimestamp")
+		assert.Equal(t, []string{"cn", "mail", "createTimestamp"}, backend.attributes)
 
-	return t.bindResult
+		search("(cn=*)", "+")
+		assert.Equal(t, []string{"cn", "createTimestamp", "modifyTimestamp"}, backend.attributes)
+
+		// assertions with values which are no timestamps are undefined
+		search("(|(createTimestamp>=20261018120000Z)(modifyTimestamp<=yesterday)(modifyTimestamp=*))")
+		assert.Equal(t, &types.Filter{
+			Type: types.FilterOr,
+			Children: []*types.Filter{
+				{Type: types.FilterGreaterOrEqual, Attribute: "createTimestamp", Value: "20261018120000Z"},
+				{Type: types.FilterFalse},
+				{Type: types.FilterPresent, Attribute: "modifyTimestamp"},
+			},
+		}, backend.filter)
+	})
 }
 
-func (t *testBackend) Search(user string, attributes []string) []types.Result {
-	t.username = user
-	t.attributes = attributes
+func TestDirectory_timestampAttributes(t *testing.T) {
+	d := newDirectory("ou=People,dc=example,dc=com", "cn", []string{"passwordExpiresAt"}, nil)
+	WithTimestampAttributes([]string{"passwordExpiresAt"})(d)
+	other := newDirectory("ou=Other,dc=example,dc=com", "cn", []string{"passwordExpiresAt"}, nil)
 
-	return t.searchResult
+	// the attributes are only timestamps of the directory they are configured for
+	assert.True(t, d.isTimestampAttribute("passwordexpiresat"))
+	assert.False(t, other.isTimestampAttribute("passwordExpiresAt"))
+	assert.Contains(t, d.attributeTypeDefinition("passwordExpiresAt"), "SYNTAX "+generalizedTimeSyntax)
+	assert.NotContains(t, other.attributeTypeDefinition("passwordExpiresAt"), "SYNTAX "+generalizedTimeSyntax)
+
+	assert.Equal(t, &types.Filter{Type: types.FilterLessOrEqual, Attribute: "passwordExpiresAt", Value: "20261101000000Z"}, d.convertUserAssertion(types.FilterLessOrEqual, "passwordExpiresAt", "2026110100Z"))
+	assert.Equal(t, &types.Filter{Type: types.FilterFalse}, d.convertUserAssertion(types.FilterLessOrEqual, "passwordExpiresAt", "tomorrow"))
+	assert.Equal(t, &types.Filter{Type: types.FilterLessOrEqual, Attribute: "passwordExpiresAt", Value: "tomorrow"}, other.convertUserAssertion(types.FilterLessOrEqual, "passwordExpiresAt", "tomorrow"))
 }
 
-func TestFrontend_handleBind(t *testing.T) {
+func TestFrontend_handleGroupSearch(t *testing.T) {
 	withLdapServerAndClient(t, nil, func(t *testing.T, backend *testBackend, client *ldap.Conn) {
-		backend.bindResult = true
-		err := client.Bind("cn=username,ou=People,dc=example,dc=com", "password")
+		backend.groupResult = []*types.Result{
+			{Rdn: "admins", Attributes: map[string][]string{"cn": {"admins"}, "member": {"alice", "bob"}, "gidNumber": {"1000"}}},
+		}
+
+		res, err := client.Search(&ldap.SearchRequest{
+			BaseDN: "ou=Groups,dc=example,dc=com",
+			Scope:  ldap.ScopeSingleLevel,
+			Filter: "(&(objectClass=groupOfNames)(member=cn=alice,ou=People,dc=example,dc=com))",
+		})
+
+		if !assert.NoError(t, err) || !assert.Len(t, res.Entries, 1) {
+			return
+		}
+
+		assert.Equal(t, &types.Filter{
+			Type: types.FilterAnd,
+			Children: []*types.Filter{
+				{Type: types.FilterTrue},
+				{Type: types.FilterEqual, Attribute: "member", Value: "alice"},
+			},
+		}, backend.filter)
+		assert.Equal(t, []string{"cn", "member", "gidNumber"}, backend.attributes)
+
+		entry := res.Entries[0]
+		assert.Equal(t, "cn=admins,ou=Groups,dc=example,dc=com", entry.DN)
+		assert.Equal(t, []string{"cn=alice,ou=People,dc=example,dc=com", "cn=bob,ou=People,dc=example,dc=com"}, entry.GetAttributeValues("member"))
+		assert.Equal(t, []string{"cn=alice,ou=People,dc=example,dc=com", "cn=bob,ou=People,dc=example,dc=com"}, entry.GetAttributeValues("uniqueMember"))
+		assert.Equal(t, []string{"alice", "bob"}, entry.GetAttributeValues("memberUid"))
+		assert.Equal(t, []string{"1000"}, entry.GetAttributeValues("gidNumber"))
+		assert.Equal(t, []string{"top", "groupOfNames", "posixGroup"}, entry.GetAttributeValues("objectClass"))
+
+		_, err = client.Search(&ldap.SearchRequest{
+			BaseDN:     "cn=admins,ou=Groups,dc=example,dc=com",
+			Scope:      ldap.ScopeBaseObject,
+			Filter:     "(|(memberUid=bob)(member=cn=bob,ou=Other,dc=example,dc=com))",
+			Attributes: []string{"memberUid"},
+		})
+
 		assert.NoError(t, err)
-		assert.Equal(t, "username", backend.username)
-		assert.Equal(t, "password", backend.password)
+		assert.Equal(t, &types.Filter{
+			Type: types.FilterAnd,
+			Children: []*types.Filter{
+				{Type: types.FilterEqual, Attribute: "cn", Value: "admins"},
+				{Type: types.FilterOr, Children: []*types.Filter{
+					{Type: types.FilterEqual, Attribute: "member", Value: "bob"},
+					{Type: types.FilterFalse},
+				}},
+			},
+		}, backend.filter)
+		assert.Equal(t, []string{"cn", "member"}, backend.attributes)
 
-		backend.bindResult = false
-		err = client.Bind("cn=username,ou=People,dc=example,dc=com", "password")
-		assert.EqualError(t, err, "LDAP Result Code 49 \"Invalid Credentials\": ")
-	})
+		// attribute names are case insensitive and * selects all attributes
+		for attributes, columns := range map[string][]string{"*": {"cn", "member", "gidNumber"}, "MEMBER objectclass": {"cn", "member"}} {
+			res, err = client.Search(&ldap.SearchRequest{
+				BaseDN:     "ou=Groups,dc=example,dc=com",
+				Scope:      ldap.ScopeSingleLevel,
+				Filter:     "(uniquemember=cn=bob,ou=People,dc=example,dc=com)",
+				Attributes: strings.Fields(attributes),
+			})
+
+			if !assert.NoError(t, err) || !assert.Len(t, res.Entries, 1) {
+				return
+			}
+
+			entry = res.Entries[0]
+			assert.Equal(t, &types.Filter{Type: types.FilterEqual, Attribute: "member", Value: "bob"}, backend.filter)
+			assert.Equal(t, columns, backend.attributes)
+			assert.Equal(t, []string{"cn=alice,ou=People,dc=example,dc=com", "cn=bob,ou=People,dc=example,dc=com"}, entry.GetAttributeValues("member"))
+			assert.Equal(t, []string{"top", "groupOfNames", "posixGroup"}, entry.GetAttributeValues("objectClass"))
+		}
+	}, WithGroups("ou=Groups,dc=example,dc=com", "cn", []string{"gidNumber"}))
 }
 
-func TestFrontend_handleUserSearch(t *testing.T) {
-	withLdapServerAndClient(t, []string{"attr1", "attr2", "attr3"}, func(t *testing.T, backend *testBackend, client *ldap.Conn) {
-		result, err := client.Search(&ldap.SearchRequest{
+func TestFrontend_handleObjectClassSearch(t *testing.T) {
+	withLdapServerAndClient(t, []string{"sn", "mail"}, func(t *testing.T, backend *testBackend, client *ldap.Conn) {
+		backend.listResult = []*types.Result{
+			{Rdn: "alice", Attributes: map[string][]string{"cn": {"alice"}, "sn": {"Smith"}}},
+		}
+
+		res, err := client.Search(&ldap.SearchRequest{
 			BaseDN: "ou=People,dc=example,dc=com",
-			Filter: "(objectClass=*)",
+			Scope:  ldap.ScopeSingleLevel,
+			Filter: "(&(objectClass=InetOrgPerson)(!(objectClass=posixAccount)))",
+		})
+
+		if !assert.NoError(t, err) || !assert.Len(t, res.Entries, 1) {
+			return
+		}
+
+		assert.Equal(t, &types.Filter{
+			Type: types.FilterAnd,
+			Children: []*types.Filter{
+				{Type: types.FilterTrue},
+				{Type: types.FilterNot, Children: []*types.Filter{{Type: types.FilterFalse}}},
+			},
+		}, backend.filter)
+		assert.Equal(t, []string{"top", "person", "organizationalPerson", "inetOrgPerson"}, res.Entries[0].GetAttributeValues("objectClass"))
+
+		res, err = client.Search(&ldap.SearchRequest{
+			BaseDN:     "ou=People,dc=example,dc=com",
+			Scope:      ldap.ScopeSingleLevel,
+			Filter:     "(mail=*)",
+			Attributes: []string{"sn"},
 		})
 
-		assert.EqualError(t, err, "LDAP Result Code 16 \"No Such Attribute\": ")
+		if !assert.NoError(t, err) || !assert.Len(t, res.Entries, 1) {
+			return
+		}
 
-		backend.searchResult = []types.Result{
-			{
-				Attributes: map[string]string{
-					"cn":    "abc",
-					"attr2": "def",
-					"attr3": "ghi",
-				},
+		assert.Empty(t, res.Entries[0].GetAttributeValues("objectClass"))
+	}, WithObjectClasses([]string{"inetOrgPerson"}))
+}
+
+func TestFrontend_CheckSchema(t *testing.T) {
+	tests := []struct {
+		name       string
+		attributes []string
+		options    []Option
+		errorMsg   string
+	}{
+		{
+			name: "Defaults",
+		},
+		{
+			name:       "Required attributes served",
+			attributes: []string{"surname", "mail"},
+			options:    []Option{WithObjectClasses([]string{"inetOrgPerson"})},
+		},
+		{
+			name:       "Required attribute missing",
+			attributes: []string{"uid", "uidNumber", "gidNumber"},
+			options:    []Option{WithObjectClasses([]string{"posixAccount"})},
+			errorMsg:   "users of ou=People,dc=example,dc=com: object class 'posixAccount' requires the attribute 'homeDirectory'",
+		},
+		{
+			name:     "Unknown object class",
+			options:  []Option{WithObjectClasses([]string{"account"})},
+			errorMsg: "users of ou=People,dc=example,dc=com: unknown object class 'account'",
+		},
+		{
+			name:    "Default group object classes",
+			options: []Option{WithGroups("ou=Groups,dc=example,dc=com", "cn", nil)},
+		},
+		{
+			name: "Group attribute missing",
+			options: []Option{
+				WithGroups("ou=Groups,dc=example,dc=com", "cn", nil),
+				WithGroupObjectClasses([]string{"posixGroup"}),
 			},
+			errorMsg: "groups of ou=Groups,dc=example,dc=com: object class 'posixGroup' requires the attribute 'gidNumber'",
+		},
+		{
+			name:       "Dn attribute",
+			attributes: []string{"memberOf"},
+			options:    []Option{WithDnAttributes([]types.DnAttribute{{Attribute: "memberOf", Template: "cn={},ou=Groups,dc=example,dc=com"}})},
+		},
+		{
+			name:       "Invalid dn template",
+			attributes: []string{"memberOf"},
+			options:    []Option{WithDnAttributes([]types.DnAttribute{{Attribute: "memberOf", Template: "ou=Groups,cn={}"}})},
+			errorMsg:   "users of ou=People,dc=example,dc=com: dn attribute 'memberOf': template 'ou=Groups,cn={}' must start with an rdn valued '{}'",
+		},
+		{
+			name:       "Computed attribute",
+			attributes: []string{"givenName", "sn"},
+			options:    []Option{WithComputedAttributes([]types.ComputedAttribute{{Attribute: "displayName", Template: "{givenName} {sn}"}})},
+		},
+		{
+			name:       "Computed attribute of unknown attribute",
+			attributes: []string{"sn"},
+			options:    []Option{WithComputedAttributes([]types.ComputedAttribute{{Attribute: "displayName", Template: "{givenName} {sn}"}})},
+			errorMsg:   "users of ou=People,dc=example,dc=com: computed attribute 'displayName': template '{givenName} {sn}' references 'givenName', which is not served",
+		},
+		{
+			name:       "Computed attribute served",
+			attributes: []string{"sn"},
+			options:    []Option{WithComputedAttributes([]types.ComputedAttribute{{Attribute: "surname", Template: "{cn}"}})},
+			errorMsg:   "users of ou=People,dc=example,dc=com: computed attribute 'surname' is served by the backend",
+		},
+		{
+			name:    "Naming contexts",
+			options: []Option{WithNamingContext("ou=Staff,dc=example,dc=org", "uid", nil, &testBackend{}, WithGroups("ou=Groups,dc=example,dc=org", "cn", nil))},
+		},
+		{
+			name:     "Nested naming context",
+			options:  []Option{WithNamingContext("ou=Staff,ou=People,dc=example,dc=com", "uid", nil, &testBackend{})},
+			errorMsg: "the trees of ou=People,dc=example,dc=com and ou=Staff,ou=People,dc=example,dc=com overlap",
+		},
+		{
+			name:     "Groups of another naming context",
+			options:  []Option{WithGroups("ou=Groups,dc=example,dc=com", "cn", nil), WithNamingContext("ou=Staff,dc=example,dc=org", "uid", nil, &testBackend{}, WithGroups("OU=Groups, DC=example,DC=com", "cn", nil))},
+			errorMsg: "the trees of ou=Groups,dc=example,dc=com and OU=Groups, DC=example,DC=com overlap",
+		},
+		{
+			name:     "Dn attribute not served",
+			options:  []Option{WithDnAttributes([]types.DnAttribute{{Attribute: "memberOf", Template: "cn={},ou=Groups,dc=example,dc=com"}})},
+			errorMsg: "users of ou=People,dc=example,dc=com: dn attribute 'memberOf' is not served",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := NewFrontend("127.0.0.1:0", tls.Certificate{}, "ou=People,dc=example,dc=com", "cn", test.attributes, &testBackend{}, test.options...)
+
+			err := f.CheckSchema()
+			if test.errorMsg == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, test.errorMsg)
+			}
+		})
+	}
+}
+
+func TestFrontend_handleRootDseSearch(t *testing.T) {
+	withLdapServerAndClient(t, []string{"mail", "custom"}, func(t *testing.T, backend *testBackend, client *ldap.Conn) {
+		res, err := client.Search(&ldap.SearchRequest{
+			BaseDN: "",
+			Scope:  ldap.ScopeBaseObject,
+			Filter: "(objectclass=TOP)",
+		})
+
+		if !assert.NoError(t, err) || !assert.Len(t, res.Entries, 1) {
+			return
 		}
 
-		result, err = client.Search(&ldap.SearchRequest{
-			BaseDN:     "ou=People,dc=example,dc=com",
-			Attributes: []string{"attr2", "attr3"},
-			Filter:     "(cn=abc)",
+		entry := res.Entries[0]
+		assert.Equal(t, "", entry.DN)
+		assert.Equal(t, []string{"ou=People,dc=example,dc=com", "ou=Groups,dc=example,dc=com"}, entry.GetAttributeValues("namingContexts"))
+		assert.Equal(t, []string{"3"}, entry.GetAttributeValues("supportedLDAPVersion"))
+		assert.Equal(t, []string{"cn=Subschema"}, entry.GetAttributeValues("subschemaSubentry"))
+
+		res, err = client.Search(&ldap.SearchRequest{
+			BaseDN:     "cn=Subschema",
+			Scope:      ldap.ScopeBaseObject,
+			Filter:     "(objectclass=SubSchema)",
+			Attributes: []string{"attributeTypes", "objectClasses"},
 		})
 
+		if !assert.NoError(t, err) || !assert.Len(t, res.Entries, 1) {
+			return
+		}
+
+		entry = res.Entries[0]
+		assert.Empty(t, entry.GetAttributeValues("cn"))
+		assert.Contains(t, entry.GetAttributeValues("attributeTypes"), "( 0.9.2342.19200300.100.1.3 NAME ( 'mail' 'rfc822Mailbox' ) EQUALITY caseIgnoreIA5Match SUBSTR caseIgnoreIA5SubstringsMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.26 )")
+		assert.Contains(t, entry.GetAttributeValues("attributeTypes"), "( custom-oid NAME 'custom' EQUALITY caseExactMatch SUBSTR caseIgnoreSubstringsMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.15 )")
+		assert.Contains(t, entry.GetAttributeValues("objectClasses"), "( 2.5.6.9 NAME 'groupOfNames' SUP top STRUCTURAL MUST ( member $ cn ) MAY description )")
+	}, WithGroups("ou=Groups,dc=example,dc=com", "cn", nil))
+}
+
+func TestFrontend_handleStartTls(t *testing.T) {
+	backend := &testBackend{bindResult: true}
+	frontend := NewFrontend("127.0.0.1:0", newTestCertificate(t), "ou=People,dc=example,dc=com", "cn", nil, backend, WithStartTls("127.0.0.1:0", true))
+	frontend.Serve()
+	defer frontend.Stop()
+
+	if !waitListenerReady(frontend.startTlsServer, 2*time.Second) {
+		t.Errorf("server not ready after 2 seconds")
+		return
+	}
+
+	client, err := ldap.Dial("tcp", frontend.startTlsServer.Listener.Addr().String())
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer client.Close()
+
+	err = client.Bind("cn=abc,ou=People,dc=example,dc=com", "password")
+	assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultConfidentialityRequired))
+
+	res, err := client.Search(&ldap.SearchRequest{Scope: ldap.ScopeBaseObject, Filter: "(objectClass=*)"})
+	if assert.NoError(t, err) && assert.Len(t, res.Entries, 1) {
+		assert.Contains(t, res.Entries[0].GetAttributeValues("supportedExtension"), "1.3.6.1.4.1.1466.20037")
+	}
+
+	err = client.StartTLS(&tls.Config{InsecureSkipVerify: true})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.NoError(t, client.Bind("cn=abc,ou=People,dc=example,dc=com", "password"))
+	assert.Equal(t, "abc", backend.username)
+}
+
+func TestFrontend_handleSearchAccess(t *testing.T) {
+	withLdapServerAndClient(t, []string{"mail", "secret"}, func(t *testing.T, backend *testBackend, client *ldap.Conn) {
+		backend.bindResult = true
+		backend.listResult = []*types.Result{
+			{Rdn: "abc", Attributes: map[string][]string{"cn": {"abc"}, "mail": {"abc@example.com"}}},
+		}
+
+		search := &ldap.SearchRequest{
+			BaseDN: "dc=example,dc=com",
+			Scope:  ldap.ScopeWholeSubtree,
+			Filter: "(|(mail=*)(secret=*))",
+		}
+
+		res, err := client.Search(search)
+		if assert.NoError(t, err) && assert.Len(t, res.Entries, 1) {
+			assert.Equal(t, "cn=abc,ou=People,dc=example,dc=com", res.Entries[0].DN)
+		}
+		assert.Equal(t, &types.Filter{
+			Type: types.FilterOr,
+			Children: []*types.Filter{
+				{Type: types.FilterPresent, Attribute: "mail"},
+				{Type: types.FilterFalse},
+			},
+		}, backend.filter)
+		assert.Equal(t, []string{"mail"}, backend.attributes)
+
+		err = client.Bind("cn=abc,ou=People,dc=example,dc=com", "password")
 		assert.NoError(t, err)
-		assert.Equal(t, "abc", backend.username)
-		assert.Equal(t, []string{"attr2", "attr3"}, backend.attributes)
-		assert.Len(t, result.Entries, 1)
-		assert.Equal(t, "cn=abc,ou=People,dc=example,dc=com", result.Entries[0].DN)
-		assert.Len(t, result.Entries[0].Attributes, 3)
-	})
+
+		_, err = client.Search(search)
+		assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultInsufficientAccessRights))
+
+		backend.bindResult = false
+		err = client.Bind("cn=abc,ou=People,dc=example,dc=com", "wrong")
+		assert.Error(t, err)
+
+		_, err = client.Search(search)
+		assert.True(t, ldap.IsErrorWithCode(err, ldap.LDAPResultInsufficientAccessRights))
+	}, WithAccessRules([]types.AccessRule{
+		{BindDn: testReaderDn, BaseDns: []string{"ou=People,dc=example,dc=com"}, Attributes: []string{"mail"}},
+	}))
+}
+
+func TestDirectory_userFromFilter(t *testing.T) {
+	d := &directory{
+		rDn: "cn",
+	}
+
+	tests := []struct {
+		name     string
+		filter   *types.Filter
+		result   string
+		errorMsg string
+	}{
+		{
+			name:   "Equality match",
+			filter: &types.Filter{Type: types.FilterEqual, Attribute: "cn", Value: "user1"},
+			result: "user1",
+		},
+		{
+			name: "Nested conjunction",
+			filter: &types.Filter{Type: types.FilterAnd, Children: []*types.Filter{
+				{Type: types.FilterPresent, Attribute: "mail"},
+				{Type: types.FilterAnd, Children: []*types.Filter{
+					{Type: types.FilterEqual, Attribute: "cn", Value: "user1"},
+				}},
+			}},
+			result: "user1",
+		},
+		{
+			name:     "Other attribute",
+			filter:   &types.Filter{Type: types.FilterEqual, Attribute: "mail", Value: "user1"},
+			errorMsg: "invalid rdn 'mail', should be 'cn'",
+		},
+		{
+			name: "Disjunction",
+			filter: &types.Filter{Type: types.FilterOr, Children: []*types.Filter{
+				{Type: types.FilterEqual, Attribute: "cn", Value: "user1"},
+			}},
+			errorMsg: "filter must select a user by 'cn'",
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			result, err := d.userFromFilter(test.filter)
+
+			if test.errorMsg != "" {
+				assert.EqualError(t, err, test.errorMsg)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, test.result, result)
+			}
+		})
+	}
 }
 
-func TestFrontend_userFromDn(t *testing.T) {
-	f := &Frontend{
+func TestDirectory_userFromDn(t *testing.T) {
+	d := &directory{
 		rDn:    "cn",
 		baseDn: "ou=People,dc=example,dc=com",
 	}
-	errorMsg := "dn must have a prefix of 'cn=' and suffix of ',ou=People,dc=example,dc=com'"
+	errorMsg := "dn must name an entry by 'cn' directly below 'ou=People,dc=example,dc=com'"
 
 	tests := []struct {
 		name     string
@@ -101,27 +1920,67 @@ func TestFrontend_userFromDn(t *testing.T) {
 			result: "user1",
 		},
 		{
-			name:     "Prefix missing",
+			name:   "Different case and spaces",
+			value:  "CN = user1 , OU=people,  DC=Example,dc=COM",
+			result: "user1",
+		},
+		{
+			name:   "Other name of the rdn attribute",
+			value:  "commonName=user1,ou=People,dc=example,dc=com",
+			result: "user1",
+		},
+		{
+			name:   "Escaped characters",
+			value:  `cn=Doe\, John\2B\c3\a4 \ ,ou=People,dc=example,dc=com`,
+			result: "Doe, John+\u00e4  ",
+		},
+		{
+			name:     "Invalid hex value",
+			value:    "cn=#0405757365723,ou=People,dc=example,dc=com",
+			errorMsg: "invalid dn 'cn=#0405757365723,ou=People,dc=example,dc=com': unsupported value '#0405757365723'",
+		},
+		{
+			name:   "BER encoded value",
+			value:  "cn=#04057573657231,ou=People,dc=example,dc=com",
+			result: "user1",
+		},
+		{
+			name:     "Rdn missing",
 			value:    "user1,ou=People,dc=example,dc=com",
+			errorMsg: "invalid dn 'user1,ou=People,dc=example,dc=com': invalid attribute type 'user1,ou'",
+		},
+		{
+			name:     "Other rdn attribute",
+			value:    "uid=user1,ou=People,dc=example,dc=com",
+			errorMsg: errorMsg,
+		},
+		{
+			name:     "Multi valued rdn",
+			value:    "cn=user1+uid=user1,ou=People,dc=example,dc=com",
 			errorMsg: errorMsg,
 		},
 		{
-			name:     "Suffix missing",
+			name:     "Base dn missing",
 			value:    "cn=user1",
 			errorMsg: errorMsg,
 		},
 		{
-			name:     "Prefix and suffix missing",
-			value:    "user1",
+			name:     "Below an entry",
+			value:    "cn=user1,cn=user2,ou=People,dc=example,dc=com",
 			errorMsg: errorMsg,
 		},
+		{
+			name:     "Rdn and base dn missing",
+			value:    "user1",
+			errorMsg: "invalid dn 'user1': missing '=' after 'user1'",
+		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
 			t.Parallel()
 
-			result, err := f.userFromDn(test.value)
+			result, err := d.userFromDn(test.value)
 
 			if test.errorMsg != "" {
 				assert.EqualError(t, err, test.errorMsg)
@@ -133,9 +1992,70 @@ func TestFrontend_userFromDn(t *testing.T) {
 	}
 }
 
-func withLdapServerAndClient(t *testing.T, attrs []string, inner func(t *testing.T, backend *testBackend, client *ldap.Conn)) {
+func TestDn(t *testing.T) {
+	assert.True(t, equalDn("cn=a+uid=B,dc=example", "UID=b + CN=A, DC=Example"))
+	assert.False(t, equalDn("cn=a,dc=example", "cn=a,dc=example,dc=com"))
+	assert.False(t, equalDn("cn=a,dc=example", "cn=a\\,dc=example"))
+	assert.False(t, equalDn("cn=a,dc=example", "cn=a,dc=example,"))
+
+	assert.True(t, isAncestor("", "dc=example"))
+	assert.True(t, isAncestor("DC=example", "ou=People,dc=example"))
+	assert.False(t, isAncestor("dc=example", "dc=example"))
+	assert.False(t, isAncestor("le", "ou=People,dc=example"))
+	assert.True(t, isParent("dc=example", "ou=People, dc=example"))
+	assert.False(t, isParent("dc=example", "cn=a,ou=People,dc=example"))
+
+	for _, value := range []string{"a", "Doe, John", " #x+y;z<>\"\\ ", "\x00"} {
+		dn := entryDn("cn", value, "ou=People,dc=example,dc=com")
+
+		result, err := valueFromDn(dn, "cn", "ou=People,dc=example,dc=com")
+		assert.NoError(t, err, dn)
+		assert.Equal(t, value, result, dn)
+	}
+	assert.Equal(t, "cn=Doe\\, John\\+\\ ,ou=People", entryDn("cn", "Doe, John+ ", "ou=People"))
+}
+
+func TestFrontend_handleNamingContexts(t *testing.T) {
+	staff := &testBackend{
+		bindResult: true,
+		listResult: []*types.Result{{Rdn: "jdoe", Attributes: map[string][]string{"mail": {"jdoe@example.org"}}}},
+	}
+
+	withLdapServerAndClient(t, []string{"mail"}, func(t *testing.T, backend *testBackend, client *ldap.Conn) {
+		backend.listResult = []*types.Result{{Rdn: "alice", Attributes: map[string][]string{"mail": {"alice@example.com"}}}}
+
+		res, err := client.Search(&ldap.SearchRequest{BaseDN: "ou=Staff,dc=example,dc=org", Scope: ldap.ScopeSingleLevel, Filter: "(mail=*)"})
+		if assert.NoError(t, err) && assert.Len(t, res.Entries, 1) {
+			assert.Equal(t, "uid=jdoe,ou=Staff,dc=example,dc=org", res.Entries[0].DN)
+		}
+
+		res, err = client.Search(&ldap.SearchRequest{BaseDN: "", Scope: ldap.ScopeWholeSubtree, Filter: "(mail=*)"})
+		if assert.NoError(t, err) && assert.Len(t, res.Entries, 2) {
+			assert.Equal(t, "cn=alice,ou=People,dc=example,dc=com", res.Entries[0].DN)
+			assert.Equal(t, "uid=jdoe,ou=Staff,dc=example,dc=org", res.Entries[1].DN)
+		}
+
+		res, err = client.Search(&ldap.SearchRequest{BaseDN: "", Scope: ldap.ScopeBaseObject, Filter: "(objectClass=*)", Attributes: []string{"namingContexts"}})
+		if assert.NoError(t, err) && assert.Len(t, res.Entries, 1) {
+			assert.Equal(t, []string{"ou=People,dc=example,dc=com", "ou=Staff,dc=example,dc=org"}, res.Entries[0].GetAttributeValues("namingContexts"))
+		}
+
+		assert.NoError(t, client.Bind("uid=jdoe,ou=Staff,dc=example,dc=org", "password"))
+		assert.Equal(t, "jdoe", staff.username)
+		assert.Equal(t, "", backend.username)
+	}, WithNamingContext("ou=Staff,dc=example,dc=org", "uid", []string{"mail"}, staff))
+}
+
+func withLdapServerAndClient(t *testing.T, attrs []string, inner func(t *testing.T, backend *testBackend, client *ldap.Conn), options ...Option) {
+	hash, err := password.Hash("secret")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	options = append([]Option{WithServiceAccounts([]types.ServiceAccount{{Dn: testReaderDn, Password: hash}})}, options...)
+
 	backend := &testBackend{}
-	frontend := NewFrontend("127.0.0.1:0", "ou=People,dc=example,dc=com", "cn", attrs, backend)
+	frontend := NewFrontend("127.0.0.1:0", newTestCertificate(t), "ou=People,dc=example,dc=com", "cn", attrs, backend, options...)
 	frontend.Serve()
 	defer frontend.Stop()
 
@@ -144,10 +2064,16 @@ func withLdapServerAndClient(t *testing.T, attrs []string, inner func(t *testing
 		return
 	}
 
-	client, err := ldap.Dial("tcp", frontend.server.Listener.Addr().String())
-	assert.Nil(t, err)
+	client, err := ldap.DialTLS("tcp", frontend.server.Listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if !assert.Nil(t, err) {
+		return
+	}
 	defer client.Close()
 
+	if !assert.NoError(t, client.Bind(testReaderDn, "secret")) {
+		return
+	}
+
 	inner(t, backend, client)
 }
 
@@ -187,3 +2113,25 @@ func waitListenerReady(server *ldapserver.Server, d time.Duration) bool {
 
 	return false
 }
+
+func newTestCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unexpected error generating key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Unexpected error creating certificate: %v", err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
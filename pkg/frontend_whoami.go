@@ -0,0 +1,22 @@
+package pkg
+
+import (
+	jww "github.com/spf13/jwalterweatherman"
+	ldap "github.com/vjeantet/ldapserver"
+)
+
+// handleWhoAmI answers the "Who am I?" extended operation (RFC 4532) with the
+// authorization identity of the connection, which is empty for anonymous
+// connections.
+func (f *Frontend) handleWhoAmI(w ldap.ResponseWriter, m *ldap.Message) {
+	s := f.session(m)
+
+	jww.INFO.Printf("Who am I? %v", s)
+
+	authzId := ""
+	if bindDn := s.BindDn(); bindDn != "" {
+		authzId = "dn:" + bindDn
+	}
+
+	writeExtendedResponse(w, ldap.NewExtendedResponse(ldap.LDAPResultSuccess), []byte(authzId))
+}
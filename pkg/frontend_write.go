@@ -0,0 +1,322 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gopenguin/minimal-ldap-proxy/pkg/password"
+	"github.com/gopenguin/minimal-ldap-proxy/types"
+	jww "github.com/spf13/jwalterweatherman"
+	"github.com/vjeantet/goldap/message"
+	ldap "github.com/vjeantet/ldapserver"
+)
+
+// userPasswordAttribute is hashed before it is passed to the backend.
+const userPasswordAttribute = "userPassword"
+
+// WithWriteOperations enables the add, modify and delete operations on the
+// users, which require the backend to be able to change users. Only the admins
+// may change entries.
+func WithWriteOperations(admins []string) FrontendOption {
+	return func(f *Frontend) {
+		f.writeOperations = true
+		f.writeAdmins = admins
+	}
+}
+
+func (f *Frontend) handleAdd(w ldap.ResponseWriter, m *ldap.Message) {
+	res := ldap.NewResponse(ldap.LDAPResultSuccess)
+	defer func() { w.Write(message.AddResponse(res)) }()
+
+	r := m.GetAddRequest()
+	dn := string(r.Entry())
+
+	bindDn, ok := f.writeAccess(m, &res, f.writeAdmins)
+	if !ok {
+		return
+	}
+
+	d, user, err := f.userDirectory(dn)
+	if err != nil {
+		res.SetResultCode(ldap.LDAPResultUnwillingToPerform)
+		res.SetDiagnosticMessage("only users can be added")
+		return
+	}
+
+	jww.INFO.Printf("Adding %s as %s", dn, bindDn)
+
+	attributes := make(map[string][]string)
+	for _, attribute := range r.Attributes() {
+		description := string(attribute.Type_())
+		// the object classes are given by the configuration
+		if strings.EqualFold(description, "objectClass") {
+			continue
+		}
+
+		name, ok := d.writableAttribute(description)
+		if !ok {
+			res.SetResultCode(ldap.LDAPResultUndefinedAttributeType)
+			res.SetDiagnosticMessage(fmt.Sprintf("unknown attribute '%s'", description))
+			return
+		}
+
+		// the rdn value is given by the dn
+		if name == d.rDn {
+			for _, value := range attribute.Vals() {
+				if !equalityMatch(name, string(value), user) {
+					res.SetResultCode(ldap.LDAPResultNamingViolation)
+					res.SetDiagnosticMessage(fmt.Sprintf("value of '%s' differs from the dn", description))
+					return
+				}
+			}
+			continue
+		}
+
+		for _, v := range attribute.Vals() {
+			value, err := d.dnValue(name, string(v))
+			if err != nil {
+				res.SetResultCode(ldap.LDAPResultInvalidAttributeSyntax)
+				res.SetDiagnosticMessage(err.Error())
+				return
+			}
+
+			value, err = storedValue(name, value)
+			if err != nil {
+				jww.ERROR.Printf("hash password: %v", err)
+				res.SetResultCode(ldap.LDAPResultOther)
+				return
+			}
+			attributes[name] = append(attributes[name], value)
+		}
+	}
+
+	if err := d.backend.Add(user, attributes); err != nil {
+		jww.WARN.Printf("add user: %v", err)
+		res.SetResultCode(writeResultCode(err))
+		res.SetDiagnosticMessage(err.Error())
+	}
+}
+
+func (f *Frontend) handleModify(w ldap.ResponseWriter, m *ldap.Message) {
+	res := ldap.NewResponse(ldap.LDAPResultSuccess)
+	defer func() { w.Write(message.ModifyResponse(res)) }()
+
+	r := m.GetModifyRequest()
+	dn := string(r.Object())
+
+	if f.lockout != nil && unlocksAccount(r) {
+		f.unlockAccount(m, &res, dn)
+		return
+	}
+	if !f.writeOperations {
+		res.SetResultCode(ldap.LDAPResultUnwillingToPerform)
+		res.SetDiagnosticMessage("only accounts can be unlocked")
+		return
+	}
+
+	bindDn, ok := f.writeAccess(m, &res, f.writeAdmins)
+	if !ok {
+		return
+	}
+
+	d, user, err := f.userDirectory(dn)
+	if err != nil {
+		res.SetResultCode(ldap.LDAPResultUnwillingToPerform)
+		res.SetDiagnosticMessage("only users can be modified")
+		return
+	}
+
+	jww.INFO.Printf("Modifying %s as %s", dn, bindDn)
+
+	var changes []types.Change
+	for _, change := range r.Changes() {
+		description := string(change.Modification().Type_())
+		if strings.EqualFold(description, "objectClass") {
+			res.SetResultCode(ldap.LDAPResultObjectClassModsProhibited)
+			return
+		}
+
+		name, ok := d.writableAttribute(description)
+		if !ok {
+			res.SetResultCode(ldap.LDAPResultUndefinedAttributeType)
+			res.SetDiagnosticMessage(fmt.Sprintf("unknown attribute '%s'", description))
+			return
+		}
+		if name == d.rDn {
+			res.SetResultCode(ldap.LDAPResultNotAllowedOnRDN)
+			return
+		}
+
+		// every value is changed on its own, a deletion without value removes
+		// all values and a replacement adds the values after the first one
+		operation := changeOperation(int(change.Operation()))
+		values := change.Modification().Vals()
+		if len(values) == 0 {
+			if operation == types.ChangeAdd {
+				res.SetResultCode(ldap.LDAPResultConstraintViolation)
+				res.SetDiagnosticMessage(fmt.Sprintf("no values to add to '%s'", description))
+				return
+			}
+			changes = append(changes, types.Change{Operation: operation, Attribute: name})
+			continue
+		}
+
+		for i, v := range values {
+			c := types.Change{Operation: operation, Attribute: name}
+			if operation == types.ChangeReplace && i > 0 {
+				c.Operation = types.ChangeAdd
+			}
+
+			value, err := d.dnValue(name, string(v))
+			if err != nil {
+				res.SetResultCode(ldap.LDAPResultInvalidAttributeSyntax)
+				res.SetDiagnosticMessage(err.Error())
+				return
+			}
+
+			switch {
+			case c.Operation != types.ChangeDelete:
+				value, err = storedValue(name, value)
+				if err != nil {
+					jww.ERROR.Printf("hash password: %v", err)
+					res.SetResultCode(ldap.LDAPResultOther)
+					return
+				}
+				c.Value = &value
+			case isPasswordAttribute(name):
+				// the stored password is a hash, which is verified like a bind
+				if ok, _ := d.backend.Authenticate(user, value); !ok {
+					res.SetResultCode(ldap.LDAPResultNoSuchAttribute)
+					res.SetDiagnosticMessage(fmt.Sprintf("attribute '%s' has no such value", description))
+					return
+				}
+			default:
+				c.Value = &value
+			}
+			changes = append(changes, c)
+		}
+	}
+
+	if err := d.backend.Modify(user, changes); err != nil {
+		jww.WARN.Printf("modify user: %v", err)
+		res.SetResultCode(writeResultCode(err))
+		res.SetDiagnosticMessage(err.Error())
+	}
+}
+
+func (f *Frontend) handleDelete(w ldap.ResponseWriter, m *ldap.Message) {
+	res := ldap.NewResponse(ldap.LDAPResultSuccess)
+	defer func() { w.Write(message.DelResponse(res)) }()
+
+	dn := string(m.GetDeleteRequest())
+
+	bindDn, ok := f.writeAccess(m, &res, f.writeAdmins)
+	if !ok {
+		return
+	}
+
+	d, user, err := f.userDirectory(dn)
+	if err != nil {
+		res.SetResultCode(ldap.LDAPResultUnwillingToPerform)
+		res.SetDiagnosticMessage("only users can be deleted")
+		return
+	}
+
+	jww.INFO.Printf("Deleting %s as %s", dn, bindDn)
+
+	if err := d.backend.Delete(user); err != nil {
+		jww.WARN.Printf("delete user: %v", err)
+		res.SetResultCode(writeResultCode(err))
+		res.SetDiagnosticMessage(err.Error())
+	}
+}
+
+// writeAccess checks that the connection is bound as one of the admins allowed
+// to change entries, otherwise the result tells why not.
+func (f *Frontend) writeAccess(m *ldap.Message, res *message.LDAPResult, admins []string) (bindDn string, ok bool) {
+	if !f.isConfidential(m) {
+		res.SetResultCode(ldap.LDAPResultConfidentialityRequired)
+		res.SetDiagnosticMessage("TLS is required, use StartTLS first")
+		return "", false
+	}
+
+	session := f.session(m)
+	bindDn = session.BindDn()
+	if bindDn == "" {
+		res.SetResultCode(ldap.LDAPResultInsufficientAccessRights)
+		res.SetDiagnosticMessage("authentication required, bind first")
+		return "", false
+	}
+	if session.MustChangePassword() {
+		res.SetResultCode(ldap.LDAPResultInsufficientAccessRights)
+		res.SetDiagnosticMessage(passwordChangeRequired)
+		return "", false
+	}
+
+	for _, admin := range admins {
+		if equalDn(admin, bindDn) {
+			return bindDn, true
+		}
+	}
+
+	jww.WARN.Printf("%s is not allowed to change entries", bindDn)
+	res.SetResultCode(ldap.LDAPResultInsufficientAccessRights)
+	res.SetDiagnosticMessage("insufficient access rights to change entries")
+	return "", false
+}
+
+// changeOperation returns the change operation of a modify request operation.
+func changeOperation(operation int) types.ChangeOperation {
+	switch operation {
+	case ldap.ModifyRequestChangeOperationAdd:
+		return types.ChangeAdd
+	case ldap.ModifyRequestChangeOperationDelete:
+		return types.ChangeDelete
+	default:
+		return types.ChangeReplace
+	}
+}
+
+// writeResultCode returns the result code of an error of a write operation of
+// the backend.
+func writeResultCode(err error) int {
+	switch {
+	case errors.Is(err, types.ErrNotConfigured), errors.Is(err, types.ErrSingleValue):
+		return ldap.LDAPResultUnwillingToPerform
+	case errors.Is(err, types.ErrNotFound):
+		return ldap.LDAPResultNoSuchObject
+	case errors.Is(err, types.ErrExists):
+		return ldap.LDAPResultEntryAlreadyExists
+	case errors.Is(err, types.ErrNoSuchValue):
+		return ldap.LDAPResultNoSuchAttribute
+	case errors.Is(err, types.ErrValueExists):
+		return ldap.LDAPResultAttributeOrValueExists
+	default:
+		return ldap.LDAPResultOperationsError
+	}
+}
+
+// writableAttribute returns the served name of an attribute the write
+// operations may change, i.e. of the rdn, the attributes and the password.
+func (d *directory) writableAttribute(attribute string) (name string, ok bool) {
+	if name, ok := d.userAttribute(attribute); ok {
+		return name, true
+	}
+
+	return attributeName([]string{userPasswordAttribute}, attribute)
+}
+
+// isPasswordAttribute tells whether the attribute is the password.
+func isPasswordAttribute(attribute string) bool {
+	return attributeKey(attribute) == attributeKey(userPasswordAttribute)
+}
+
+// storedValue returns the value passed to the backend, passwords are hashed.
+func storedValue(attribute string, value string) (string, error) {
+	if isPasswordAttribute(attribute) {
+		return password.Hash(value)
+	}
+
+	return value, nil
+}
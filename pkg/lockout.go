@@ -0,0 +1,412 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gopenguin/minimal-ldap-proxy/types"
+	sql "github.com/jmoiron/sqlx"
+	jww "github.com/spf13/jwalterweatherman"
+	"github.com/vjeantet/goldap/message"
+	ldap "github.com/vjeantet/ldapserver"
+)
+
+// accountLockedTimeAttribute is deleted to unlock an account, like in the
+// ppolicy overlay of OpenLDAP.
+const accountLockedTimeAttribute = "pwdAccountLockedTime"
+
+// WithLockout locks users out after repeated failed binds. The lockout is kept
+// in memory unless a store is passed.
+func WithLockout(policy types.LockoutPolicy, store types.LockoutStore) FrontendOption {
+	return func(f *Frontend) {
+		if store == nil {
+			store = newMemoryLockoutStore(time.Duration(policy.LockoutWindow) * time.Second)
+		}
+
+		f.lockout = newLockout(policy, store)
+	}
+}
+
+type lockout struct {
+	policy types.LockoutPolicy
+	store  types.LockoutStore
+
+	// mutex guards users, the locks of the users with binds in progress
+	mutex sync.Mutex
+	users map[string]*userLock
+}
+
+type userLock struct {
+	sync.Mutex
+	references int
+}
+
+func newLockout(policy types.LockoutPolicy, store types.LockoutStore) *lockout {
+	return &lockout{policy: policy, store: store, users: make(map[string]*userLock)}
+}
+
+// authenticate doesn't verify the passwords of locked out users, so they can't
+// be guessed.
+func (f *Frontend) authenticate(m *ldap.Message, d *directory, dn string, user string, password string) (bool, types.PasswordPolicy) {
+	if f.lockout == nil {
+		return d.backend.Authenticate(user, password)
+	}
+
+	var policy types.PasswordPolicy
+	authenticated, locked := f.lockout.verify(m, dn, func() bool {
+		var authenticated bool
+		authenticated, policy = d.backend.Authenticate(user, password)
+		return authenticated
+	}, func() bool {
+		return d.backend.Search(context.Background(), user, nil, []string{d.rDn}) != nil
+	})
+	if locked {
+		return false, types.PasswordPolicy{Locked: true, LockedOut: true}
+	}
+
+	return authenticated, policy
+}
+
+func (l *lockout) verify(m *ldap.Message, dn string, verify func() bool, exists func() bool) (authenticated bool, locked bool) {
+	user, source := l.key(m, dn)
+
+	unlock := l.lock(user)
+	defer unlock()
+
+	state, locked := l.locked(user, source)
+	if locked {
+		jww.INFO.Printf("%s is locked out until %s", user, state.LockedUntil.Format(time.RFC3339))
+		return false, true
+	}
+
+	if verify() {
+		l.succeeded(user, source, state)
+		return true, false
+	}
+
+	l.failed(user, source, state, exists)
+	return false, false
+}
+
+func (l *lockout) lock(user string) (unlock func()) {
+	l.mutex.Lock()
+	u, ok := l.users[user]
+	if !ok {
+		u = &userLock{}
+		l.users[user] = u
+	}
+	u.references++
+	l.mutex.Unlock()
+
+	u.Lock()
+
+	return func() {
+		u.Unlock()
+
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+
+		u.references--
+		if u.references == 0 {
+			delete(l.users, user)
+		}
+	}
+}
+
+func (l *lockout) key(m *ldap.Message, dn string) (user string, source string) {
+	if l.policy.LockoutPerSourceIp {
+		source = clientIp(m)
+	}
+
+	return normalizedDn(dn), source
+}
+
+// locked doesn't lock the user out if the state can't be loaded.
+func (l *lockout) locked(user string, source string) (state types.LockoutState, locked bool) {
+	state, err := l.store.Load(user, source)
+	if err != nil {
+		jww.ERROR.Printf("load lockout of %s: %v", user, err)
+		return types.LockoutState{}, false
+	}
+
+	return state, time.Now().Before(state.LockedUntil)
+}
+
+// failed counts the failures of existing accounts only, so binds with made up
+// dns don't fill the store.
+func (l *lockout) failed(user string, source string, state types.LockoutState, exists func() bool) {
+	now := time.Now()
+	if state.Failures == 0 || now.Sub(state.Since) > time.Duration(l.policy.LockoutWindow)*time.Second {
+		if !exists() {
+			return
+		}
+	}
+
+	state, err := l.store.Fail(user, source, now)
+	if err != nil {
+		jww.ERROR.Printf("count failed bind of %s: %v", user, err)
+		return
+	}
+
+	if state.Failures >= l.policy.LockoutFailures {
+		jww.WARN.Printf("Locking %s out after %d failed binds", user, state.Failures)
+		state = types.LockoutState{LockedUntil: now.Add(time.Duration(l.policy.LockoutDuration) * time.Second)}
+	}
+
+	if err := l.store.Save(user, source, state); err != nil {
+		jww.ERROR.Printf("save lockout of %s: %v", user, err)
+	}
+}
+
+func (l *lockout) succeeded(user string, source string, state types.LockoutState) {
+	if state.Failures == 0 && state.LockedUntil.IsZero() {
+		return
+	}
+
+	if err := l.store.Save(user, source, types.LockoutState{}); err != nil {
+		jww.ERROR.Printf("save lockout of %s: %v", user, err)
+	}
+}
+
+func unlocksAccount(r message.ModifyRequest) bool {
+	if len(r.Changes()) == 0 {
+		return false
+	}
+
+	for _, change := range r.Changes() {
+		description := string(change.Modification().Type_())
+		deletion := int(change.Operation()) == ldap.ModifyRequestChangeOperationDelete ||
+			(int(change.Operation()) == ldap.ModifyRequestChangeOperationReplace && len(change.Modification().Vals()) == 0)
+
+		if !strings.EqualFold(description, accountLockedTimeAttribute) || !deletion {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (f *Frontend) unlockAccount(m *ldap.Message, res *message.LDAPResult, dn string) {
+	bindDn, ok := f.writeAccess(m, res, f.passwordAdmins)
+	if !ok {
+		return
+	}
+
+	_, _, err := f.userDirectory(dn)
+	if _, ok := f.serviceAccount(dn); err != nil && !ok {
+		res.SetResultCode(ldap.LDAPResultUnwillingToPerform)
+		res.SetDiagnosticMessage("only users and service accounts can be unlocked")
+		return
+	}
+
+	user, _ := f.lockout.key(m, dn)
+	jww.INFO.Printf("Unlocking %s as %s", user, bindDn)
+
+	unlock := f.lockout.lock(user)
+	defer unlock()
+
+	if err := f.lockout.store.Unlock(user); err != nil {
+		jww.WARN.Printf("unlock user: %v", err)
+		res.SetResultCode(ldap.LDAPResultOperationsError)
+		res.SetDiagnosticMessage(err.Error())
+	}
+}
+
+type memoryLockoutStore struct {
+	window time.Duration
+
+	mutex  sync.Mutex
+	states map[string]map[string]types.LockoutState
+	pruned time.Time
+}
+
+func newMemoryLockoutStore(window time.Duration) *memoryLockoutStore {
+	return &memoryLockoutStore{window: window, states: make(map[string]map[string]types.LockoutState), pruned: time.Now()}
+}
+
+func (s *memoryLockoutStore) Load(user string, source string) (types.LockoutState, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.states[user][source], nil
+}
+
+func (s *memoryLockoutStore) Fail(user string, source string, now time.Time) (types.LockoutState, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	state := s.states[user][source]
+	if state.Failures == 0 || now.Sub(state.Since) > s.window {
+		state = types.LockoutState{Since: now}
+	}
+	state.Failures++
+	s.store(user, source, state)
+
+	return state, nil
+}
+
+func (s *memoryLockoutStore) Save(user string, source string, state types.LockoutState) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if state == (types.LockoutState{}) {
+		s.delete(user, source)
+		return nil
+	}
+	s.store(user, source, state)
+
+	return nil
+}
+
+func (s *memoryLockoutStore) store(user string, source string, state types.LockoutState) {
+	now := time.Now()
+	if now.Sub(s.pruned) >= s.window {
+		s.prune(now)
+	}
+
+	if s.states[user] == nil {
+		s.states[user] = make(map[string]types.LockoutState)
+	}
+	s.states[user][source] = state
+}
+
+func (s *memoryLockoutStore) prune(now time.Time) {
+	for user, sources := range s.states {
+		for source, state := range sources {
+			if now.After(state.LockedUntil) && now.Sub(state.Since) > s.window {
+				s.delete(user, source)
+			}
+		}
+	}
+
+	s.pruned = now
+}
+
+func (s *memoryLockoutStore) delete(user string, source string) {
+	delete(s.states[user], source)
+	if len(s.states[user]) == 0 {
+		delete(s.states, user)
+	}
+}
+
+func (s *memoryLockoutStore) Unlock(user string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.states, user)
+
+	return nil
+}
+
+// NewLockoutStore persists the lockout in a database, so it is shared by
+// several proxies.
+func NewLockoutStore(driver string, conn string, policy types.LockoutPolicy) (types.LockoutStore, error) {
+	if policy.LockoutQuery == "" || policy.LockoutFailQuery == "" || policy.LockoutUpdateQuery == "" || policy.UnlockQuery == "" {
+		return nil, fmt.Errorf("the lockout, lockout fail, lockout update and unlock queries are required")
+	}
+
+	db, err := sql.Open(driver, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sqlLockoutStore{
+		db:          db,
+		window:      time.Duration(policy.LockoutWindow) * time.Second,
+		loadQuery:   policy.LockoutQuery,
+		failQuery:   policy.LockoutFailQuery,
+		updateQuery: policy.LockoutUpdateQuery,
+		unlockQuery: policy.UnlockQuery,
+	}, nil
+}
+
+type sqlLockoutStore struct {
+	db     *sql.DB
+	window time.Duration
+
+	loadQuery   string
+	failQuery   string
+	updateQuery string
+	unlockQuery string
+}
+
+func (s *sqlLockoutStore) Load(user string, source string) (types.LockoutState, error) {
+	return s.queryState(s.loadQuery, map[string]interface{}{"user": user, "source": source})
+}
+
+// Fail counts the failure in a single statement, so concurrent proxies don't
+// lose failures.
+func (s *sqlLockoutStore) Fail(user string, source string, now time.Time) (types.LockoutState, error) {
+	return s.queryState(s.failQuery, map[string]interface{}{
+		"user":        user,
+		"source":      source,
+		"since":       now.Unix(),
+		"windowStart": now.Add(-s.window).Unix(),
+	})
+}
+
+func (s *sqlLockoutStore) queryState(query string, args map[string]interface{}) (types.LockoutState, error) {
+	var state types.LockoutState
+
+	rows, err := s.db.NamedQuery(query, args)
+	if err != nil {
+		return state, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return state, rows.Err()
+	}
+
+	values, err := rows.SliceScan()
+	if err != nil {
+		return state, err
+	}
+	if len(values) != 3 {
+		return state, fmt.Errorf("the lockout queries must return failures, since and lockedUntil, got %d columns", len(values))
+	}
+
+	state.Failures = columnInt(values[0])
+	state.Since = unixTime(columnInt(values[1]))
+	state.LockedUntil = unixTime(columnInt(values[2]))
+
+	return state, nil
+}
+
+func (s *sqlLockoutStore) Save(user string, source string, state types.LockoutState) error {
+	_, err := s.db.NamedExec(s.updateQuery, map[string]interface{}{
+		"user":        user,
+		"source":      source,
+		"failures":    state.Failures,
+		"since":       unixTimestamp(state.Since),
+		"lockedUntil": unixTimestamp(state.LockedUntil),
+	})
+
+	return err
+}
+
+func (s *sqlLockoutStore) Unlock(user string) error {
+	_, err := s.db.NamedExec(s.unlockQuery, map[string]interface{}{"user": user})
+
+	return err
+}
+
+// the zero time is stored as 0
+func unixTime(timestamp int) time.Time {
+	if timestamp <= 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(int64(timestamp), 0)
+}
+
+func unixTimestamp(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return t.Unix()
+}
@@ -0,0 +1,165 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/gopenguin/minimal-ldap-proxy/types"
+	sql "github.com/jmoiron/sqlx"
+)
+
+// queryBuilder wraps a configured query as sub query and appends conditions
+// compiled from a search filter. The arguments of the wrapped query are
+// repeated for every occurrence, unless the driver uses numbered placeholders
+// which can be referenced more than once. Entries are identified by the value
+// of the rdn column.
+type queryBuilder struct {
+	query    string
+	args     []interface{}
+	numbered bool
+	rdn      string
+	// column returns the column holding an attribute, the attribute itself
+	// if it is nil
+	column func(attribute string) string
+	// argument returns the parameter of an assertion value, the value itself
+	// if it is nil
+	argument func(attribute string, value string) interface{}
+
+	buf    bytes.Buffer
+	params []interface{}
+}
+
+func newQueryBuilder(driver string, query string, rdn string, args ...interface{}) *queryBuilder {
+	return &queryBuilder{
+		query:    query,
+		args:     args,
+		numbered: sql.BindType(driver) == sql.DOLLAR,
+		rdn:      rdn,
+	}
+}
+
+func (q *queryBuilder) writeQuery() {
+	q.buf.WriteString("(")
+	q.buf.WriteString(q.query)
+	q.buf.WriteString(")")
+
+	if !q.numbered {
+		q.params = append(q.params, q.args...)
+	}
+}
+
+func (q *queryBuilder) writeParam(value interface{}) {
+	q.params = append(q.params, value)
+
+	if q.numbered {
+		fmt.Fprintf(&q.buf, "$%d", len(q.args)+len(q.params))
+	} else {
+		q.buf.WriteString("?")
+	}
+}
+
+// writeFilter compiles the filter into a condition on the rows of the entries
+// sub query. Every assertion is checked with an EXISTS sub query correlated by
+// the rdn, so an entry matches if any of its rows (i.e. any value of a multi
+// valued attribute) satisfies it.
+func (q *queryBuilder) writeFilter(filter *types.Filter) {
+	switch filter.Type {
+	case types.FilterAnd, types.FilterOr:
+		op := " AND "
+		if filter.Type == types.FilterOr {
+			op = " OR "
+		}
+
+		q.buf.WriteString("(")
+		for i, child := range filter.Children {
+			if i > 0 {
+				q.buf.WriteString(op)
+			}
+			q.writeFilter(child)
+		}
+		q.buf.WriteString(")")
+	case types.FilterNot:
+		q.buf.WriteString("NOT (")
+		q.writeFilter(filter.Children[0])
+		q.buf.WriteString(")")
+	case types.FilterTrue:
+		q.buf.WriteString("1 = 1")
+	case types.FilterFalse:
+		q.buf.WriteString("1 = 0")
+	default:
+		q.buf.WriteString("EXISTS (SELECT 1 FROM ")
+		q.writeQuery()
+		q.buf.WriteString(" AS candidates WHERE candidates." + q.rdn + " = entries." + q.rdn + " AND ")
+		q.writeAssertion(filter)
+		q.buf.WriteString(")")
+	}
+}
+
+// writeAssertion compares the column of the attribute like the equality rule
+// of the attribute, which ignores the case of most directory strings.
+func (q *queryBuilder) writeAssertion(filter *types.Filter) {
+	column := filter.Attribute
+	if q.column != nil {
+		column = q.column(filter.Attribute)
+	}
+
+	switch filter.Type {
+	case types.FilterEqual:
+		if ignoresCase(filter.Attribute) {
+			q.buf.WriteString("LOWER(" + column + ") = LOWER(")
+			q.writeParam(filter.Value)
+			q.buf.WriteString(")")
+		} else {
+			q.buf.WriteString(column + " = ")
+			q.writeParam(q.value(filter.Attribute, filter.Value))
+		}
+	case types.FilterApprox:
+		q.buf.WriteString("LOWER(" + column + ") = LOWER(")
+		q.writeParam(filter.Value)
+		q.buf.WriteString(")")
+	case types.FilterGreaterOrEqual:
+		q.buf.WriteString(column + " >= ")
+		q.writeParam(q.value(filter.Attribute, filter.Value))
+	case types.FilterLessOrEqual:
+		q.buf.WriteString(column + " <= ")
+		q.writeParam(q.value(filter.Attribute, filter.Value))
+	case types.FilterPresent:
+		q.buf.WriteString(column + " IS NOT NULL")
+	case types.FilterSubstrings:
+		q.buf.WriteString("LOWER(" + column + ") LIKE LOWER(")
+		q.writeParam(likePattern(filter))
+		q.buf.WriteString(") ESCAPE '!'")
+	}
+}
+
+func (q *queryBuilder) value(attribute string, value string) interface{} {
+	if q.argument != nil {
+		return q.argument(attribute, value)
+	}
+
+	return value
+}
+
+func (q *queryBuilder) build() (string, []interface{}) {
+	if q.numbered {
+		return q.buf.String(), append(append([]interface{}{}, q.args...), q.params...)
+	}
+
+	return q.buf.String(), q.params
+}
+
+func likePattern(filter *types.Filter) string {
+	pattern := escapeLike(filter.Initial) + "%"
+	for _, any := range filter.Any {
+		pattern += escapeLike(any) + "%"
+	}
+
+	return pattern + escapeLike(filter.Final)
+}
+
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+func escapeLike(value string) string {
+	return likeEscaper.Replace(value)
+}
@@ -0,0 +1,240 @@
+package pkg
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gopenguin/minimal-ldap-proxy/types"
+	jww "github.com/spf13/jwalterweatherman"
+	ldap "github.com/vjeantet/ldapserver"
+)
+
+// The delays of operations exceeding a rate limit if none are configured.
+const (
+	defaultTarpitDelay    = 500 * time.Millisecond
+	defaultMaxTarpitDelay = 10 * time.Second
+)
+
+const rateLimitExceeded = "rate limit exceeded, try again later"
+
+// WithRateLimits delays or refuses binds and searches exceeding the rate
+// limits, the trusted networks are verified by CheckRateLimits.
+func WithRateLimits(limits types.RateLimits) FrontendOption {
+	return func(f *Frontend) {
+		f.rateLimiter = newRateLimiter(limits)
+	}
+}
+
+type rateLimiter struct {
+	limits  types.RateLimits
+	trusted []trustedNetwork
+
+	tarpitDelay    time.Duration
+	maxTarpitDelay time.Duration
+
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+	pruned  time.Time
+}
+
+type trustedNetwork struct {
+	network *net.IPNet
+	rate    float64
+	burst   int
+}
+
+func newRateLimiter(limits types.RateLimits) *rateLimiter {
+	l := &rateLimiter{
+		limits:         limits,
+		tarpitDelay:    time.Duration(limits.TarpitDelay) * time.Millisecond,
+		maxTarpitDelay: time.Duration(limits.MaxTarpitDelay) * time.Millisecond,
+		buckets:        make(map[string]*tokenBucket),
+	}
+
+	if l.tarpitDelay <= 0 {
+		l.tarpitDelay = defaultTarpitDelay
+	}
+	if l.maxTarpitDelay <= 0 {
+		l.maxTarpitDelay = defaultMaxTarpitDelay
+	}
+
+	var err error
+	if l.trusted, err = trustedNetworks(limits.TrustedNetworks); err != nil {
+		jww.ERROR.Printf("Ignoring trusted networks: %v", err)
+	}
+
+	return l
+}
+
+func CheckRateLimits(limits types.RateLimits) error {
+	_, err := trustedNetworks(limits.TrustedNetworks)
+	return err
+}
+
+func trustedNetworks(networks []types.TrustedNetwork) ([]trustedNetwork, error) {
+	var trusted []trustedNetwork
+	for _, t := range networks {
+		_, network, err := net.ParseCIDR(t.Cidr)
+		if err != nil {
+			return nil, fmt.Errorf("trusted network: %w", err)
+		}
+
+		trusted = append(trusted, trustedNetwork{network: network, rate: t.RateLimit, burst: t.RateBurst})
+	}
+
+	return trusted, nil
+}
+
+// tarpit delays the operation of a client or user exceeding the rate limit, ok
+// is false if it is refused or abandoned while delayed.
+func (f *Frontend) tarpit(m *ldap.Message, operation string, user string) (ok bool) {
+	if f.rateLimiter == nil {
+		return true
+	}
+
+	address := clientIp(m)
+	delay, ok := f.rateLimiter.delay(address, user, time.Now())
+	if !ok {
+		jww.INFO.Printf("Refusing %s of %s, rate limit exceeded", operation, address)
+		return false
+	}
+
+	if delay > 0 {
+		jww.INFO.Printf("Delaying %s of %s by %v, rate limit exceeded", operation, address, delay)
+		if !waitDelay(delay, m.Done) {
+			jww.INFO.Printf("Delayed %s of %s abandoned", operation, address)
+			return false
+		}
+	}
+
+	return true
+}
+
+func waitDelay(delay time.Duration, abandoned <-chan bool) (ok bool) {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-abandoned:
+		return false
+	}
+}
+
+func (l *rateLimiter) delay(address string, user string, now time.Time) (delay time.Duration, ok bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.prune(now)
+
+	rate, burst := l.addressLimit(address)
+	delay, ok = l.take("address "+address, rate, burst, now)
+	if !ok || user == "" {
+		return delay, ok
+	}
+
+	userDelay, ok := l.take("user "+normalizedDn(user), l.limits.UserRateLimit, l.limits.UserRateBurst, now)
+	if userDelay > delay {
+		delay = userDelay
+	}
+
+	return delay, ok
+}
+
+func (l *rateLimiter) addressLimit(address string) (rate float64, burst int) {
+	if ip := net.ParseIP(address); ip != nil {
+		for _, trusted := range l.trusted {
+			if trusted.network.Contains(ip) {
+				return trusted.rate, trusted.burst
+			}
+		}
+	}
+
+	return l.limits.RateLimit, l.limits.RateBurst
+}
+
+// take doubles the delay while the bucket is empty, operations are refused
+// beyond the maximum delay and while another one is delayed.
+func (l *rateLimiter) take(key string, rate float64, burst int, now time.Time) (delay time.Duration, ok bool) {
+	if rate <= 0 {
+		return 0, true
+	}
+	// the bucket holds at least the tokens of a second
+	if burst <= 0 {
+		burst = int(math.Max(1, math.Ceil(rate)))
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		l.buckets[key] = b
+	}
+	b.rate = rate
+	b.burst = burst
+
+	exceeded := b.take(now)
+	if exceeded == 0 {
+		return 0, true
+	}
+	if now.Before(b.delayedUntil) {
+		return 0, false
+	}
+
+	delay = l.tarpitDelay
+	for i := 1; i < exceeded && delay <= l.maxTarpitDelay; i++ {
+		delay *= 2
+	}
+	if delay > l.maxTarpitDelay {
+		return 0, false
+	}
+
+	b.delayedUntil = now.Add(delay)
+	return delay, true
+}
+
+func (l *rateLimiter) prune(now time.Time) {
+	if now.Sub(l.pruned) < time.Minute {
+		return
+	}
+	l.pruned = now
+
+	for key, b := range l.buckets {
+		if b.refill(now); b.tokens >= float64(b.burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+type tokenBucket struct {
+	rate         float64
+	burst        int
+	tokens       float64
+	last         time.Time
+	exceeded     int
+	delayedUntil time.Time
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(float64(b.burst), b.tokens+elapsed*b.rate)
+		b.last = now
+	}
+}
+
+// take returns the number of operations exceeding the limit in a row.
+func (b *tokenBucket) take(now time.Time) int {
+	b.refill(now)
+
+	if b.tokens >= 1 {
+		b.tokens--
+		b.exceeded = 0
+		return 0
+	}
+
+	b.exceeded++
+	return b.exceeded
+}
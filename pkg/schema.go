@@ -0,0 +1,394 @@
+package pkg
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// attributeTypeDefinitions are keyed by all lower case names of the attributes
+var attributeTypeDefinitions = map[string]string{}
+
+var objectClassDefinitions = map[string]string{}
+
+func init() {
+	for _, definition := range []string{
+		"( 2.5.4.0 NAME 'objectClass' EQUALITY objectIdentifierMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.38 )",
+		"( 2.5.4.3 NAME ( 'cn' 'commonName' ) EQUALITY caseIgnoreMatch SUBSTR caseIgnoreSubstringsMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.15 )",
+		"( 2.5.4.4 NAME ( 'sn' 'surname' ) EQUALITY caseIgnoreMatch SUBSTR caseIgnoreSubstringsMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.15 )",
+		"( 2.5.4.42 NAME ( 'givenName' 'gn' ) EQUALITY caseIgnoreMatch SUBSTR caseIgnoreSubstringsMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.15 )",
+		"( 2.5.4.11 NAME ( 'ou' 'organizationalUnitName' ) EQUALITY caseIgnoreMatch SUBSTR caseIgnoreSubstringsMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.15 )",
+		"( 2.5.4.12 NAME 'title' EQUALITY caseIgnoreMatch SUBSTR caseIgnoreSubstringsMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.15 )",
+		"( 2.5.4.13 NAME 'description' EQUALITY caseIgnoreMatch SUBSTR caseIgnoreSubstringsMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.15 )",
+		"( 2.5.4.20 NAME 'telephoneNumber' EQUALITY telephoneNumberMatch SUBSTR telephoneNumberSubstringsMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.50 )",
+		"( 2.5.4.35 NAME 'userPassword' EQUALITY octetStringMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.40 )",
+		"( 2.5.4.31 NAME 'member' EQUALITY distinguishedNameMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.12 )",
+		"( 2.5.4.50 NAME 'uniqueMember' EQUALITY uniqueMemberMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.34 )",
+		"( 2.16.840.1.113730.3.1.241 NAME 'displayName' EQUALITY caseIgnoreMatch SUBSTR caseIgnoreSubstringsMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.15 SINGLE-VALUE )",
+		"( 0.9.2342.19200300.100.1.1 NAME ( 'uid' 'userid' ) EQUALITY caseIgnoreMatch SUBSTR caseIgnoreSubstringsMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.15 )",
+		"( 0.9.2342.19200300.100.1.3 NAME ( 'mail' 'rfc822Mailbox' ) EQUALITY caseIgnoreIA5Match SUBSTR caseIgnoreIA5SubstringsMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.26 )",
+		"( 0.9.2342.19200300.100.1.25 NAME ( 'dc' 'domainComponent' ) EQUALITY caseIgnoreIA5Match SUBSTR caseIgnoreIA5SubstringsMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.26 SINGLE-VALUE )",
+		"( 1.3.6.1.1.1.1.0 NAME 'uidNumber' EQUALITY integerMatch ORDERING integerOrderingMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.27 SINGLE-VALUE )",
+		"( 1.3.6.1.1.1.1.1 NAME 'gidNumber' EQUALITY integerMatch ORDERING integerOrderingMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.27 SINGLE-VALUE )",
+		"( 2.16.840.1.113730.3.1.3 NAME 'employeeNumber' EQUALITY caseIgnoreMatch SUBSTR caseIgnoreSubstringsMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.15 SINGLE-VALUE )",
+		"( 1.3.6.1.1.1.1.2 NAME 'gecos' EQUALITY caseIgnoreIA5Match SUBSTR caseIgnoreIA5SubstringsMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.26 SINGLE-VALUE )",
+		"( 1.3.6.1.1.1.1.3 NAME 'homeDirectory' EQUALITY caseExactIA5Match SYNTAX 1.3.6.1.4.1.1466.115.121.1.26 SINGLE-VALUE )",
+		"( 1.3.6.1.1.1.1.4 NAME 'loginShell' EQUALITY caseExactIA5Match SYNTAX 1.3.6.1.4.1.1466.115.121.1.26 SINGLE-VALUE )",
+		"( 0.9.2342.19200300.100.1.10 NAME 'manager' EQUALITY distinguishedNameMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.12 )",
+		"( 1.2.840.113556.1.2.102 NAME 'memberOf' EQUALITY distinguishedNameMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.12 )",
+		"( 1.3.6.1.1.1.1.12 NAME 'memberUid' EQUALITY caseExactIA5Match SUBSTR caseExactIA5SubstringsMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.26 )",
+		"( 0.9.2342.19200300.100.1.60 NAME 'jpegPhoto' EQUALITY octetStringMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.28 )",
+		"( 2.5.4.36 NAME 'userCertificate' EQUALITY certificateExactMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.8 )",
+		"( 2.5.18.1 NAME 'createTimestamp' EQUALITY generalizedTimeMatch ORDERING generalizedTimeOrderingMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.24 SINGLE-VALUE NO-USER-MODIFICATION USAGE directoryOperation )",
+		"( 2.5.18.2 NAME 'modifyTimestamp' EQUALITY generalizedTimeMatch ORDERING generalizedTimeOrderingMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.24 SINGLE-VALUE NO-USER-MODIFICATION USAGE directoryOperation )",
+		"( 1.3.6.1.4.1.42.2.27.8.1.16 NAME 'pwdChangedTime' EQUALITY generalizedTimeMatch ORDERING generalizedTimeOrderingMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.24 SINGLE-VALUE NO-USER-MODIFICATION USAGE directoryOperation )",
+	} {
+		for _, name := range definitionNames(definition) {
+			attributeTypeDefinitions[strings.ToLower(name)] = definition
+		}
+	}
+
+	for _, definition := range []string{
+		"( 2.5.6.0 NAME 'top' ABSTRACT MUST objectClass )",
+		"( 2.5.6.6 NAME 'person' SUP top STRUCTURAL MUST ( sn $ cn ) MAY ( userPassword $ telephoneNumber $ description ) )",
+		"( 2.5.6.7 NAME 'organizationalPerson' SUP person STRUCTURAL MAY ( title $ ou $ telephoneNumber $ description ) )",
+		"( 2.16.840.1.113730.3.2.2 NAME 'inetOrgPerson' SUP organizationalPerson STRUCTURAL MAY ( displayName $ employeeNumber $ givenName $ mail $ uid ) )",
+		"( 1.3.6.1.1.1.2.0 NAME 'posixAccount' SUP top AUXILIARY MUST ( cn $ uid $ uidNumber $ gidNumber $ homeDirectory ) MAY ( userPassword $ loginShell $ gecos $ description ) )",
+		"( 2.5.6.9 NAME 'groupOfNames' SUP top STRUCTURAL MUST ( member $ cn ) MAY description )",
+		"( 2.5.6.17 NAME 'groupOfUniqueNames' SUP top STRUCTURAL MUST ( uniqueMember $ cn ) MAY description )",
+		"( 1.3.6.1.1.1.2.2 NAME 'posixGroup' SUP top AUXILIARY MUST gidNumber MAY ( memberUid $ description ) )",
+	} {
+		for _, name := range definitionNames(definition) {
+			objectClassDefinitions[strings.ToLower(name)] = definition
+		}
+	}
+}
+
+func definitionNames(definition string) []string {
+	i := strings.Index(definition, " NAME ")
+	if i < 0 {
+		return nil
+	}
+
+	names := definition[i+len(" NAME "):]
+	if strings.HasPrefix(names, "(") {
+		names = names[1:strings.Index(names, ")")]
+	} else {
+		names = names[:strings.Index(names[1:], "'")+2]
+	}
+
+	var result []string
+	for _, name := range strings.Fields(names) {
+		result = append(result, strings.Trim(name, "'"))
+	}
+
+	return result
+}
+
+func definitionList(definition string, keyword string) []string {
+	i := strings.Index(definition, " "+keyword+" ")
+	if i < 0 {
+		return nil
+	}
+
+	list := definition[i+len(keyword)+2:]
+	if strings.HasPrefix(list, "(") {
+		list = list[1:strings.Index(list, ")")]
+	} else {
+		list = strings.Fields(list)[0]
+	}
+
+	var result []string
+	for _, name := range strings.Split(list, "$") {
+		result = append(result, strings.TrimSpace(name))
+	}
+
+	return result
+}
+
+func requiredAttributes(objectClass string) ([]string, error) {
+	definition, ok := objectClassDefinitions[strings.ToLower(objectClass)]
+	if !ok {
+		return nil, fmt.Errorf("unknown object class '%s'", objectClass)
+	}
+
+	attributes := definitionList(definition, "MUST")
+	for _, superclass := range definitionList(definition, "SUP") {
+		inherited, err := requiredAttributes(superclass)
+		if err != nil {
+			return nil, err
+		}
+
+		attributes = append(attributes, inherited...)
+	}
+
+	return attributes, nil
+}
+
+func withSuperclasses(objectClasses []string) []string {
+	var result []string
+
+	var add func(objectClass string)
+	add = func(objectClass string) {
+		for _, superclass := range definitionList(objectClassDefinitions[strings.ToLower(objectClass)], "SUP") {
+			add(superclass)
+		}
+
+		for _, c := range result {
+			if strings.EqualFold(c, objectClass) {
+				return
+			}
+		}
+		result = append(result, objectClass)
+	}
+
+	for _, objectClass := range objectClasses {
+		add(objectClass)
+	}
+
+	return result
+}
+
+// attributeTypeDefinition describes unknown attributes as directory strings.
+func attributeTypeDefinition(name string) string {
+	name = withoutBinaryOption(name)
+	if definition, ok := attributeTypeDefinitions[strings.ToLower(name)]; ok {
+		return definition
+	}
+
+	return fmt.Sprintf("( %s-oid NAME '%s' EQUALITY caseExactMatch SUBSTR caseIgnoreSubstringsMatch SYNTAX 1.3.6.1.4.1.1466.115.121.1.15 )", name, name)
+}
+
+func attributeName(served []string, attribute string) (name string, ok bool) {
+	for _, name := range served {
+		if strings.EqualFold(name, withoutBinaryOption(attribute)) {
+			return name, true
+		}
+	}
+
+	definition := attributeTypeDefinition(attribute)
+	for _, name := range served {
+		if attributeTypeDefinition(name) == definition {
+			return name, true
+		}
+	}
+
+	return "", false
+}
+
+// withoutBinaryOption keeps other options, they describe subtypes (RFC 4512).
+func withoutBinaryOption(attribute string) string {
+	parts := strings.Split(attribute, ";")
+
+	description := parts[0]
+	for _, option := range parts[1:] {
+		if !strings.EqualFold(option, "binary") {
+			description += ";" + option
+		}
+	}
+
+	return description
+}
+
+// binaryTransferSyntaxes require the ';binary' option (RFC 4522).
+var binaryTransferSyntaxes = map[string]bool{
+	"1.3.6.1.4.1.1466.115.121.1.5":  true, // Binary
+	"1.3.6.1.4.1.1466.115.121.1.8":  true, // Certificate
+	"1.3.6.1.4.1.1466.115.121.1.9":  true, // Certificate List
+	"1.3.6.1.4.1.1466.115.121.1.10": true, // Certificate Pair
+}
+
+func isBinaryAttribute(attribute string) bool {
+	syntax := definitionField(attributeTypeDefinition(attribute), "SYNTAX")
+	return binaryTransferSyntaxes[syntax] || syntax == "1.3.6.1.4.1.1466.115.121.1.28" // JPEG
+}
+
+func binaryTransferName(attribute string) string {
+	if binaryTransferSyntaxes[definitionField(attributeTypeDefinition(attribute), "SYNTAX")] {
+		return withoutBinaryOption(attribute) + ";binary"
+	}
+
+	return attribute
+}
+
+// generalizedTimeSyntax is the syntax of timestamps (RFC 4517, section 3.3.13).
+const generalizedTimeSyntax = "1.3.6.1.4.1.1466.115.121.1.24"
+
+func checkTimestampAttribute(attribute string) error {
+	definition, ok := attributeTypeDefinitions[strings.ToLower(withoutBinaryOption(attribute))]
+	if ok && !isTimestampAttribute(attribute) {
+		return fmt.Errorf("attribute '%s' is a standard attribute of another syntax: %s", attribute, definition)
+	}
+
+	return nil
+}
+
+func timestampAttributeTypeDefinition(attribute string) string {
+	if isTimestampAttribute(attribute) {
+		return attributeTypeDefinition(attribute)
+	}
+
+	return fmt.Sprintf("( %s-oid NAME '%s' EQUALITY generalizedTimeMatch ORDERING generalizedTimeOrderingMatch SYNTAX %s )", attribute, attribute, generalizedTimeSyntax)
+}
+
+func isTimestampAttribute(attribute string) bool {
+	return definitionField(attributeTypeDefinition(attribute), "SYNTAX") == generalizedTimeSyntax
+}
+
+// operational attributes are only returned if selected (RFC 4512, section 3.4)
+func isOperationalAttribute(attribute string) bool {
+	usage := definitionField(attributeTypeDefinition(attribute), "USAGE")
+	return usage != "" && usage != "userApplications"
+}
+
+// fractions after the seconds are accepted by the time package
+var generalizedTimeLayouts = []string{
+	"20060102150405Z0700",
+	"200601021504Z0700",
+	"2006010215Z0700",
+	"20060102150405Z07",
+	"200601021504Z07",
+	"2006010215Z07",
+}
+
+func parseGeneralizedTime(value string) (time.Time, error) {
+	for _, layout := range generalizedTimeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("invalid generalized time '%s'", value)
+}
+
+func attributeKey(attribute string) string {
+	return strings.ToLower(attributeTypeDefinition(attribute))
+}
+
+// equalityMatch compares exactly for unknown rules.
+func equalityMatch(attribute string, a string, b string) bool {
+	a, b = prepareValue(a), prepareValue(b)
+
+	if ignoresCase(attribute) {
+		return strings.EqualFold(a, b)
+	}
+
+	switch equalityRule(attributeTypeDefinition(attribute)) {
+	case "integerMatch":
+		x, errX := strconv.ParseInt(a, 10, 64)
+		y, errY := strconv.ParseInt(b, 10, 64)
+		if errX != nil || errY != nil {
+			return a == b
+		}
+
+		return x == y
+	case "distinguishedNameMatch", "uniqueMemberMatch":
+		return a == b || equalDn(a, b)
+	case "generalizedTimeMatch":
+		x, errX := parseGeneralizedTime(a)
+		y, errY := parseGeneralizedTime(b)
+		if errX != nil || errY != nil {
+			return a == b
+		}
+
+		return x.Equal(y)
+	default:
+		return a == b
+	}
+}
+
+func ignoresCase(attribute string) bool {
+	switch equalityRule(attributeTypeDefinition(attribute)) {
+	case "caseIgnoreMatch", "caseIgnoreIA5Match", "objectIdentifierMatch":
+		return true
+	default:
+		return false
+	}
+}
+
+func equalityRule(definition string) string {
+	return definitionField(definition, "EQUALITY")
+}
+
+var orderingRules = map[string]string{
+	"caseignoreorderingmatch": "caseIgnoreOrderingMatch",
+	"2.5.13.3":                "caseIgnoreOrderingMatch",
+	"caseexactorderingmatch":  "caseExactOrderingMatch",
+	"2.5.13.6":                "caseExactOrderingMatch",
+	"integerorderingmatch":    "integerOrderingMatch",
+	"2.5.13.15":               "integerOrderingMatch",
+
+	"generalizedtimeorderingmatch": "generalizedTimeOrderingMatch",
+	"2.5.13.28":                    "generalizedTimeOrderingMatch",
+}
+
+// attributes without ordering use the one of their equality rule
+func orderingRule(attribute string) string {
+	definition := attributeTypeDefinition(attribute)
+	if rule := definitionField(definition, "ORDERING"); rule != "" {
+		return rule
+	}
+
+	switch equalityRule(definition) {
+	case "caseIgnoreMatch", "caseIgnoreIA5Match":
+		return "caseIgnoreOrderingMatch"
+	case "integerMatch":
+		return "integerOrderingMatch"
+	default:
+		return "caseExactOrderingMatch"
+	}
+}
+
+func orderingCompare(rule string, a string, b string) int {
+	a, b = prepareValue(a), prepareValue(b)
+
+	switch rule {
+	case "caseIgnoreOrderingMatch":
+		return strings.Compare(strings.ToLower(a), strings.ToLower(b))
+	case "integerOrderingMatch":
+		x, errX := strconv.ParseInt(a, 10, 64)
+		y, errY := strconv.ParseInt(b, 10, 64)
+		if errX == nil && errY == nil {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			default:
+				return 0
+			}
+		}
+	case "generalizedTimeOrderingMatch":
+		x, errX := parseGeneralizedTime(a)
+		y, errY := parseGeneralizedTime(b)
+		if errX == nil && errY == nil {
+			switch {
+			case x.Before(y):
+				return -1
+			case x.After(y):
+				return 1
+			default:
+				return 0
+			}
+		}
+	}
+
+	return strings.Compare(a, b)
+}
+
+func definitionField(definition string, name string) string {
+	fields := strings.Fields(definition)
+	for i := 0; i < len(fields)-1; i++ {
+		if fields[i] == name {
+			return fields[i+1]
+		}
+	}
+
+	return ""
+}
+
+// prepareValue removes insignificant spaces (RFC 4518, section 2.6.1).
+func prepareValue(value string) string {
+	return strings.Join(strings.Fields(value), " ")
+}
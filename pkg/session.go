@@ -0,0 +1,175 @@
+package pkg
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	jww "github.com/spf13/jwalterweatherman"
+	ldap "github.com/vjeantet/ldapserver"
+)
+
+const (
+	authMethodAnonymous = "anonymous"
+	authMethodSimple    = "simple"
+)
+
+// session holds the state of a client connection.
+type session struct {
+	mutex sync.Mutex
+
+	// bindDn is the dn of the authenticated account, empty for anonymous
+	// connections
+	bindDn string
+	// authMethod and bindTime describe the last bind
+	authMethod string
+	bindTime   time.Time
+	// mustChangePassword is set if the password of the bound user has been
+	// reset, the session may only change it then
+	mustChangePassword bool
+	// tls is set if the connection is secured by TLS
+	tls bool
+	// pagedSearches holds the cursors of the unfinished paged searches keyed
+	// by their cookie
+	pagedSearches map[string]*pagedSearch
+	lastCookie    int
+
+	// writeMutex serializes the responses written to the connection
+	writeMutex sync.Mutex
+}
+
+func (s *session) BindDn() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.bindDn
+}
+
+// bind sets the authentication state, an empty dn makes the connection
+// anonymous.
+func (s *session) bind(bindDn string, authMethod string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.bindDn = bindDn
+	s.authMethod = authMethod
+	s.bindTime = time.Now()
+	s.mustChangePassword = false
+}
+
+// MustChangePassword checks if the bound user must change the password before
+// any other operation.
+func (s *session) MustChangePassword() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.mustChangePassword
+}
+
+func (s *session) requirePasswordChange(required bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.mustChangePassword = required
+}
+
+func (s *session) Tls() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.tls
+}
+
+func (s *session) setTls() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.tls = true
+}
+
+func (s *session) String() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.bindDn == "" {
+		return "anonymous"
+	}
+
+	return s.bindDn + " (" + s.authMethod + " bind at " + s.bindTime.Format(time.RFC3339) + ")"
+}
+
+// session returns the state of the connection the message was received on.
+// Connections are identified by the connection accepted by the listener, which
+// is wrapped when the connection is upgraded by StartTLS.
+func (f *Frontend) session(m *ldap.Message) *session {
+	key := m.Client.GetConn()
+	if tlsConn, ok := key.(*tls.Conn); ok {
+		key = tlsConn.NetConn()
+	}
+
+	f.sessionsMutex.Lock()
+	defer f.sessionsMutex.Unlock()
+
+	s, ok := f.sessions[key]
+	if !ok {
+		s = &session{authMethod: authMethodAnonymous, tls: isTls(m)}
+		f.sessions[key] = s
+	}
+
+	return s
+}
+
+// clientIp returns the address the message was sent from without the port.
+func clientIp(m *ldap.Message) string {
+	address := m.Client.Addr().String()
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+
+	return address
+}
+
+func (f *Frontend) closeSession(key net.Conn) {
+	f.sessionsMutex.Lock()
+	defer f.sessionsMutex.Unlock()
+
+	if s, ok := f.sessions[key]; ok {
+		jww.INFO.Printf("Connection from %s closed, was %v", key.RemoteAddr(), s)
+		delete(f.sessions, key)
+	}
+}
+
+// trackConnections wraps the listener of the server to discard the session of
+// a connection once it is closed.
+func (f *Frontend) trackConnections(s *ldap.Server) {
+	s.Listener = &trackingListener{Listener: s.Listener, frontend: f}
+}
+
+type trackingListener struct {
+	net.Listener
+	frontend *Frontend
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &trackedConn{Conn: conn, frontend: l.frontend}, nil
+}
+
+type trackedConn struct {
+	net.Conn
+	frontend *Frontend
+	once     sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		c.frontend.closeSession(c)
+	})
+
+	return c.Conn.Close()
+}
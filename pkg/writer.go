@@ -0,0 +1,170 @@
+package pkg
+
+import (
+	"encoding/asn1"
+	"net"
+
+	jww "github.com/spf13/jwalterweatherman"
+	"github.com/vjeantet/goldap/message"
+	ldap "github.com/vjeantet/ldapserver"
+)
+
+// tagExtendedResponseValue is the context specific tag of the responseValue
+// of an extended response (RFC 4511, section 4.12), tagControls the one of the
+// controls of a message (RFC 4511, section 4.1.1).
+const (
+	tagExtendedResponseValue = 11
+	tagControls              = 0
+)
+
+// control is a response control (RFC 4511, section 4.1.11), the criticality
+// is omitted as it is only meaningful for request controls.
+type control struct {
+	ControlType  []byte
+	ControlValue []byte `asn1:"optional"`
+}
+
+// ServeLDAP implements ldap.Handler. It passes the messages to the router with
+// a response writer, which writes the responses synchronously to the
+// connection and supports the parts of responses ldapserver can not encode.
+// The writer of ldapserver is bypassed, so the notice of disconnection it
+// writes on shutdown is not serialized with the responses of this writer.
+func (f *Frontend) ServeLDAP(w ldap.ResponseWriter, m *ldap.Message) {
+	f.router.ServeLDAP(&responseWriter{
+		session:   f.session(m),
+		conn:      m.Client.GetConn,
+		messageID: m.MessageID().Int(),
+	}, m)
+}
+
+type responseWriter struct {
+	session   *session
+	conn      func() net.Conn
+	messageID int
+}
+
+func (w *responseWriter) Write(po message.ProtocolOp) {
+	w.write(po, nil, nil)
+}
+
+// write encodes the response, adding the response value of an extended
+// response if value is not nil and the controls.
+func (w *responseWriter) write(po message.ProtocolOp, value []byte, controls []control) {
+	data, err := encodeResponse(w.messageID, po, value, controls)
+	if err != nil {
+		jww.ERROR.Printf("encode response: %v", err)
+		return
+	}
+
+	w.session.writeMutex.Lock()
+	defer w.session.writeMutex.Unlock()
+
+	if _, err := w.conn().Write(data); err != nil {
+		jww.WARN.Printf("write response: %v", err)
+	}
+}
+
+// writeExtendedResponse writes an extended response including the response
+// value. Other writers than the one of ServeLDAP get the response without
+// value.
+func writeExtendedResponse(w ldap.ResponseWriter, res message.ExtendedResponse, value []byte) {
+	rw, ok := w.(*responseWriter)
+	if !ok {
+		jww.WARN.Printf("response writer %T can't write the response value", w)
+		w.Write(res)
+		return
+	}
+
+	rw.write(res, value, nil)
+}
+
+// replaceControl replaces the control of the same type, or adds it.
+func replaceControl(controls []control, c control) []control {
+	for i := range controls {
+		if string(controls[i].ControlType) == string(c.ControlType) {
+			controls[i] = c
+			return controls
+		}
+	}
+
+	return append(controls, c)
+}
+
+// writeWithControls writes a response including the controls. Other writers
+// than the one of ServeLDAP get the response without controls.
+func writeWithControls(w ldap.ResponseWriter, po message.ProtocolOp, controls ...control) {
+	rw, ok := w.(*responseWriter)
+	if !ok {
+		if len(controls) > 0 {
+			jww.WARN.Printf("response writer %T can't write the response controls", w)
+		}
+		w.Write(po)
+		return
+	}
+
+	rw.write(po, nil, controls)
+}
+
+func encodeResponse(messageID int, po message.ProtocolOp, value []byte, controls []control) ([]byte, error) {
+	m := message.NewLDAPMessageWithProtocolOp(po)
+	m.SetMessageID(messageID)
+
+	bytes, err := m.Write()
+	if err != nil {
+		return nil, err
+	}
+
+	if value == nil && len(controls) == 0 {
+		return bytes.Bytes(), nil
+	}
+
+	// LDAPMessage ::= SEQUENCE { messageID, protocolOp, controls [0] OPTIONAL }
+	var msg, id, op asn1.RawValue
+	if _, err := asn1.Unmarshal(bytes.Bytes(), &msg); err != nil {
+		return nil, err
+	}
+
+	rest, err := asn1.Unmarshal(msg.Bytes, &id)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := asn1.Unmarshal(rest, &op); err != nil {
+		return nil, err
+	}
+
+	opBytes := op.FullBytes
+	if value != nil {
+		responseValue, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: tagExtendedResponseValue, Bytes: value})
+		if err != nil {
+			return nil, err
+		}
+
+		opBytes, err = asn1.Marshal(asn1.RawValue{Class: op.Class, Tag: op.Tag, IsCompound: true, Bytes: append(op.Bytes, responseValue...)})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	contents := append(append([]byte{}, id.FullBytes...), opBytes...)
+
+	if len(controls) > 0 {
+		var controlsBytes []byte
+		for _, c := range controls {
+			controlBytes, err := asn1.Marshal(c)
+			if err != nil {
+				return nil, err
+			}
+
+			controlsBytes = append(controlsBytes, controlBytes...)
+		}
+
+		controlsBytes, err = asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: tagControls, IsCompound: true, Bytes: controlsBytes})
+		if err != nil {
+			return nil, err
+		}
+
+		contents = append(contents, controlsBytes...)
+	}
+
+	return asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSequence, IsCompound: true, Bytes: contents})
+}
@@ -0,0 +1,33 @@
+package types
+
+// FilterType identifies the kind of a Filter node.
+type FilterType int
+
+const (
+	FilterAnd FilterType = iota
+	FilterOr
+	FilterNot
+	FilterEqual
+	FilterSubstrings
+	FilterGreaterOrEqual
+	FilterLessOrEqual
+	FilterPresent
+	FilterApprox
+	FilterTrue
+	FilterFalse
+)
+
+// Filter is a search filter which is independent of the LDAP wire format, so
+// backends can translate it into their own query language.
+type Filter struct {
+	Type      FilterType
+	Attribute string
+	Value     string
+
+	// Initial, Any and Final hold the parts of a FilterSubstrings node
+	Initial string
+	Any     []string
+	Final   string
+
+	Children []*Filter
+}
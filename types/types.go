@@ -1,18 +1,213 @@
 package types
 
+import (
+	"context"
+	"errors"
+	"time"
+)
+
 type CmdConfig struct {
-	ServerAddress string
-	Cert          string
-	Key           string
+	ServerAddress   string
+	StartTlsAddress string
+	RequireTls      bool
+	Cert            string
+	Key             string
+
+	NamingContext `mapstructure:",squash"`
+	// NamingContexts are served in addition to the naming context of the
+	// top level configuration
+	NamingContexts []NamingContext
+
+	BindPolicy      `mapstructure:",squash"`
+	ServiceAccounts []ServiceAccount
+	AccessRules     []AccessRule
+
+	LockoutPolicy `mapstructure:",squash"`
+
+	PasswordAdmins []string
+	// WriteAdmins may add, modify and delete users
+	WriteAdmins []string
+
+	SearchLimits `mapstructure:",squash"`
+	RateLimits   `mapstructure:",squash"`
+}
+
+// NamingContext is a tree of users, and optionally of their groups, served from
+// its own backend.
+type NamingContext struct {
+	BackendConfig `mapstructure:",squash"`
+
+	BaseDn        string
+	Attributes    []string
+	ObjectClasses []string
+	DnAttributes  []DnAttribute
+	// ComputedAttributes are served in addition to the Attributes
+	ComputedAttributes []ComputedAttribute
+
+	GroupBaseDn        string
+	GroupAttributes    []string
+	GroupObjectClasses []string
+}
+
+// DnAttribute serves the values of an attribute as the dns of the entries they
+// name, e.g. group names as group dns. The Template is a dn whose first rdn
+// value is the placeholder '{}', e.g. 'cn={},ou=Groups,dc=example,dc=com'.
+type DnAttribute struct {
+	Attribute string
+	Template  string
+}
+
+// ComputedAttribute serves an attribute computed from the other attributes of
+// the users. The placeholders of the Template like '{sn}' are replaced by the
+// first value of the attributes they name, e.g. '/home/{uid}'. Users without
+// value of a referenced attribute have no value.
+type ComputedAttribute struct {
+	Attribute string
+	Template  string
+}
 
+type BackendConfig struct {
 	Driver string
 	Conn   string
 
 	AuthQuery   string
 	SearchQuery string
-	BaseDn      string
-	Attributes  []string
+	ListQuery   string
 	Rdn         string
+
+	GroupQuery string
+	GroupRdn   string
+
+	UpdatePasswordQuery string
+
+	// AddQuery, ModifyQueries and DeleteQuery enable the write operations on
+	// the users, they take the attributes as named parameters
+	AddQuery      string
+	ModifyQueries []ModifyQuery
+	DeleteQuery   string
+
+	// Mapping renames the columns of the queries to the attributes they hold
+	Mapping []ColumnMapping
+	// TimestampAttributes have the GeneralizedTime syntax besides the
+	// standard ones like createTimestamp
+	TimestampAttributes []string
+	// TimestampFormats declare the columns of timestamp attributes which do
+	// not hold times
+	TimestampFormats []TimestampFormat
+}
+
+// ColumnMapping serves a column of the queries as an attribute, which is
+// useful if the column names of the database differ from the attribute names.
+type ColumnMapping struct {
+	Column    string
+	Attribute string
+}
+
+// TimestampFormat declares how the column of a timestamp attribute stores the
+// times: 'unix' for unix timestamps or the layout of text in UTC, e.g.
+// '2006-01-02 15:04:05'. Filter values are converted to this format.
+type TimestampFormat struct {
+	Attribute string
+	Format    string
+}
+
+// ModifyQuery stores the value of an attribute, which is passed as the named
+// parameter of the attribute besides the rdn. A removed value is NULL.
+// Attributes with several values are stored value by value with AddQuery and
+// removed with DeleteQuery instead, which removes all values given NULL.
+type ModifyQuery struct {
+	Attribute   string
+	Query       string
+	AddQuery    string
+	DeleteQuery string
+}
+
+// BindPolicy decides about binds without password (RFC 4513, section 5.1),
+// which leave the connection anonymous: anonymous binds with an empty dn and
+// unauthenticated binds with a dn.
+type BindPolicy struct {
+	AllowAnonymousBind       bool
+	AllowUnauthenticatedBind bool
+	// AnonymousRootDse allows anonymous connections to read the root DSE and
+	// the subschema
+	AnonymousRootDse bool
+}
+
+// ServiceAccount is an account of the configuration instead of the backend,
+// e.g. for applications searching the directory.
+type ServiceAccount struct {
+	Dn string
+	// Password is a hash as accepted for the passwords of the backend
+	Password string
+}
+
+// AccessRule allows the account bound as BindDn, or every account if it is
+// "*", to search the trees below BaseDns and to read the Attributes of their
+// entries. Without attributes all attributes are readable.
+type AccessRule struct {
+	BindDn     string
+	BaseDns    []string
+	Attributes []string
+}
+
+// LockoutPolicy locks the account of a user for LockoutDuration seconds once
+// LockoutFailures binds failed within LockoutWindow seconds, zero failures
+// disable the lockout.
+type LockoutPolicy struct {
+	LockoutFailures int
+	LockoutWindow   int
+	LockoutDuration int
+	// LockoutPerSourceIp counts the failures of every source address of a user
+	// separately, so failures from one address don't lock the user out at the
+	// others
+	LockoutPerSourceIp bool
+
+	// LockoutQuery, LockoutFailQuery, LockoutUpdateQuery and UnlockQuery
+	// persist the lockout in the database of the top level naming context
+	// instead of the memory of the proxy. They take the named parameters user,
+	// source, failures, since, lockedUntil and windowStart, the times are unix
+	// timestamps. LockoutFailQuery counts a failure in a single statement and
+	// returns the state like LockoutQuery, so proxies sharing the database
+	// count every failure.
+	LockoutQuery       string
+	LockoutFailQuery   string
+	LockoutUpdateQuery string
+	UnlockQuery        string
+}
+
+// SearchLimits are the maximum number of entries and seconds of a search,
+// zero means unlimited. Lower limits requested by a client are honored.
+type SearchLimits struct {
+	SizeLimit int
+	TimeLimit int
+	// SortLimit is the maximum number of entries sorted in memory
+	SortLimit int
+}
+
+// RateLimits restrict the binds and searches per client address and the binds
+// per user with token buckets, which are refilled by RateLimit tokens per
+// second up to RateBurst tokens. Operations exceeding a limit are delayed, the
+// delay doubles from TarpitDelay milliseconds as long as the limit is exceeded.
+// Operations are refused once the delay exceeds MaxTarpitDelay or while another
+// operation of the client or user is delayed. A zero limit is unlimited.
+type RateLimits struct {
+	RateLimit      float64
+	RateBurst      int
+	UserRateLimit  float64
+	UserRateBurst  int
+	TarpitDelay    int
+	MaxTarpitDelay int
+	// TrustedNetworks replace the limit of the client addresses within them
+	TrustedNetworks []TrustedNetwork
+}
+
+// TrustedNetwork limits the clients of a network, e.g. application servers, to
+// the RateLimit and RateBurst of the network. The Cidr is a network like
+// '192.0.2.0/24'.
+type TrustedNetwork struct {
+	Cidr      string
+	RateLimit float64
+	RateBurst int
 }
 
 type Result struct {
@@ -20,7 +215,106 @@ type Result struct {
 	Attributes map[string][]string
 }
 
+// ListOptions order the entries of a listing and select a range of them. The
+// zero value selects all entries ordered by their rdn.
+type ListOptions struct {
+	// Sort orders the entries by the values of the attributes before the rdn
+	Sort []SortKey
+	// Offset skips the first entries
+	Offset int
+	// Limit restricts the number of entries if it is positive
+	Limit int
+}
+
+// SortKey orders entries by an attribute. Entries with several values are
+// ordered by their smallest value, or their largest if the order is reversed.
+// Entries without value are ordered as if they had the largest value.
+type SortKey struct {
+	Attribute string
+	Reverse   bool
+}
+
+// ChangeOperation is the operation of a change (RFC 4511, section 4.6).
+type ChangeOperation int
+
+const (
+	// ChangeReplace sets the value, or removes it if the value is nil
+	ChangeReplace ChangeOperation = iota
+	// ChangeAdd adds the value
+	ChangeAdd
+	// ChangeDelete removes the value, which must equal the value of the change
+	// unless it is nil
+	ChangeDelete
+)
+
+// Change sets an attribute to the value, or removes its value.
+type Change struct {
+	Operation ChangeOperation
+	Attribute string
+	Value     *string
+}
+
+// The errors of the write operations of a backend, which are wrapped with the
+// statement, user or attribute they concern.
+var (
+	ErrNotConfigured = errors.New("not configured")
+	ErrNotFound      = errors.New("not found")
+	ErrExists        = errors.New("already exists")
+	ErrNoSuchValue   = errors.New("has no such value")
+	ErrValueExists   = errors.New("already has a value")
+	ErrSingleValue   = errors.New("takes a single value")
+)
+
+// PasswordPolicy is the state of the password of a user as far as it is held
+// by the backend (draft-behera-ldap-password-policy).
+type PasswordPolicy struct {
+	Locked bool
+	// LockedOut is set if the user is locked out after failed binds, which is
+	// reported without verifying the password
+	LockedOut bool
+	Expired   bool
+	// MustChange is set if the password has been reset and must be changed
+	MustChange bool
+	// GraceLogins is the number of logins left with an expired password
+	GraceLogins int
+	// ExpiresIn is the number of seconds until the password expires, zero if
+	// unknown
+	ExpiresIn int
+}
+
+// LockoutState counts the failed binds of a user since the first failure
+// within the lockout window.
+type LockoutState struct {
+	Failures int
+	Since    time.Time
+	// LockedUntil is the end of the lockout, zero if the user is not locked
+	LockedUntil time.Time
+}
+
+// LockoutStore persists the lockout states, keyed by the dn of the user and the
+// source address, which is empty unless failures are counted per source.
+type LockoutStore interface {
+	// Load returns the state, the zero state if nothing is stored
+	Load(user string, source string) (LockoutState, error)
+	// Fail counts a failed bind at the time, which starts a new window if the
+	// last one passed, and returns the new state
+	Fail(user string, source string, now time.Time) (LockoutState, error)
+	Save(user string, source string, state LockoutState) error
+	// Unlock removes the states of the user of all sources
+	Unlock(user string) error
+}
+
 type Backend interface {
-	Authenticate(username string, password string) bool
-	Search(user string, attributes []string) *Result
+	// Authenticate verifies the password of the user and returns the state of
+	// the password, which is returned even if the password is wrong
+	Authenticate(username string, password string) (bool, PasswordPolicy)
+	UpdatePassword(username string, passwordHash string) error
+	// Add, Modify and Delete change the users, the changes of an operation are
+	// applied all or none
+	Add(username string, attributes map[string][]string) error
+	Modify(username string, changes []Change) error
+	Delete(username string) error
+	Search(ctx context.Context, user string, filter *Filter, attributes []string) *Result
+	List(ctx context.Context, filter *Filter, attributes []string, options ListOptions, fn func(result *Result)) error
+	ListGroups(ctx context.Context, filter *Filter, attributes []string, options ListOptions, fn func(result *Result)) error
 }